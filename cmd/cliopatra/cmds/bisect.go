@@ -0,0 +1,292 @@
+package cmds
+
+import (
+	"context"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/bisect"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/helpers/templating"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/settings"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+type BisectCommand struct {
+	*cmds.CommandDescription
+}
+
+// NewBisectCommand returns a command that binary searches an ordered list of builds
+// of a tool for the first build for which a program behaves differently.
+func NewBisectCommand() *cobra.Command {
+	glazedParameterLayer, err := settings.NewGlazedParameterLayers()
+	cobra.CheckErr(err)
+
+	cmd := &BisectCommand{
+		CommandDescription: cmds.NewCommandDescription("bisect",
+			cmds.WithShort("Find the first build of a tool for which a program behaves differently"),
+			cmds.WithFlags(
+				parameters.NewParameterDefinition(
+					"repository",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Repositories to load programs from"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"program",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Name of the program to run"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"builds",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Builds of the tool from oldest to newest, as paths or globs (matches are sorted)"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"good-output",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("File containing the known-good stdout, instead of the expectations of the program"),
+				),
+				parameters.NewParameterDefinition(
+					"predicate",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Template that renders to true for good builds, given .Stdout, .Stderr, .ExitCode and .Build"),
+				),
+				newTimeoutParameter("timeout", "Timeout of each run, overridden by the program's timeout"),
+				newProfileParameter("run"),
+				newEnvParameter(),
+			),
+			cmds.WithLayersList(glazedParameterLayer),
+		),
+	}
+	cobraCommand, err := cli.BuildCobraCommandFromGlazeCommand(cmd)
+	cobra.CheckErr(err)
+
+	return cobraCommand
+}
+
+type BisectCommandSettings struct {
+	Repositories []string          `glazed.parameter:"repository"`
+	Program      string            `glazed.parameter:"program"`
+	Builds       []string          `glazed.parameter:"builds"`
+	GoodOutput   string            `glazed.parameter:"good-output"`
+	Predicate    string            `glazed.parameter:"predicate"`
+	Timeout      string            `glazed.parameter:"timeout"`
+	Profile      string            `glazed.parameter:"profile"`
+	Env          map[string]string `glazed.parameter:"env"`
+}
+
+func (b *BisectCommand) RunIntoGlazeProcessor(
+	ctx context.Context,
+	parsedLayers *layers.ParsedLayers,
+	gp middlewares.Processor,
+) error {
+	s := &BisectCommandSettings{}
+	err := parsedLayers.InitializeStruct(layers.DefaultSlug, s)
+	if err != nil {
+		return err
+	}
+	if s.GoodOutput != "" && s.Predicate != "" {
+		return errors.New("cannot specify both good-output and predicate")
+	}
+
+	r := pkg.NewRepository(s.Repositories, pkg.WithProfile(s.Profile), pkg.WithEnv(s.Env))
+	err = r.Load()
+	if err != nil {
+		return err
+	}
+	rp, err := r.Lookup(s.Program)
+	if err != nil {
+		return err
+	}
+
+	builds, err := expandBuilds(s.Builds)
+	if err != nil {
+		return err
+	}
+
+	options := []golden.Option{}
+	timeout, err := parseTimeout("timeout", s.Timeout)
+	if err != nil {
+		return err
+	}
+	if timeout != 0 {
+		options = append(options, golden.WithRunnerOptions(runner.WithTimeout(timeout)))
+	}
+
+	var isGood bisect.Predicate
+	if s.Predicate != "" {
+		isGood, err = newTemplatePredicate(rp, s.Predicate, options)
+	} else {
+		isGood, err = newGoldenPredicate(rp, s.GoodOutput, options)
+	}
+	if err != nil {
+		return err
+	}
+
+	outcome, err := bisect.Bisect(ctx, builds, isGood)
+	if err != nil {
+		return err
+	}
+
+	steps := outcome.Steps
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].Index < steps[j].Index
+	})
+	for _, step := range steps {
+		result := "bad"
+		if step.Good {
+			result = "good"
+		}
+		row := types.NewRow(
+			types.MRP("index", step.Index),
+			types.MRP("build", step.Build),
+			types.MRP("result", result),
+			types.MRP("first_bad", step.Index == outcome.FirstBad),
+			types.MRP("detail", step.Detail),
+		)
+		err = gp.AddRow(ctx, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandBuilds expands the globs in builds. Matches of a glob are sorted, while the
+// order of the arguments is kept.
+func expandBuilds(builds []string) ([]string, error) {
+	ret := []string{}
+	for _, build := range builds {
+		if _, err := os.Stat(build); err == nil {
+			ret = append(ret, build)
+			continue
+		}
+		matches, err := doublestar.FilepathGlob(build)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid build glob %s", build)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no build matches %s", build)
+		}
+		sort.Strings(matches)
+		ret = append(ret, matches...)
+	}
+
+	for i, build := range ret {
+		abs, err := absExecutable(build)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = abs
+	}
+
+	return ret, nil
+}
+
+func withBuild(options []golden.Option, build string) []golden.Option {
+	return append(append([]golden.Option{}, options...), golden.WithPathOverride(func(string) string {
+		return build
+	}))
+}
+
+// newGoldenPredicate checks builds against the expectations of the program, or
+// against the content of goodOutput if it is set.
+func newGoldenPredicate(rp *pkg.RepositoryProgram, goodOutput string, options []golden.Option) (bisect.Predicate, error) {
+	if goodOutput != "" {
+		b, err := os.ReadFile(goodOutput)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read %s", goodOutput)
+		}
+		rp.Program().ExpectedStdout = string(b)
+	}
+	if !golden.HasExpectations(rp) {
+		return nil, errors.Errorf("program %s declares no expectations, pass --good-output or --predicate", rp.Program().Name)
+	}
+
+	return func(ctx context.Context, build string) (*bisect.Verdict, error) {
+		res := golden.RunProgram(ctx, rp, withBuild(options, build)...)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// a build that can't run the program, for example because it crashes or
+		// times out, behaves differently as well
+		switch res.Status {
+		case golden.StatusPass:
+			return &bisect.Verdict{Good: true}, nil
+		case golden.StatusError:
+			return &bisect.Verdict{Detail: res.Err.Error()}, nil
+		case golden.StatusFail,
+			golden.StatusSkip,
+			golden.StatusUpdated,
+			golden.StatusUnchanged:
+		}
+
+		details := []string{}
+		for _, c := range res.FailedChecks() {
+			details = append(details, c.Name+": "+c.DiffSummary())
+		}
+		return &bisect.Verdict{Detail: strings.Join(details, "\n")}, nil
+	}, nil
+}
+
+type predicateData struct {
+	Build    string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// newTemplatePredicate checks builds by rendering the predicate template with the
+// outputs of the program. A build is good if the template renders to true.
+func newTemplatePredicate(rp *pkg.RepositoryProgram, predicate string, options []golden.Option) (bisect.Predicate, error) {
+	t, err := templating.CreateTemplate("predicate").Parse(predicate)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse predicate")
+	}
+
+	return func(ctx context.Context, build string) (*bisect.Verdict, error) {
+		res := golden.ExecuteProgram(ctx, rp, withBuild(options, build)...)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if res.Err != nil {
+			return &bisect.Verdict{Detail: res.Err.Error()}, nil
+		}
+
+		return evaluatePredicate(t, &predicateData{
+			Build:    build,
+			Stdout:   res.Output.Stdout,
+			Stderr:   res.Output.Stderr,
+			ExitCode: res.Output.ExitCode,
+		})
+	}, nil
+}
+
+func evaluatePredicate(t *template.Template, data *predicateData) (*bisect.Verdict, error) {
+	sb := &strings.Builder{}
+	err := t.Execute(sb, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not evaluate predicate")
+	}
+	v := strings.TrimSpace(sb.String())
+	if v == "true" {
+		return &bisect.Verdict{Good: true}, nil
+	}
+	return &bisect.Verdict{Detail: "predicate is " + v}, nil
+}
@@ -0,0 +1,220 @@
+package cmds
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/cliopatra/pkg/selector"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/settings"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type CompareProgramsCommand struct {
+	*cmds.CommandDescription
+	different int
+}
+
+// NewCompareCommand returns a command that runs the programs of the repositories
+// with two versions of a tool, and compares the outputs of both versions.
+//
+// It emits one row per output of each program, and exits with a non-zero status if
+// any of the programs behaved differently.
+func NewCompareCommand() *cobra.Command {
+	glazedParameterLayer, err := settings.NewGlazedParameterLayers()
+	cobra.CheckErr(err)
+
+	cmd := &CompareProgramsCommand{
+		CommandDescription: cmds.NewCommandDescription("compare",
+			cmds.WithShort("Compare the outputs of repository programs run with two versions of a tool"),
+			cmds.WithFlags(
+				parameters.NewParameterDefinition(
+					"repository",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Repositories to load programs from"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"baseline",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Executable whose outputs are the reference"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"candidate",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Executable to compare with the baseline"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"tool",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Executable replaced by the baseline and the candidate, by path or base name"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"full-diff",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Output the full diff instead of a summary"),
+					parameters.WithDefault(false),
+				),
+				parameters.NewParameterDefinition(
+					"jobs",
+					parameters.ParameterTypeInteger,
+					parameters.WithHelp("Number of programs to run in parallel"),
+					parameters.WithDefault(4),
+				),
+				newTimeoutParameter("timeout", "Default timeout of a program, overridden by the program's timeout"),
+				newProfileParameter("run"),
+				newEnvParameter(),
+				newMatchParameter("compare"),
+			),
+			cmds.WithLayersList(glazedParameterLayer),
+		),
+	}
+	cobraCommand, err := cli.BuildCobraCommandFromGlazeCommand(cmd)
+	cobra.CheckErr(err)
+
+	// see NewTestCommand
+	origRun := cobraCommand.Run
+	cobraCommand.Run = func(c *cobra.Command, args []string) {
+		origRun(c, args)
+		if cmd.different > 0 {
+			os.Exit(1)
+		}
+	}
+
+	return cobraCommand
+}
+
+type CompareCommandSettings struct {
+	Repositories []string          `glazed.parameter:"repository"`
+	Baseline     string            `glazed.parameter:"baseline"`
+	Candidate    string            `glazed.parameter:"candidate"`
+	Tool         string            `glazed.parameter:"tool"`
+	FullDiff     bool              `glazed.parameter:"full-diff"`
+	Jobs         int               `glazed.parameter:"jobs"`
+	Timeout      string            `glazed.parameter:"timeout"`
+	Profile      string            `glazed.parameter:"profile"`
+	Env          map[string]string `glazed.parameter:"env"`
+	Match        string            `glazed.parameter:"match"`
+}
+
+func (c *CompareProgramsCommand) RunIntoGlazeProcessor(
+	ctx context.Context,
+	parsedLayers *layers.ParsedLayers,
+	gp middlewares.Processor,
+) error {
+	s := &CompareCommandSettings{}
+	err := parsedLayers.InitializeStruct(layers.DefaultSlug, s)
+	if err != nil {
+		return err
+	}
+	r := pkg.NewRepository(s.Repositories, pkg.WithProfile(s.Profile), pkg.WithEnv(s.Env))
+	err = r.Load()
+	if err != nil {
+		return err
+	}
+
+	sel, err := selector.Parse(s.Match)
+	if err != nil {
+		return err
+	}
+	rps := selector.Filter(sel, r.GetRepositoryPrograms())
+
+	options := []golden.Option{}
+	timeout, err := parseTimeout("timeout", s.Timeout)
+	if err != nil {
+		return err
+	}
+	if timeout != 0 {
+		options = append(options, golden.WithRunnerOptions(runner.WithTimeout(timeout)))
+	}
+
+	baseline, err := absExecutable(s.Baseline)
+	if err != nil {
+		return err
+	}
+	candidate, err := absExecutable(s.Candidate)
+	if err != nil {
+		return err
+	}
+
+	err = checkTool(rps, s.Tool)
+	if err != nil {
+		return err
+	}
+
+	f := golden.NewDifferentialFunc(s.Tool, baseline, candidate)
+	results, err := golden.RunAll(ctx, runner.NewPool(s.Jobs), rps, f, options...)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		if res.Status == golden.StatusFail || res.Status == golden.StatusError {
+			c.different++
+		}
+		errString := ""
+		if res.Err != nil {
+			errString = res.Err.Error()
+		}
+
+		checks := res.Checks
+		if len(checks) == 0 {
+			checks = []*golden.Check{{Status: res.Status}}
+		}
+		for _, check := range checks {
+			status := "same"
+			switch check.Status {
+			case golden.StatusFail:
+				status = "different"
+			case golden.StatusError:
+				status = "error"
+			case golden.StatusSkip:
+				status = "skipped"
+			case golden.StatusPass,
+				golden.StatusUpdated,
+				golden.StatusUnchanged:
+			}
+			diff := check.DiffSummary()
+			if s.FullDiff {
+				diff = check.Diff
+			}
+
+			row := types.NewRow(
+				types.MRP("name", res.Name),
+				types.MRP("path", res.Path),
+				types.MRP("output", check.Name),
+				types.MRP("status", status),
+				types.MRP("diff", diff),
+				types.MRP("error", errString),
+			)
+			err = gp.AddRow(ctx, row)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkTool returns an error if none of rps runs tool. All the programs would be
+// skipped, and the comparison would pass without having compared anything.
+func checkTool(rps []*pkg.RepositoryProgram, tool string) error {
+	for _, rp := range rps {
+		if golden.RunsExecutable(rp, tool) {
+			return nil
+		}
+	}
+	return errors.Errorf("no selected program runs %s", tool)
+}
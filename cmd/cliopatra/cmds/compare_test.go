@@ -0,0 +1,20 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckTool(t *testing.T) {
+	rps := loadTestRepositories(t, map[string]string{
+		"glaze.yaml": "name: glaze-yaml\npath: /usr/local/bin/glaze\n",
+		"jq.yaml":    "name: jq\n",
+	})
+
+	assert.NoError(t, checkTool(rps, "glaze"))
+	assert.NoError(t, checkTool(rps, "/usr/local/bin/glaze"))
+	assert.NoError(t, checkTool(rps, "jq"))
+	// the base name of the candidate, which no program runs
+	assert.Error(t, checkTool(rps, "new-glaze"))
+	assert.Error(t, checkTool(nil, "glaze"))
+}
@@ -0,0 +1,29 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+)
+
+// All the glazed commands loading the programs of the repositories take --profile and
+// --env, so that programs whose values refer to variables of a profile can be loaded by
+// any of them. run is a plain cobra command and declares its own flags.
+
+// newProfileParameter returns the definition of the --profile flag, verb being what
+// the command does with the programs, such as "run".
+func newProfileParameter(verb string) *parameters.ParameterDefinition {
+	return parameters.NewParameterDefinition(
+		"profile",
+		parameters.ParameterTypeString,
+		parameters.WithHelp("Environment profile of the repositories to "+verb+" the programs with"),
+	)
+}
+
+// newEnvParameter returns the definition of the --env flag.
+func newEnvParameter() *parameters.ParameterDefinition {
+	return parameters.NewParameterDefinition(
+		"env",
+		parameters.ParameterTypeKeyValue,
+		parameters.WithHelp("Environment variables set on top of the environment of the programs, as KEY:VALUE"),
+		parameters.WithDefault(map[string]string{}),
+	)
+}
@@ -0,0 +1,22 @@
+package cmds
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCommandsLoadingProgramsTakeProfileAndEnv(t *testing.T) {
+	for _, c := range []*cobra.Command{
+		NewRunCommand(),
+		NewRenderCommand(),
+		NewTestCommand(),
+		NewRerecordCommand(),
+		NewCompareCommand(),
+		NewBisectCommand(),
+		NewWorkflowRunCommand(),
+	} {
+		assert.NotNil(t, c.Flags().Lookup("profile"), c.Name())
+		assert.NotNil(t, c.Flags().Lookup("env"), c.Name())
+	}
+}
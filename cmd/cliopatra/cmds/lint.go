@@ -0,0 +1,131 @@
+package cmds
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/lint"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/settings"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type LintCommand struct {
+	*cmds.CommandDescription
+	errors int
+}
+
+// NewLintCommand returns a command that checks the program files of the repositories
+// and outputs one row per issue.
+//
+// It exits with a non-zero status if any error is left unfixed.
+func NewLintCommand() *cobra.Command {
+	glazedParameterLayer, err := settings.NewGlazedParameterLayers()
+	cobra.CheckErr(err)
+
+	cmd := &LintCommand{
+		CommandDescription: cmds.NewCommandDescription("lint",
+			cmds.WithShort("Check the program files of repositories"),
+			cmds.WithFlags(
+				parameters.NewParameterDefinition(
+					"repository",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Repositories to check"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"fix",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Rewrite the program files to fix the fixable issues"),
+					parameters.WithDefault(false),
+				),
+				parameters.NewParameterDefinition(
+					"probe-verbs",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Run <path> <verbs> --help to check that the verbs of the programs exist"),
+					parameters.WithDefault(true),
+				),
+				newTimeoutParameter("probe-timeout", "Timeout of each verb probe, 5s by default"),
+				newProfileParameter("check"),
+			),
+			cmds.WithLayersList(glazedParameterLayer),
+		),
+	}
+	cobraCommand, err := cli.BuildCobraCommandFromGlazeCommand(cmd)
+	cobra.CheckErr(err)
+
+	// The glazed processor needs to be closed for the rows to be output,
+	// so we only report errors once the original command has run.
+	origRun := cobraCommand.Run
+	cobraCommand.Run = func(c *cobra.Command, args []string) {
+		origRun(c, args)
+		if cmd.errors > 0 {
+			os.Exit(1)
+		}
+	}
+
+	return cobraCommand
+}
+
+type LintCommandSettings struct {
+	Repositories []string `glazed.parameter:"repository"`
+	Fix          bool     `glazed.parameter:"fix"`
+	ProbeVerbs   bool     `glazed.parameter:"probe-verbs"`
+	ProbeTimeout string   `glazed.parameter:"probe-timeout"`
+	Profile      string   `glazed.parameter:"profile"`
+}
+
+func (l *LintCommand) RunIntoGlazeProcessor(
+	ctx context.Context,
+	parsedLayers *layers.ParsedLayers,
+	gp middlewares.Processor,
+) error {
+	s := &LintCommandSettings{}
+	err := parsedLayers.InitializeStruct(layers.DefaultSlug, s)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := parseTimeout("probe-timeout", s.ProbeTimeout)
+	if err != nil {
+		return err
+	}
+	linterOptions := []lint.Option{
+		lint.WithFix(s.Fix),
+		lint.WithProbeVerbs(s.ProbeVerbs),
+	}
+	if timeout != 0 {
+		linterOptions = append(linterOptions, lint.WithProbeTimeout(timeout))
+	}
+	linter := lint.NewLinter(linterOptions...)
+	issues, err := linter.Lint(ctx, s.Repositories, pkg.WithProfile(s.Profile))
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range issues {
+		if issue.Severity == lint.SeverityError && !issue.Fixed {
+			l.errors++
+		}
+		err = gp.AddRow(ctx, types.NewRow(
+			types.MRP("path", issue.Path),
+			types.MRP("line", issue.Line),
+			types.MRP("program", issue.Program),
+			types.MRP("check", string(issue.Check)),
+			types.MRP("severity", string(issue.Severity)),
+			types.MRP("message", issue.Message),
+			types.MRP("fixable", issue.Fixable),
+			types.MRP("fixed", issue.Fixed),
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package cmds
 import (
 	"context"
 	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/selector"
 	"github.com/go-go-golems/glazed/pkg/cli"
 	"github.com/go-go-golems/glazed/pkg/cmds"
 	"github.com/go-go-golems/glazed/pkg/cmds/layers"
@@ -32,6 +33,13 @@ func NewLsCommand() *cobra.Command {
 					parameters.WithHelp("Repositories to load programs from"),
 					parameters.WithRequired(true),
 				),
+				parameters.NewParameterDefinition(
+					"shadows",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("List the programs shadowed by programs with the same name instead"),
+					parameters.WithDefault(false),
+				),
+				newMatchParameter("list"),
 			),
 			cmds.WithLayersList(glazedParameterLayer),
 		),
@@ -44,6 +52,8 @@ func NewLsCommand() *cobra.Command {
 
 type LsCommandSettings struct {
 	Repositories []string `glazed.parameter:"repository"`
+	Shadows      bool     `glazed.parameter:"shadows"`
+	Match        string   `glazed.parameter:"match"`
 }
 
 func (l *LsProgramCommand) RunIntoGlazeProcessor(
@@ -62,15 +72,27 @@ func (l *LsProgramCommand) RunIntoGlazeProcessor(
 		return err
 	}
 
-	for _, program := range r.GetPrograms() {
+	sel, err := selector.Parse(s.Match)
+	if err != nil {
+		return err
+	}
+
+	if s.Shadows {
+		return addShadowRows(ctx, gp, sel, r.GetShadows())
+	}
+
+	for _, rp := range selector.Filter(sel, r.GetRepositoryPrograms()) {
+		program := rp.Program()
 		ps_, err2 := program.ComputeArgs(parsedLayers.GetAllParsedParameters())
 		if err2 != nil {
 			return err2
 		}
 		obj := types.NewRow(
 			types.MRP("name", program.Name),
+			types.MRP("qualified_name", rp.QualifiedName()),
 			types.MRP("desc", program.Description),
 			types.MRP("args", strings.Join(ps_, " ")),
+			types.MRP("tags", strings.Join(rp.Spec().Tags, ",")),
 		)
 		err := gp.AddRow(ctx, obj)
 		if err != nil {
@@ -80,3 +102,27 @@ func (l *LsProgramCommand) RunIntoGlazeProcessor(
 
 	return nil
 }
+
+// addShadowRows outputs one row per shadowed program matched by sel, along with the
+// program its name resolves to.
+func addShadowRows(ctx context.Context, gp middlewares.Processor, sel selector.Selector, shadows []*pkg.Shadow) error {
+	for _, shadow := range shadows {
+		if !sel.Match(shadow.Shadowed) {
+			continue
+		}
+		resolvesTo := ""
+		if shadow.Program != nil {
+			resolvesTo = shadow.Program.Path()
+		}
+		err := gp.AddRow(ctx, types.NewRow(
+			types.MRP("name", shadow.Name),
+			types.MRP("kind", string(shadow.Kind)),
+			types.MRP("shadowed", shadow.Shadowed.Path()),
+			types.MRP("resolves_to", resolvesTo),
+		))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
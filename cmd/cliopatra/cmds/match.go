@@ -0,0 +1,20 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+)
+
+// All the commands working on a subset of the programs of the repositories take the
+// selector expression of package selector with --match. It can't be --select, which
+// glazed commands use to select an output field, nor a positional argument, which
+// run uses for the program and its arguments.
+
+// newMatchParameter returns the definition of the --match flag, verb being what the
+// command does with the matched programs, such as "list".
+func newMatchParameter(verb string) *parameters.ParameterDefinition {
+	return parameters.NewParameterDefinition(
+		"match",
+		parameters.ParameterTypeString,
+		parameters.WithHelp("Only "+verb+" the programs matching a selector expression, for example 'tag:sqleton and not tag:slow'"),
+	)
+}
@@ -0,0 +1,109 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/overrides"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// AddProgramCommands registers each program of the repository as a subcommand of
+// rootCmd, so that `cliopatra reports ttc-orders --from 2023-01-01` runs the program
+// ttc-orders stored in the reports directory of a repository.
+//
+// Programs are nested under one command per directory or per verb, depending on the
+// configuration of their repository. Programs are added in order, and programs that
+// would shadow an existing command are skipped.
+func AddProgramCommands(rootCmd *cobra.Command, rps []*pkg.RepositoryProgram) error {
+	for _, rp := range rps {
+		path := rp.CommandPath()
+		name := path[len(path)-1]
+
+		parent := rootCmd
+		for _, group := range path[:len(path)-1] {
+			parent = getOrAddGroupCommand(parent, group)
+			if parent == nil {
+				break
+			}
+		}
+		if parent == nil || findSubcommand(parent, name) != nil {
+			log.Warn().Str("program", rp.QualifiedName()).Str("command", strings.Join(path, " ")).
+				Msg("program shadows an existing command, skipping")
+			continue
+		}
+
+		cmd, err := NewProgramCommand(rp)
+		if err != nil {
+			return err
+		}
+		parent.AddCommand(cmd)
+	}
+
+	return nil
+}
+
+// NewProgramCommand returns a command running rp, with the flags and arguments of the
+// program exposed as typed flags and positional arguments.
+func NewProgramCommand(rp *pkg.RepositoryProgram) (*cobra.Command, error) {
+	p := rp.Program()
+	use := p.Name
+	if usage := overrides.ArgsUsage(p); usage != "" {
+		use += " " + usage
+	}
+
+	ret := &cobra.Command{
+		Use:   use,
+		Short: p.Description,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+
+			err := runRepositoryProgram(ctx, rp, &runSettings{}, func(p *cliopatra.Program) (*cliopatra.Program, error) {
+				return overrides.Apply(cmd.Flags(), args, p)
+			})
+			exitOnError(err)
+		},
+	}
+
+	err := overrides.AddFlags(ret.Flags(), p)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// getOrAddGroupCommand returns the subcommand of parent grouping programs under name,
+// creating it if necessary. It returns nil if parent already has a subcommand with
+// that name that isn't a group of programs.
+func getOrAddGroupCommand(parent *cobra.Command, name string) *cobra.Command {
+	if cmd := findSubcommand(parent, name); cmd != nil {
+		if _, ok := cmd.Annotations["cliopatra-group"]; !ok {
+			return nil
+		}
+		return cmd
+	}
+
+	ret := &cobra.Command{
+		Use:   name,
+		Short: "Programs in " + name,
+		Annotations: map[string]string{
+			"cliopatra-group": name,
+		},
+	}
+	parent.AddCommand(ret)
+	return ret
+}
+
+func findSubcommand(parent *cobra.Command, name string) *cobra.Command {
+	for _, cmd := range parent.Commands() {
+		if cmd.Name() == name || cmd.HasAlias(name) {
+			return cmd
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func loadTestRepositories(t *testing.T, repositories ...map[string]string) []*pkg.RepositoryProgram {
+	dirs := []string{}
+	for _, files := range repositories {
+		dir := t.TempDir()
+		for name, content := range files {
+			p := filepath.Join(dir, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		}
+		dirs = append(dirs, dir)
+	}
+
+	r := pkg.NewRepository(dirs)
+	require.NoError(t, r.Load())
+	return r.GetOrderedRepositoryPrograms()
+}
+
+// commandPaths returns the paths of the commands under cmd, groups included.
+func commandPaths(cmd *cobra.Command) []string {
+	ret := []string{}
+	for _, c := range cmd.Commands() {
+		ret = append(ret, strings.TrimPrefix(c.CommandPath(), "cliopatra "))
+		ret = append(ret, commandPaths(c)...)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestAddProgramCommands(t *testing.T) {
+	tests := []struct {
+		name         string
+		repositories []map[string]string
+		expected     []string
+	}{
+		{
+			name: "by directory",
+			repositories: []map[string]string{{
+				"echo.yaml":                 "name: echo\npath: echo\n",
+				"reports/orders.yaml":       "name: ttc-orders\nverbs: [ttc, orders]\n",
+				"reports/sales/totals.yaml": "name: totals\n",
+			}},
+			expected: []string{"echo", "reports", "reports sales", "reports sales totals", "reports ttc-orders", "run", "test"},
+		},
+		{
+			name: "by verbs",
+			repositories: []map[string]string{{
+				".cliopatra.yaml":      "commandNesting: verbs\n",
+				"echo.yaml":            "name: echo\npath: echo\n",
+				"reports/orders.yaml":  "name: ttc-orders\nverbs: [ttc, orders]\n",
+				"reports/refunds.yaml": "name: ttc-refunds\nverbs: [ttc, refunds]\n",
+			}},
+			expected: []string{"echo", "run", "test", "ttc", "ttc orders", "ttc orders ttc-orders", "ttc refunds", "ttc refunds ttc-refunds"},
+		},
+		{
+			name: "built-in commands",
+			repositories: []map[string]string{{
+				"run.yaml":        "name: run\n",
+				"run/nested.yaml": "name: nested\n",
+				"test/echo.yaml":  "name: echo\n",
+			}},
+			expected: []string{"run", "test"},
+		},
+		{
+			name: "same command in two repositories",
+			repositories: []map[string]string{
+				{"reports/orders.yaml": "name: orders\npath: first\n"},
+				{"reports/orders.yaml": "name: orders\npath: second\n", "reports/totals.yaml": "name: totals\n"},
+			},
+			expected: []string{"reports", "reports orders", "reports totals", "run", "test"},
+		},
+		{
+			// the program comes first, its command can't be a group
+			name: "program named like a group",
+			repositories: []map[string]string{{
+				"reports.yaml":        "name: reports\n",
+				"reports/orders.yaml": "name: orders\n",
+			}},
+			expected: []string{"reports", "run", "test"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootCmd := &cobra.Command{Use: "cliopatra"}
+			rootCmd.AddCommand(&cobra.Command{Use: "run"}, &cobra.Command{Use: "test"})
+
+			err := AddProgramCommands(rootCmd, loadTestRepositories(t, tt.repositories...))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, commandPaths(rootCmd))
+		})
+	}
+}
+
+func TestAddProgramCommandsPrecedence(t *testing.T) {
+	rootCmd := &cobra.Command{Use: "cliopatra"}
+	err := AddProgramCommands(rootCmd, loadTestRepositories(t,
+		map[string]string{"reports/orders.yaml": "name: orders\ndescription: first\n"},
+		map[string]string{"reports/orders.yaml": "name: orders\ndescription: second\n"},
+	))
+	require.NoError(t, err)
+
+	cmd, _, err := rootCmd.Find([]string{"reports", "orders"})
+	require.NoError(t, err)
+	assert.Equal(t, "first", cmd.Short)
+}
+
+func TestNewProgramCommand(t *testing.T) {
+	rps := loadTestRepositories(t, map[string]string{
+		"orders.yaml": `name: orders
+description: Show orders.
+flags:
+  - name: limit
+    type: int
+    value: 10
+args:
+  - name: status
+    type: string
+    value: open
+`,
+	})
+	require.Len(t, rps, 1)
+
+	cmd, err := NewProgramCommand(rps[0])
+	require.NoError(t, err)
+	assert.Equal(t, "orders", cmd.Name())
+	assert.Equal(t, "Show orders.", cmd.Short)
+	f := cmd.Flags().Lookup("limit")
+	require.NotNil(t, f)
+	assert.Equal(t, "10", f.DefValue)
+}
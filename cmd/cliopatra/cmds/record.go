@@ -0,0 +1,190 @@
+package cmds
+
+import (
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/fschange"
+	"github.com/go-go-golems/cliopatra/pkg/normalize"
+	"github.com/go-go-golems/cliopatra/pkg/record"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// NewRecordCommand returns a command that runs an arbitrary command line and
+// records it, along with its output, as a program file.
+func NewRecordCommand() *cobra.Command {
+	recordCommand := &cobra.Command{
+		Use:   "record --name <name> -- <command> [args...]",
+		Short: "Run a command and record it as a program file",
+		Long: `Run a command and record it as a program file.
+
+The command line is split into path, verbs, flags and arguments using a heuristic
+that can be tuned with --verbs, --bool-flag, --value-flag and --raw-flags.
+Its stdout, stderr and exit code are stored as the expected outputs of the program,
+normalized by the filters of the repository and the --normalize filters.
+
+With --capture-files or --fixture, the command is run in a temporary directory into
+which the fixtures, relative to the repository, are copied, as it will be when testing
+the program.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name, err := cmd.Flags().GetString("name")
+			cobra.CheckErr(err)
+			description, err := cmd.Flags().GetString("description")
+			cobra.CheckErr(err)
+			repository, err := cmd.Flags().GetString("repository")
+			cobra.CheckErr(err)
+			force, err := cmd.Flags().GetBool("force")
+			cobra.CheckErr(err)
+
+			verbs, err := cmd.Flags().GetInt("verbs")
+			cobra.CheckErr(err)
+			boolFlags, err := cmd.Flags().GetStringSlice("bool-flag")
+			cobra.CheckErr(err)
+			valueFlags, err := cmd.Flags().GetStringSlice("value-flag")
+			cobra.CheckErr(err)
+			rawFlags, err := cmd.Flags().GetBool("raw-flags")
+			cobra.CheckErr(err)
+
+			p, err := record.NewProgramFromArgs(name, args,
+				record.WithVerbs(verbs),
+				record.WithBoolFlags(boolFlags...),
+				record.WithValueFlags(valueFlags...),
+				record.WithRawFlags(rawFlags),
+			)
+			cobra.CheckErr(err)
+			p.Description = description
+
+			env, err := cmd.Flags().GetStringArray("env")
+			cobra.CheckErr(err)
+			captureEnv, err := cmd.Flags().GetStringSlice("capture-env")
+			cobra.CheckErr(err)
+			if len(env) > 0 || len(captureEnv) > 0 {
+				p.Env = map[string]string{}
+			}
+			for _, e := range env {
+				k, v, ok := strings.Cut(e, "=")
+				if !ok {
+					cobra.CheckErr(errors.Errorf("invalid environment variable %s, expected KEY=VALUE", e))
+				}
+				p.Env[k] = v
+			}
+			for _, k := range captureEnv {
+				v, ok := os.LookupEnv(k)
+				if !ok {
+					cobra.CheckErr(errors.Errorf("environment variable %s is not set", k))
+				}
+				p.Env[k] = v
+			}
+
+			stdin, err := cmd.Flags().GetString("stdin")
+			cobra.CheckErr(err)
+			if stdin != "" {
+				var b []byte
+				if stdin == "-" {
+					b, err = io.ReadAll(os.Stdin)
+				} else {
+					b, err = os.ReadFile(stdin)
+				}
+				cobra.CheckErr(err)
+				p.Stdin = string(b)
+			}
+
+			timeoutString, err := cmd.Flags().GetString("timeout")
+			cobra.CheckErr(err)
+			timeout, err := parseTimeout("timeout", timeoutString)
+			cobra.CheckErr(err)
+
+			captureFiles, err := cmd.Flags().GetBool("capture-files")
+			cobra.CheckErr(err)
+			fixtures, err := cmd.Flags().GetStringSlice("fixture")
+			cobra.CheckErr(err)
+			normalizeFilters, err := cmd.Flags().GetStringSlice("normalize")
+			cobra.CheckErr(err)
+			ignoreFiles, err := cmd.Flags().GetStringSlice("ignore-files")
+			cobra.CheckErr(err)
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+
+			spec := &pkg.ProgramSpec{
+				Fixtures: fixtures,
+			}
+			for _, name := range normalizeFilters {
+				f, err := normalize.NewFilter(normalize.FilterType(name))
+				cobra.CheckErr(err)
+				spec.Normalize = append(spec.Normalize, f)
+			}
+			// outputs are stored as the tests will compare them
+			config, err := pkg.LoadRepositoryConfigFromFS(os.DirFS(repository))
+			cobra.CheckErr(err)
+			normalizers := append(append(normalize.Pipeline{}, config.Normalize...), spec.Normalize...)
+
+			options := []runner.Option{runner.WithTimeout(timeout)}
+			var workdir *runner.Workdir
+			// the command is run where the program will be run when testing it
+			if captureFiles || len(fixtures) > 0 {
+				workdir, err = runner.NewWorkdir(repository, fixtures, false)
+				cobra.CheckErr(err)
+				defer func() {
+					_ = workdir.Close()
+				}()
+				options = append(options, runner.WithDir(workdir.Path))
+			}
+
+			var before *fschange.Snapshot
+			if captureFiles {
+				before, err = fschange.TakeSnapshot(workdir.Path, ignoreFiles)
+				cobra.CheckErr(err)
+				spec.CaptureFileChanges = true
+				spec.IgnoreFileChanges = ignoreFiles
+			}
+
+			output, err := runner.NewRunner(options...).Run(ctx, p)
+			cobra.CheckErr(err)
+			p.ExpectedStdout = normalizers.Apply(output.Stdout)
+			p.ExpectedError = normalizers.Apply(output.Stderr)
+			p.ExpectedStatusCode = output.ExitCode
+
+			if before != nil {
+				after, err := fschange.TakeSnapshot(workdir.Path, before.Ignore())
+				cobra.CheckErr(err)
+				spec.ExpectedFileChanges, err = fschange.Diff(before, after)
+				cobra.CheckErr(err)
+				for _, c := range spec.ExpectedFileChanges {
+					c.Content = normalizers.Apply(c.Content)
+				}
+			}
+
+			path, err := record.WriteProgram(repository, p, spec, force)
+			cobra.CheckErr(err)
+
+			fmt.Println(path)
+		},
+	}
+
+	recordCommand.Flags().SetInterspersed(false)
+	recordCommand.Flags().String("name", "", "Name of the program, defaults to the name of the executable")
+	recordCommand.Flags().String("description", "", "Description of the program")
+	recordCommand.Flags().String("repository", ".", "Repository directory to write the program file to")
+	recordCommand.Flags().Bool("force", false, "Overwrite an existing program file")
+	recordCommand.Flags().Int("verbs", 0, "Number of words after the command that are verbs, such as log in git log")
+	recordCommand.Flags().StringSlice("bool-flag", []string{}, "Flags that don't take a value")
+	recordCommand.Flags().StringSlice("value-flag", []string{}, "Flags that always take a value")
+	recordCommand.Flags().Bool("raw-flags", false, "Record everything after the verbs as raw flags")
+	recordCommand.Flags().StringArray("env", []string{}, "Environment variable to set, as KEY=VALUE")
+	recordCommand.Flags().StringSlice("capture-env", []string{}, "Environment variables to copy from the current environment")
+	recordCommand.Flags().String("stdin", "", "File to pass as stdin, - to read it from stdin")
+	recordCommand.Flags().String("timeout", "", "Timeout of the command (for example 30s or 2m)")
+	recordCommand.Flags().Bool("capture-files", false, "Record the files created, modified and deleted by the command, which is run in a temporary directory")
+	recordCommand.Flags().StringSlice("fixture", []string{}, "Files or directories of the repository copied into the temporary directory the command is run in")
+	recordCommand.Flags().StringSlice("ignore-files", []string{}, "Globs of files whose changes are not recorded")
+	recordCommand.Flags().StringSlice("normalize", []string{}, "Normalization filters of the program, applied to the outputs along with the filters of the repository (trim-trailing-whitespace, sort-lines, mask-iso-dates, mask-uuids)")
+
+	return recordCommand
+}
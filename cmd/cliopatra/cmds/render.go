@@ -32,6 +32,10 @@ type renderSettings struct {
 	Quiet                bool              `glazed.parameter:"quiet"`
 	RenameOutputFiles    map[string]string `glazed.parameter:"rename-output-files"`
 	BaseDirectory        string            `glazed.parameter:"base-directory"`
+	Timeout              string            `glazed.parameter:"timeout"`
+	DryRun               bool              `glazed.parameter:"dry-run"`
+	Profile              string            `glazed.parameter:"profile"`
+	Env                  map[string]string `glazed.parameter:"env"`
 	Files                []string          `glazed.argument:"files"`
 }
 
@@ -117,6 +121,15 @@ func NewRenderCommand() *cobra.Command {
 				parameters.ParameterTypeString,
 				parameters.WithHelp("Base directory"),
 			),
+			newTimeoutParameter("timeout", "Timeout of each program run from a template"),
+			parameters.NewParameterDefinition(
+				"dry-run",
+				parameters.ParameterTypeBool,
+				parameters.WithHelp("Insert how programs would be run instead of running them"),
+				parameters.WithDefault(false),
+			),
+			newProfileParameter("run"),
+			newEnvParameter(),
 		),
 	)
 	cobra.CheckErr(err)
@@ -152,7 +165,10 @@ func NewRenderCommand() *cobra.Command {
 		err = parsedLayers.InitializeStruct(layers.DefaultSlug, s)
 		cobra.CheckErr(err)
 
-		repository := pkg.NewRepository(settings.Repository)
+		repository := pkg.NewRepository(settings.Repository,
+			pkg.WithProfile(settings.Profile),
+			pkg.WithEnv(settings.Env),
+		)
 		err = repository.Load()
 		cobra.CheckErr(err)
 
@@ -167,6 +183,7 @@ func NewRenderCommand() *cobra.Command {
 			render.WithYamlMarkers(settings.WithYamlMarkers),
 			render.WithAllowProgramCreation(settings.AllowProgramCreation),
 			render.WithVerbose(!settings.Quiet),
+			render.WithDryRun(settings.DryRun),
 		}
 		if settings.Glob != nil {
 			options = append(options, render.WithMasks(settings.Glob...))
@@ -176,12 +193,21 @@ func NewRenderCommand() *cobra.Command {
 			options = append(options, render.WithDelimiters(settings.Delimiters[0], settings.Delimiters[1]))
 		}
 
+		timeout, err := parseTimeout("timeout", settings.Timeout)
+		cobra.CheckErr(err)
+		if timeout != 0 {
+			options = append(options, render.WithTimeout(timeout))
+		}
+
 		if settings.OutputDirectory != "" {
 			options = append(options, render.WithRenameOutputFiles(settings.RenameOutputFiles))
 		}
 
 		renderer := render.NewRenderer(options...)
 
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+
 		if settings.OutputFile != "" && len(s.Files) > 1 {
 			cobra.CheckErr(errors.New("output-file parameter can only be used with a single file"))
 		}
@@ -204,42 +230,48 @@ func NewRenderCommand() *cobra.Command {
 			}
 		}
 
-		for _, file := range s.Files {
-			// check if file is a directory
-			fi, err := os.Stat(file)
-			cobra.CheckErr(err)
-
-			if fi.IsDir() {
-				if settings.OutputDirectory == "" {
-					cobra.CheckErr(errors.New("output-directory parameter is required when rendering a directory"))
+		renderAll := func(ctx context.Context) error {
+			for _, file := range s.Files {
+				// check if file is a directory
+				fi, err := os.Stat(file)
+				if err != nil {
+					return err
 				}
 
-				err = renderer.RenderDirectory(file, settings.OutputDirectory)
-				cobra.CheckErr(err)
+				if fi.IsDir() {
+					if settings.OutputDirectory == "" {
+						return errors.New("output-directory parameter is required when rendering a directory")
+					}
 
-			} else {
-				f, err := os.Open(file)
-				cobra.CheckErr(err)
-				defer func(f *os.File) {
-					_ = f.Close()
-				}(f)
+					err = renderer.RenderDirectory(ctx, file, settings.OutputDirectory)
+					if err != nil {
+						return err
+					}
 
-				var outputFile string
-				if settings.OutputFile != "" {
-					outputFile = settings.OutputFile
 				} else {
-					basePath := render.ComputeBaseDirectory(file, dirs, settings.BaseDirectory)
-					outputFile = filepath.Join(
-						settings.OutputDirectory,
-						strings.TrimPrefix(file, basePath),
-					)
-				}
+					var outputFile string
+					if settings.OutputFile != "" {
+						outputFile = settings.OutputFile
+					} else {
+						basePath := render.ComputeBaseDirectory(file, dirs, settings.BaseDirectory)
+						outputFile = filepath.Join(
+							settings.OutputDirectory,
+							strings.TrimPrefix(file, basePath),
+						)
+					}
 
-				err = renderer.RenderFile(file, outputFile)
-				cobra.CheckErr(err)
+					err = renderer.RenderFile(ctx, file, outputFile)
+					if err != nil {
+						return err
+					}
+				}
 			}
+			return nil
 		}
 
+		err = renderAll(ctx)
+		cobra.CheckErr(err)
+
 		if settings.Watch {
 
 			if settings.OutputDirectory == "" {
@@ -258,7 +290,7 @@ func NewRenderCommand() *cobra.Command {
 							Str("outputPath", outputPath).
 							Msg("File changed")
 
-						err = renderer.RenderFile(path, outputPath)
+						err = renderer.RenderFile(ctx, path, outputPath)
 						if err != nil {
 							log.Error().Err(err).Msg("Error rendering file")
 						}
@@ -297,11 +329,21 @@ func NewRenderCommand() *cobra.Command {
 
 			w := watcher.NewWatcher(watcherOptions...)
 
-			eg, ctx := errgroup.WithContext(context.Background())
-			ctx2, cancel := context.WithCancel(ctx)
-			defer cancel()
-			ctx2, stop := signal.NotifyContext(ctx2, os.Interrupt)
-			defer stop()
+			// the templates can call any program, so re-render everything when one changes
+			unsubscribe := repository.Subscribe(func(e *pkg.ChangeEvent) {
+				if e.Type == pkg.ChangeLoadError {
+					log.Error().Err(e.Err).Str("path", e.Path).Msg("Could not reload program")
+					return
+				}
+				log.Info().Str("name", e.Name).Str("change", string(e.Type)).Msg("Program changed, rendering again")
+				err := renderAll(ctx)
+				if err != nil {
+					log.Error().Err(err).Msg("Error rendering files")
+				}
+			})
+			defer unsubscribe()
+
+			eg, ctx2 := errgroup.WithContext(ctx)
 
 			eg.Go(func() error {
 				log.Info().Msg("Starting watcher")
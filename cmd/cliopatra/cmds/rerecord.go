@@ -0,0 +1,230 @@
+package cmds
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/cliopatra/pkg/selector"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/settings"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"path/filepath"
+	"strings"
+)
+
+type RerecordProgramsCommand struct {
+	*cmds.CommandDescription
+}
+
+// NewRerecordCommand returns a command that reruns all the programs of the repositories,
+// usually against a new build of the tools they run, and writes the refreshed program
+// files to a parallel directory tree.
+//
+// It emits one row per program, telling whether its outputs changed.
+func NewRerecordCommand() *cobra.Command {
+	glazedParameterLayer, err := settings.NewGlazedParameterLayers()
+	cobra.CheckErr(err)
+
+	cmd := &RerecordProgramsCommand{
+		CommandDescription: cmds.NewCommandDescription("rerecord",
+			cmds.WithShort("Rerun repository programs and write their outputs to a new directory"),
+			cmds.WithFlags(
+				parameters.NewParameterDefinition(
+					"repository",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Repositories to load programs from"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"output-dir",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Directory to write the rerecorded program files to"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"binary",
+					parameters.ParameterTypeKeyValue,
+					parameters.WithHelp("Executables to substitute, as a list of path:new-path (path can be the name of the executable)"),
+					parameters.WithDefault(map[string]string{}),
+				),
+				parameters.NewParameterDefinition(
+					"jobs",
+					parameters.ParameterTypeInteger,
+					parameters.WithHelp("Number of programs to run in parallel"),
+					parameters.WithDefault(1),
+				),
+				newTimeoutParameter("timeout", "Default timeout of a program, overridden by the program's timeout"),
+				parameters.NewParameterDefinition(
+					"full-diff",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Output the full diff of the changed outputs instead of a summary"),
+					parameters.WithDefault(false),
+				),
+				newProfileParameter("run"),
+				newEnvParameter(),
+				newMatchParameter("rerecord"),
+			),
+			cmds.WithLayersList(glazedParameterLayer),
+		),
+	}
+	cobraCommand, err := cli.BuildCobraCommandFromGlazeCommand(cmd)
+	cobra.CheckErr(err)
+
+	return cobraCommand
+}
+
+type RerecordCommandSettings struct {
+	Repositories []string          `glazed.parameter:"repository"`
+	OutputDir    string            `glazed.parameter:"output-dir"`
+	Binaries     map[string]string `glazed.parameter:"binary"`
+	Jobs         int               `glazed.parameter:"jobs"`
+	Timeout      string            `glazed.parameter:"timeout"`
+	FullDiff     bool              `glazed.parameter:"full-diff"`
+	Profile      string            `glazed.parameter:"profile"`
+	Env          map[string]string `glazed.parameter:"env"`
+	Match        string            `glazed.parameter:"match"`
+}
+
+func (r *RerecordProgramsCommand) RunIntoGlazeProcessor(
+	ctx context.Context,
+	parsedLayers *layers.ParsedLayers,
+	gp middlewares.Processor,
+) error {
+	s := &RerecordCommandSettings{}
+	err := parsedLayers.InitializeStruct(layers.DefaultSlug, s)
+	if err != nil {
+		return err
+	}
+	repository := pkg.NewRepository(s.Repositories, pkg.WithProfile(s.Profile), pkg.WithEnv(s.Env))
+	err = repository.Load()
+	if err != nil {
+		return err
+	}
+
+	sel, err := selector.Parse(s.Match)
+	if err != nil {
+		return err
+	}
+	rps := selector.Filter(sel, repository.GetRepositoryPrograms())
+
+	options := []golden.Option{
+		golden.WithOutputDir(s.OutputDir),
+		golden.WithOutputDirPerRepository(len(s.Repositories) > 1),
+	}
+	if len(s.Binaries) > 0 {
+		pathOverride, err := newPathOverride(s.Binaries)
+		if err != nil {
+			return err
+		}
+		options = append(options, golden.WithPathOverride(pathOverride))
+	}
+	timeout, err := parseTimeout("timeout", s.Timeout)
+	if err != nil {
+		return err
+	}
+	if timeout != 0 {
+		options = append(options, golden.WithRunnerOptions(runner.WithTimeout(timeout)))
+	}
+
+	err = golden.CheckOutputPaths(rps, options...)
+	if err != nil {
+		return err
+	}
+
+	results, err := golden.RunAll(ctx, runner.NewPool(s.Jobs), rps, golden.UpdateProgram, options...)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		status := "unchanged"
+		changes := []string{}
+		diffs := []string{}
+		switch res.Status {
+		case golden.StatusUpdated:
+			status = "changed"
+			for _, c := range res.FailedChecks() {
+				changes = append(changes, c.Name)
+				diff := c.DiffSummary()
+				if s.FullDiff {
+					diff = c.Diff
+				}
+				diffs = append(diffs, c.Name+": "+diff)
+			}
+			if len(changes) == 0 {
+				changes = append(changes, "stdout")
+				diffs = append(diffs, "stdout: new output")
+			}
+		case golden.StatusError:
+			status = "error"
+		case golden.StatusPass,
+			golden.StatusFail,
+			golden.StatusSkip,
+			golden.StatusUnchanged:
+		}
+
+		errString := ""
+		if res.Err != nil {
+			errString = res.Err.Error()
+		}
+		row := types.NewRow(
+			types.MRP("name", res.Name),
+			types.MRP("path", res.Path),
+			types.MRP("output", res.OutputPath),
+			types.MRP("status", status),
+			types.MRP("changes", strings.Join(changes, ",")),
+			types.MRP("diff", strings.Join(diffs, "\n")),
+			types.MRP("error", errString),
+		)
+		err = gp.AddRow(ctx, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newPathOverride returns a function substituting the executables listed in binaries,
+// matched either by their full path or by their base name.
+func newPathOverride(binaries map[string]string) (func(string) string, error) {
+	binaries_ := map[string]string{}
+	for k, v := range binaries {
+		v_, err := absExecutable(v)
+		if err != nil {
+			return nil, err
+		}
+		binaries_[k] = v_
+	}
+
+	return func(path string) string {
+		if b, ok := binaries_[path]; ok {
+			return b
+		}
+		if b, ok := binaries_[filepath.Base(path)]; ok {
+			return b
+		}
+		return path
+	}, nil
+}
+
+// absExecutable makes a relative executable path absolute, so that it can be run from
+// the working directory of a hermetic program. Executable names without a slash are
+// left as is, to be looked up in PATH.
+func absExecutable(path string) (string, error) {
+	if !strings.Contains(path, string(filepath.Separator)) {
+		return path, nil
+	}
+	ret, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not resolve executable %s", path)
+	}
+	return ret, nil
+}
@@ -4,122 +4,346 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/explain"
+	"github.com/go-go-golems/cliopatra/pkg/overrides"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/cliopatra/pkg/selector"
 	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
-	"github.com/go-go-golems/glazed/pkg/cmds/layers"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // NewRunCommand returns a command that can be used to run either commands from
 // a file or from a repository.
 //
-// It currently doesn't allow overloading flags in the underlying program run
-// by cliopatra.
-//
-// See https://github.com/go-go-golems/glazed/issues/220
+// The flags and arguments of a single program can be overridden on the command line,
+// for example `cliopatra run ttc-orders --dbt-profile prod.ttc --output csv`. As these
+// flags are only known once the program is loaded, the flags of the run command are
+// first parsed on their own to find the program, before the arguments are parsed
+// again by a command built for the program. See
+// https://github.com/go-go-golems/glazed/issues/220
 func NewRunCommand() *cobra.Command {
 	runCommand := &cobra.Command{
-		Use:   "run <cmd.yaml>",
-		Short: "Run a command from a file or from a repository program",
-		Args:  cobra.MaximumNArgs(1),
+		Use:                "run <program|cmd.yaml> [program flags and arguments]",
+		Short:              "Run a command from a file or from a repository program",
+		DisableFlagParsing: true,
 		Run: func(cmd *cobra.Command, args []string) {
-			repositories, err := cmd.Flags().GetStringSlice("repository")
+			// flags of the program are unknown at this point, skip them
+			cmd.Flags().ParseErrorsWhitelist.UnknownFlags = true
+			err := cmd.Flags().Parse(args)
 			cobra.CheckErr(err)
+			positional := cmd.Flags().Args()
 
-			repository := pkg.NewRepository(repositories)
-			err = repository.Load()
+			repositories, err := cmd.Flags().GetStringSlice("repository")
 			cobra.CheckErr(err)
-
 			file, err := cmd.Flags().GetString("file")
 			cobra.CheckErr(err)
 			program, err := cmd.Flags().GetString("program")
 			cobra.CheckErr(err)
+			match, err := cmd.Flags().GetString("match")
+			cobra.CheckErr(err)
+			help, err := cmd.Flags().GetBool("help")
+			cobra.CheckErr(err)
+			profile, err := cmd.Flags().GetString("profile")
+			cobra.CheckErr(err)
+			env, err := cmd.Flags().GetStringToString("env")
+			cobra.CheckErr(err)
 
-			options := len(args)
-			if file != "" {
-				options++
+			options := 0
+			for _, o := range []string{file, program, match} {
+				if o != "" {
+					options++
+				}
 			}
-			if program != "" {
+			// the first positional argument is the program, unless the program is
+			// given as a flag, in which case it is an argument of the program
+			programFromArgs := options == 0 && len(positional) > 0
+			if programFromArgs {
 				options++
 			}
 
+			if options == 0 && help {
+				cobra.CheckErr(cmd.Help())
+				return
+			}
 			if options > 1 {
-				cobra.CheckErr(errors.Errorf("cannot specify both file and program"))
+				cobra.CheckErr(errors.Errorf("only one of file, program or match can be specified"))
+			}
+
+			// program files run directly don't need the repositories
+			loadRepository := func() *pkg.Repository {
+				repository := pkg.NewRepository(repositories, pkg.WithProfile(profile), pkg.WithEnv(env))
+				err := repository.Load()
+				cobra.CheckErr(err)
+				return repository
 			}
 
-			var p *cliopatra.Program
+			var rps []*pkg.RepositoryProgram
+			var p *pkg.RepositoryProgram
 
 			if file != "" {
-				f, err := os.Open(file)
-				cobra.CheckErr(err)
-				defer func(f *os.File) {
-					_ = f.Close()
-				}(f)
-				p, err = cliopatra.NewProgramFromYAML(f)
+				p, err = loadRepositoryProgramFromFile(file, profile, env)
 				cobra.CheckErr(err)
 			}
 
-			programs := repository.GetPrograms()
-
 			if program != "" {
-				p_, ok := programs[program]
-				if !ok {
-					cobra.CheckErr(errors.Errorf("program %s not found", program))
-				}
-				p = p_
+				p, err = loadRepository().Lookup(program)
+				cobra.CheckErr(err)
 			}
 
-			if len(args) > 0 {
-				// check if args[0] is a yaml file, otherwise treat as program name
-				f, err := os.Open(args[0])
-				if err == nil {
-					defer func(f *os.File) {
-						_ = f.Close()
-					}(f)
-					p, err = cliopatra.NewProgramFromYAML(f)
+			if programFromArgs {
+				// check if positional[0] is a yaml file, otherwise treat as program name
+				if _, err := os.Stat(positional[0]); err == nil {
+					p, err = loadRepositoryProgramFromFile(positional[0], profile, env)
 					cobra.CheckErr(err)
 				} else {
-					p_, ok := programs[args[0]]
-					if !ok {
-						cobra.CheckErr(errors.Errorf("program %s not found", args[0]))
-					}
-					p = p_
+					p, err = loadRepository().Lookup(positional[0])
+					cobra.CheckErr(err)
 				}
 			}
 
-			if p == nil {
-				cobra.CheckErr(errors.Errorf("either file or program must be specified"))
+			if match != "" {
+				sel, err := selector.Parse(match)
+				cobra.CheckErr(err)
+				rps = selector.Filter(sel, loadRepository().GetRepositoryPrograms())
+				if len(rps) == 0 {
+					cobra.CheckErr(errors.Errorf("no program matches %s", match))
+				}
+			} else if p != nil {
+				rps = []*pkg.RepositoryProgram{p}
+			} else {
+				cobra.CheckErr(errors.Errorf("either file, program or match must be specified"))
 			}
 
-			// TODO(manuel, 2023-03-17) To allow the user to override flags of the loaded cliopatra program
-			// we need to use a similar mechanism to what sqleton does with its run-command hack.
-			//
-			// We basically need to handle flags manually until we know which program we are going to run,
-			// at that point we can initialize a custom cobra command with the necessary flags,
-			// and run that instead after doing some os.Args splicing.
-			//
-			// See https://github.com/go-go-golems/glazed/issues/220
-			ctx := context.Background()
-			buf := &strings.Builder{}
-			err = p.RunIntoWriter(
-				ctx,
-				layers.NewParsedLayers(),
-				buf,
-			)
+			programCommand, err := newRunProgramCommand(cmd, rps, programFromArgs)
+			cobra.CheckErr(err)
+			programCommand.SetArgs(args)
+			err = programCommand.ExecuteContext(cmd.Context())
 			if err != nil {
-				_, _ = fmt.Fprint(os.Stderr, buf.String())
-				cobra.CheckErr(err)
+				os.Exit(1)
 			}
-
-			fmt.Println(buf.String())
 		},
 	}
 
 	runCommand.Flags().StringSlice("repository", []string{}, "Repository to load commands from")
 	runCommand.Flags().String("file", "", "File to load commands from")
 	runCommand.Flags().String("program", "", "Name of the program loaded from the repositories")
+	runCommand.Flags().String("timeout", "", "Timeout of the program, overridden by the program's own timeout (for example 30s or 2m)")
+	runCommand.Flags().Bool("keep-workdir", false, "Keep the temporary working directory of a hermetic program")
+	runCommand.Flags().String("match", "", "Run all the programs matching a selector expression, for example 'tag:sqleton and not tag:slow'")
+	runCommand.Flags().String("profile", "", "Environment profile of the repositories to run the program with")
+	runCommand.Flags().StringToString("env", map[string]string{}, "Environment variables set on top of the environment of the program, as KEY=VALUE")
+	runCommand.Flags().Bool("dry-run", false, "Print the command line, environment and stdin of the program and where its flag values come from, without running it")
 
 	return runCommand
 }
+
+// newRunProgramCommand returns the command parsing the arguments of the run command
+// once the programs to run are known. It has the flags of the run command, and if a
+// single program is run, the flags and arguments of that program as well.
+func newRunProgramCommand(
+	runCommand *cobra.Command,
+	rps []*pkg.RepositoryProgram,
+	programFromArgs bool,
+) (*cobra.Command, error) {
+	ret := &cobra.Command{
+		Use:          runCommand.Use,
+		Short:        runCommand.Short,
+		SilenceUsage: true,
+	}
+	ret.Flags().AddFlagSet(runCommand.Flags())
+
+	single := len(rps) == 1
+	if single {
+		p := rps[0].Program()
+		ret.Use = "run " + p.Name
+		if usage := overrides.ArgsUsage(p); usage != "" {
+			ret.Use += " " + usage
+		}
+		ret.Short = p.Description
+		err := overrides.AddFlags(ret.Flags(), p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret.Run = func(cmd *cobra.Command, args []string) {
+		if programFromArgs {
+			args = args[1:]
+		}
+		if !single && len(args) > 0 {
+			cobra.CheckErr(errors.Errorf("arguments can only be passed when running a single program"))
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+
+		var err error
+		s := &runSettings{}
+		timeout, err := cmd.Flags().GetString("timeout")
+		cobra.CheckErr(err)
+		s.timeout, err = parseTimeout("timeout", timeout)
+		cobra.CheckErr(err)
+		s.keepWorkdir, err = cmd.Flags().GetBool("keep-workdir")
+		cobra.CheckErr(err)
+		s.dryRun, err = cmd.Flags().GetBool("dry-run")
+		cobra.CheckErr(err)
+
+		var override func(p *cliopatra.Program) (*cliopatra.Program, error)
+		if single {
+			override = func(p *cliopatra.Program) (*cliopatra.Program, error) {
+				return overrides.Apply(cmd.Flags(), args, p)
+			}
+		}
+
+		for _, rp := range rps {
+			err = runRepositoryProgram(ctx, rp, s, override)
+			exitOnError(err)
+		}
+	}
+
+	return ret, nil
+}
+
+// loadRepositoryProgramFromFile loads a program file outside of a repository, with
+// the environment of the directory holding it, the selected profile and env on top.
+func loadRepositoryProgramFromFile(file string, profile string, env map[string]string) (*pkg.RepositoryProgram, error) {
+	rp, err := pkg.LoadProgramFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if profile != "" && !rp.HasProfile(profile) {
+		return nil, errors.Errorf("profile %s is not declared next to %s", profile, file)
+	}
+	return rp.WithEnvironment(profile, env)
+}
+
+// exitCodeError is returned when a program exits with a non-zero exit code.
+type exitCodeError struct {
+	name string
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.name, e.code)
+}
+
+// exitOnError exits with the exit code of the program if err is an exitCodeError, so
+// that cliopatra can be used in shell scripts in place of the program. Other errors
+// are reported and exit with 1.
+func exitOnError(err error) {
+	var exitCodeError_ *exitCodeError
+	if errors.As(err, &exitCodeError_) {
+		os.Exit(exitCodeError_.code)
+	}
+	cobra.CheckErr(err)
+}
+
+// describeWorkdir describes the temporary working directory a hermetic program is run in.
+func describeWorkdir(rp *pkg.RepositoryProgram) string {
+	ret := "a new temporary directory"
+	if fixtures := rp.Spec().Fixtures; len(fixtures) > 0 {
+		ret += fmt.Sprintf(", with %s copied from %s", strings.Join(fixtures, ", "), filepath.Dir(rp.Path()))
+	}
+	return ret
+}
+
+// explainRun describes how rp, recorded with overridden values, would be run. The
+// recorded program is planned the same way, so that only the overridden values are
+// attributed to the command line, and not the paths resolved against the program file.
+func explainRun(rp *pkg.RepositoryProgram, recorded *pkg.RepositoryProgram) (*explain.Explanation, error) {
+	p, hermetic, err := rp.PlanRun()
+	if err != nil {
+		return nil, err
+	}
+	recordedProgram, _, err := recorded.PlanRun()
+	if err != nil {
+		return nil, err
+	}
+
+	options := []explain.Option{
+		explain.WithRecorded(recordedProgram, "command line"),
+		explain.WithLog(rp.ParameterLog),
+		explain.WithStdinSource("inherited from cliopatra"),
+	}
+	if hermetic {
+		options = append(options, explain.WithPlannedDir(describeWorkdir(rp)))
+	}
+	return explain.Explain(p, options...)
+}
+
+type runSettings struct {
+	timeout     time.Duration
+	keepWorkdir bool
+	dryRun      bool
+}
+
+// runRepositoryProgram runs rp, streaming its stdout and stderr to ours as they are
+// written. Our stdin is passed to the program unless it declares its own.
+//
+// The timeout declared by the program overrides the timeout of s. If override is not
+// nil, it is applied to the program before its argument paths are resolved, so that
+// overridden values are resolved like recorded ones. A non-zero exit code of the
+// program is returned as an exitCodeError.
+//
+// With dryRun, the program is not run, and how it would be run is printed instead.
+// The working directory of a hermetic program is not created, and is described instead.
+func runRepositoryProgram(
+	ctx context.Context,
+	rp *pkg.RepositoryProgram,
+	s *runSettings,
+	override func(p *cliopatra.Program) (*cliopatra.Program, error),
+) error {
+	timeout := s.timeout
+	if rp.Spec().Timeout > 0 {
+		timeout = rp.Spec().Timeout
+	}
+
+	recorded := rp
+	if override != nil {
+		p, err := override(rp.Program())
+		if err != nil {
+			return err
+		}
+		rp = rp.WithProgram(p)
+	}
+
+	if s.dryRun {
+		e, err := explainRun(rp, recorded)
+		if err != nil {
+			return err
+		}
+		return e.Write(os.Stdout)
+	}
+
+	p, workdir, err := rp.PrepareRun(s.keepWorkdir)
+	if err != nil {
+		return err
+	}
+	options := []runner.Option{
+		runner.WithTimeout(timeout),
+		runner.WithStdin(os.Stdin),
+		runner.WithOutputWriters(os.Stdout, os.Stderr),
+	}
+	if workdir != nil {
+		defer func() {
+			_ = workdir.Close()
+		}()
+		options = append(options, runner.WithDir(workdir.Path))
+	}
+
+	output, err := runner.NewRunner(options...).Run(ctx, p)
+	if err != nil {
+		return err
+	}
+	if output.ExitCode != 0 {
+		return &exitCodeError{name: p.Name, code: output.ExitCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestExplainRunAttributesOnlyOverriddenValues(t *testing.T) {
+	rps := loadTestRepositories(t, map[string]string{
+		"cat.yaml": `name: cat
+path: cat
+flags:
+  - {name: number, type: bool, value: false}
+args:
+  - {name: file, type: string, value: input.txt}
+`,
+		"input.txt": "hello\n",
+	})
+	require.Len(t, rps, 1)
+	rp := rps[0]
+
+	e, err := explainRun(rp, rp)
+	require.NoError(t, err)
+	assert.NotContains(t, e.String(), "source: command line")
+
+	p := rp.Program().Clone()
+	require.NoError(t, p.SetFlagValue("number", true))
+	e, err = explainRun(rp.WithProgram(p), rp)
+	require.NoError(t, err)
+	assert.Contains(t, e.String(), "source: command line (recorded: false)")
+	assert.NotContains(t, e.String(), "recorded: input.txt")
+}
@@ -0,0 +1,32 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg/schema"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// NewSchemaCommand returns a command that prints the JSON Schema of program files,
+// for YAML language servers to complete and validate them.
+func NewSchemaCommand() *cobra.Command {
+	ret := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of program files",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			outputFile, err := cmd.Flags().GetString("output-file")
+			cobra.CheckErr(err)
+
+			if outputFile == "" {
+				_, err = cmd.OutOrStdout().Write(schema.ProgramSchemaJSON())
+				cobra.CheckErr(err)
+				return
+			}
+			err = os.WriteFile(outputFile, schema.ProgramSchemaJSON(), 0644)
+			cobra.CheckErr(err)
+		},
+	}
+	ret.Flags().String("output-file", "", "Write the schema to a file instead of stdout")
+
+	return ret
+}
@@ -0,0 +1,261 @@
+package cmds
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"github.com/go-go-golems/cliopatra/pkg/report"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/cliopatra/pkg/selector"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/settings"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type TestProgramsCommand struct {
+	*cmds.CommandDescription
+	failed int
+}
+
+// NewTestCommand returns a command that runs all the programs of the repositories
+// and compares their output with the expected output stored in the program file.
+//
+// It emits one row per program, and exits with a non-zero status if any of the
+// programs failed.
+func NewTestCommand() *cobra.Command {
+	glazedParameterLayer, err := settings.NewGlazedParameterLayers()
+	cobra.CheckErr(err)
+
+	cmd := &TestProgramsCommand{
+		CommandDescription: cmds.NewCommandDescription("test",
+			cmds.WithShort("Run repository programs as golden tests"),
+			cmds.WithFlags(
+				parameters.NewParameterDefinition(
+					"repository",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Repositories to load programs from"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"full-diff",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Output the full diff instead of a summary"),
+					parameters.WithDefault(false),
+				),
+				parameters.NewParameterDefinition(
+					"update",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Rewrite the expected output stored in the program files"),
+					parameters.WithDefault(false),
+				),
+				parameters.NewParameterDefinition(
+					"report",
+					parameters.ParameterTypeKeyValue,
+					parameters.WithHelp("Write reports, as a list of format:file (formats: junit, tap, jsonl), - being stderr"),
+					parameters.WithDefault(map[string]string{}),
+				),
+				parameters.NewParameterDefinition(
+					"jobs",
+					parameters.ParameterTypeInteger,
+					parameters.WithHelp("Number of programs to run in parallel"),
+					parameters.WithDefault(1),
+				),
+				newTimeoutParameter("timeout", "Default timeout of a program, overridden by the program's timeout"),
+				parameters.NewParameterDefinition(
+					"keep-workdir",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Keep the temporary working directories of hermetic programs"),
+					parameters.WithDefault(false),
+				),
+				newProfileParameter("run"),
+				newEnvParameter(),
+				newMatchParameter("test"),
+			),
+			cmds.WithLayersList(glazedParameterLayer),
+		),
+	}
+	cobraCommand, err := cli.BuildCobraCommandFromGlazeCommand(cmd)
+	cobra.CheckErr(err)
+
+	// The glazed processor needs to be closed for the rows to be output,
+	// so we only report failures once the original command has run.
+	origRun := cobraCommand.Run
+	cobraCommand.Run = func(c *cobra.Command, args []string) {
+		origRun(c, args)
+		if cmd.failed > 0 {
+			os.Exit(1)
+		}
+	}
+
+	return cobraCommand
+}
+
+type TestCommandSettings struct {
+	Repositories []string          `glazed.parameter:"repository"`
+	FullDiff     bool              `glazed.parameter:"full-diff"`
+	Update       bool              `glazed.parameter:"update"`
+	Reports      map[string]string `glazed.parameter:"report"`
+	Jobs         int               `glazed.parameter:"jobs"`
+	Timeout      string            `glazed.parameter:"timeout"`
+	KeepWorkdir  bool              `glazed.parameter:"keep-workdir"`
+	Profile      string            `glazed.parameter:"profile"`
+	Env          map[string]string `glazed.parameter:"env"`
+	Match        string            `glazed.parameter:"match"`
+}
+
+func (t *TestProgramsCommand) RunIntoGlazeProcessor(
+	ctx context.Context,
+	parsedLayers *layers.ParsedLayers,
+	gp middlewares.Processor,
+) error {
+	s := &TestCommandSettings{}
+	err := parsedLayers.InitializeStruct(layers.DefaultSlug, s)
+	if err != nil {
+		return err
+	}
+	r := pkg.NewRepository(s.Repositories, pkg.WithProfile(s.Profile), pkg.WithEnv(s.Env))
+	err = r.Load()
+	if err != nil {
+		return err
+	}
+
+	reporter, closeReporter, err := openReporters(s.Reports)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = closeReporter()
+	}()
+
+	sel, err := selector.Parse(s.Match)
+	if err != nil {
+		return err
+	}
+	rps := selector.Filter(sel, r.GetRepositoryPrograms())
+
+	options := []golden.Option{
+		golden.WithKeepWorkdir(s.KeepWorkdir),
+	}
+	timeout, err := parseTimeout("timeout", s.Timeout)
+	if err != nil {
+		return err
+	}
+	if timeout != 0 {
+		options = append(options, golden.WithRunnerOptions(runner.WithTimeout(timeout)))
+	}
+
+	f := golden.RunProgram
+	if s.Update {
+		f = golden.UpdateProgram
+	}
+	results, err := golden.RunAll(ctx, runner.NewPool(s.Jobs), rps, f, options...)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		if res.Status == golden.StatusFail || res.Status == golden.StatusError {
+			t.failed++
+		}
+		err = reporter.AddResult(res)
+		if err != nil {
+			return err
+		}
+
+		// programs that were skipped or couldn't be run don't have any checks,
+		// and are reported as a single row
+		checks := res.Checks
+		if len(checks) == 0 {
+			checks = []*golden.Check{{Status: res.Status}}
+		}
+		for _, c := range checks {
+			err = gp.AddRow(ctx, newTestRow(res, c, s.FullDiff))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return closeReporter()
+}
+
+// openReporters creates a reporter for each format:file pair, - being stderr since
+// stdout carries the glazed rows.
+// The returned function closes the reporters and their files, and can safely be called twice.
+func openReporters(reports map[string]string) (report.Reporter, func() error, error) {
+	reporters := report.MultiReporter{}
+	files := []*os.File{}
+
+	closed := false
+	closeAll := func() error {
+		if closed {
+			return nil
+		}
+		closed = true
+		err := reporters.Close()
+		for _, f := range files {
+			err2 := f.Close()
+			if err == nil {
+				err = err2
+			}
+		}
+		return err
+	}
+
+	for format, fileName := range reports {
+		w := os.Stderr
+		if fileName != "-" {
+			f, err := os.Create(fileName)
+			if err != nil {
+				_ = closeAll()
+				return nil, nil, errors.Wrapf(err, "could not create report file %s", fileName)
+			}
+			files = append(files, f)
+			w = f
+		}
+
+		reporter, err := report.NewReporter(report.Format(format), w)
+		if err != nil {
+			_ = closeAll()
+			return nil, nil, err
+		}
+		reporters = append(reporters, reporter)
+	}
+
+	return reporters, closeAll, nil
+}
+
+// newTestRow returns a row describing the outcome of a single expectation of a program.
+func newTestRow(res *golden.Result, c *golden.Check, fullDiff bool) types.Row {
+	diff := c.DiffSummary()
+	if fullDiff {
+		diff = c.Diff
+	}
+	errString := ""
+	if res.Err != nil {
+		errString = res.Err.Error()
+	}
+
+	status := c.Status
+	// in update mode, report the outcome for the whole program
+	if res.Status == golden.StatusUpdated || res.Status == golden.StatusUnchanged {
+		status = res.Status
+	}
+
+	return types.NewRow(
+		types.MRP("name", res.Name),
+		types.MRP("path", res.Path),
+		types.MRP("expectation", c.Name),
+		types.MRP("status", string(status)),
+		types.MRP("duration", res.Duration.String()),
+		types.MRP("diff", diff),
+		types.MRP("error", errString),
+	)
+}
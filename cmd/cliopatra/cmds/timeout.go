@@ -0,0 +1,32 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// glazed has no duration parameter type, so all the commands, including the plain
+// cobra ones, take timeouts as strings parsed by parseTimeout.
+
+// newTimeoutParameter returns the definition of a timeout flag named name.
+func newTimeoutParameter(name string, help string) *parameters.ParameterDefinition {
+	return parameters.NewParameterDefinition(
+		name,
+		parameters.ParameterTypeString,
+		parameters.WithHelp(help+" (for example 30s or 2m)"),
+	)
+}
+
+// parseTimeout parses the value s of the timeout flag name. An empty value is 0,
+// which means no timeout.
+func parseTimeout(name string, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	ret, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid --%s %s", name, s)
+	}
+	return ret, nil
+}
@@ -0,0 +1,21 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	timeout, err := parseTimeout("timeout", "")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	timeout, err = parseTimeout("timeout", "1m30s")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	_, err = parseTimeout("probe-timeout", "30")
+	assert.ErrorContains(t, err, "invalid --probe-timeout 30")
+}
@@ -0,0 +1,208 @@
+package cmds
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/cliopatra/pkg/workflow"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/settings"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NewWorkflowCommand returns the command grouping the workflow subcommands.
+func NewWorkflowCommand() *cobra.Command {
+	ret := &cobra.Command{
+		Use:   "workflow",
+		Short: "Run workflows chaining repository programs",
+	}
+	ret.AddCommand(NewWorkflowRunCommand())
+	return ret
+}
+
+type WorkflowRunCommand struct {
+	*cmds.CommandDescription
+	failed int
+}
+
+// NewWorkflowRunCommand returns a command that runs a workflow of the repositories,
+// given by name or as a workflow file.
+//
+// It emits one row per step, and exits with a non-zero status if any of the steps
+// didn't succeed.
+func NewWorkflowRunCommand() *cobra.Command {
+	glazedParameterLayer, err := settings.NewGlazedParameterLayers()
+	cobra.CheckErr(err)
+
+	cmd := &WorkflowRunCommand{
+		CommandDescription: cmds.NewCommandDescription("run",
+			cmds.WithShort("Run a workflow"),
+			cmds.WithFlags(
+				parameters.NewParameterDefinition(
+					"repository",
+					parameters.ParameterTypeStringList,
+					parameters.WithHelp("Repositories to load programs and workflows from"),
+					parameters.WithRequired(true),
+				),
+				parameters.NewParameterDefinition(
+					"jobs",
+					parameters.ParameterTypeInteger,
+					parameters.WithHelp("Number of steps to run in parallel"),
+					parameters.WithDefault(4),
+				),
+				newTimeoutParameter("timeout", "Default timeout of a step, overridden by the program's timeout"),
+				parameters.NewParameterDefinition(
+					"show-output",
+					parameters.ParameterTypeBool,
+					parameters.WithHelp("Add the stdout and stderr of each step to the output"),
+					parameters.WithDefault(false),
+				),
+				newProfileParameter("run"),
+				newEnvParameter(),
+			),
+			cmds.WithArguments(
+				parameters.NewParameterDefinition(
+					"workflow",
+					parameters.ParameterTypeString,
+					parameters.WithHelp("Name of the workflow, or path to a workflow file"),
+					parameters.WithRequired(true),
+				),
+			),
+			cmds.WithLayersList(glazedParameterLayer),
+		),
+	}
+	cobraCommand, err := cli.BuildCobraCommandFromGlazeCommand(cmd)
+	cobra.CheckErr(err)
+
+	origRun := cobraCommand.Run
+	cobraCommand.Run = func(c *cobra.Command, args []string) {
+		origRun(c, args)
+		if cmd.failed > 0 {
+			os.Exit(1)
+		}
+	}
+
+	return cobraCommand
+}
+
+type WorkflowRunSettings struct {
+	Repositories []string          `glazed.parameter:"repository"`
+	Jobs         int               `glazed.parameter:"jobs"`
+	Timeout      string            `glazed.parameter:"timeout"`
+	ShowOutput   bool              `glazed.parameter:"show-output"`
+	Profile      string            `glazed.parameter:"profile"`
+	Env          map[string]string `glazed.parameter:"env"`
+	Workflow     string            `glazed.parameter:"workflow"`
+}
+
+func (w *WorkflowRunCommand) RunIntoGlazeProcessor(
+	ctx context.Context,
+	parsedLayers *layers.ParsedLayers,
+	gp middlewares.Processor,
+) error {
+	s := &WorkflowRunSettings{}
+	err := parsedLayers.InitializeStruct(layers.DefaultSlug, s)
+	if err != nil {
+		return err
+	}
+
+	r := pkg.NewRepository(s.Repositories, pkg.WithProfile(s.Profile), pkg.WithEnv(s.Env))
+	err = r.Load()
+	if err != nil {
+		return err
+	}
+
+	wf, err := loadWorkflow(r, s.Workflow)
+	if err != nil {
+		return err
+	}
+
+	options := []workflow.Option{workflow.WithJobs(s.Jobs)}
+	timeout, err := parseTimeout("timeout", s.Timeout)
+	if err != nil {
+		return err
+	}
+	if timeout != 0 {
+		options = append(options, workflow.WithRunnerOptions(runner.WithTimeout(timeout)))
+	}
+
+	results, err := wf.Run(ctx, r.Lookup, options...)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		if res.Status != workflow.StatusSuccess {
+			w.failed++
+		}
+		err = gp.AddRow(ctx, newWorkflowRow(res, s.ShowOutput))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadWorkflow loads the workflow file at name if there is one, and otherwise looks
+// up the workflow called name in the sources of r.
+func loadWorkflow(r *pkg.Repository, name string) (*workflow.Workflow, error) {
+	if pkg.IsWorkflowFile(name) {
+		if _, err := os.Stat(name); err == nil {
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not open workflow file %s", name)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			return workflow.NewWorkflowFromYAML(f, name)
+		}
+	}
+
+	workflows, err := workflow.LoadWorkflows(r.Sources())
+	if err != nil {
+		return nil, err
+	}
+	wf, ok := workflow.FindWorkflow(workflows, name)
+	if !ok {
+		return nil, errors.Errorf("could not find workflow %s", name)
+	}
+	return wf, nil
+}
+
+func newWorkflowRow(res *workflow.StepResult, showOutput bool) types.Row {
+	errString := ""
+	if res.Err != nil {
+		errString = res.Err.Error()
+	}
+	exitCode := ""
+	stdout, stderr := "", ""
+	if res.Output != nil {
+		exitCode = strconv.Itoa(res.Output.ExitCode)
+		stdout, stderr = res.Output.Stdout, res.Output.Stderr
+	}
+
+	row := types.NewRow(
+		types.MRP("step", res.Name),
+		types.MRP("program", res.Program),
+		types.MRP("status", string(res.Status)),
+		types.MRP("exit_code", exitCode),
+		types.MRP("duration", res.Duration.Round(time.Millisecond).String()),
+		types.MRP("error", errString),
+	)
+	if showOutput {
+		row.Set("stdout", stdout)
+		row.Set("stderr", stderr)
+	}
+	return row
+}
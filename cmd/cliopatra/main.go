@@ -4,8 +4,15 @@ import (
 	"embed"
 	clay "github.com/go-go-golems/clay/pkg"
 	cmds2 "github.com/go-go-golems/cliopatra/cmd/cliopatra/cmds"
+	"github.com/go-go-golems/cliopatra/pkg"
 	"github.com/go-go-golems/glazed/pkg/help"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
 )
 
 //go:embed doc/*
@@ -24,12 +31,108 @@ func main() {
 	renderCmd := cmds2.NewRenderCommand()
 	rootCmd.AddCommand(renderCmd)
 
+	testCmd := cmds2.NewTestCommand()
+	rootCmd.AddCommand(testCmd)
+
+	recordCmd := cmds2.NewRecordCommand()
+	rootCmd.AddCommand(recordCmd)
+
+	rerecordCmd := cmds2.NewRerecordCommand()
+	rootCmd.AddCommand(rerecordCmd)
+
+	compareCmd := cmds2.NewCompareCommand()
+	rootCmd.AddCommand(compareCmd)
+
+	bisectCmd := cmds2.NewBisectCommand()
+	rootCmd.AddCommand(bisectCmd)
+
+	workflowCmd := cmds2.NewWorkflowCommand()
+	rootCmd.AddCommand(workflowCmd)
+
+	lintCmd := cmds2.NewLintCommand()
+	rootCmd.AddCommand(lintCmd)
+
+	schemaCmd := cmds2.NewSchemaCommand()
+	rootCmd.AddCommand(schemaCmd)
+
+	err = addRepositoryPrograms(rootCmd, os.Args[1:])
+	cobra.CheckErr(err)
+
 	_ = helpSystem
 
 	err = rootCmd.Execute()
 	cobra.CheckErr(err)
 }
 
+// addRepositoryPrograms exposes the programs of the repositories listed in the
+// `repositories` setting of the configuration file as subcommands.
+//
+// The repositories are only loaded if args might run one of these subcommands, and
+// not for built-in commands. Repositories that can't be loaded are an error, while
+// program files that can't be loaded are reported and skipped.
+func addRepositoryPrograms(rootCmd *cobra.Command, args []string) error {
+	repositories := viper.GetStringSlice("repositories")
+	if len(repositories) == 0 || !mightRunProgramCommand(rootCmd, args) {
+		return nil
+	}
+
+	repository := pkg.NewRepository(repositories, pkg.WithLoadErrorHandler(func(path string, err error) {
+		log.Error().Err(err).Str("path", path).Msg("could not load program, skipping")
+	}))
+	err := repository.Load()
+	if err != nil {
+		return errors.Wrap(err, "could not load the repositories of the configuration file")
+	}
+
+	return cmds2.AddProgramCommands(rootCmd, repository.GetOrderedRepositoryPrograms())
+}
+
+// mightRunProgramCommand returns false if the first argument of args that isn't a flag
+// is a built-in command of rootCmd. Getting help on a program also needs the programs.
+// The values of the persistent flags of rootCmd, such as `--log-level debug`, are
+// skipped.
+func mightRunProgramCommand(rootCmd *cobra.Command, args []string) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "-") {
+			if takesValue(rootCmd.PersistentFlags(), arg) {
+				i++
+			}
+			continue
+		}
+		switch arg {
+		case "help":
+			return mightRunProgramCommand(rootCmd, args[i+1:])
+		case "completion":
+			return false
+		case cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return true
+		}
+		for _, cmd := range rootCmd.Commands() {
+			if cmd.Name() == arg || cmd.HasAlias(arg) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// takesValue returns true if arg is a flag of flags that takes the next argument as
+// its value. Unknown flags are assumed not to.
+func takesValue(flags *pflag.FlagSet, arg string) bool {
+	if strings.Contains(arg, "=") {
+		return false
+	}
+	var flag *pflag.Flag
+	if name := strings.TrimPrefix(arg, "--"); name != arg {
+		flag = flags.Lookup(name)
+	} else if name := strings.TrimPrefix(arg, "-"); len(name) == 1 {
+		flag = flags.ShorthandLookup(name)
+	}
+	return flag != nil && flag.NoOptDefVal == ""
+}
+
 func initRootCmd() (*help.HelpSystem, *cobra.Command, error) {
 	helpSystem := help.NewHelpSystem()
 	err := helpSystem.LoadSectionsFromFS(docFS, ".")
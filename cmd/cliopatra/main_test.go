@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMightRunProgramCommand(t *testing.T) {
+	rootCmd := &cobra.Command{Use: "cliopatra"}
+	rootCmd.PersistentFlags().String("log-level", "info", "")
+	rootCmd.PersistentFlags().StringP("config", "c", "", "")
+	rootCmd.PersistentFlags().Bool("with-caller", false, "")
+	rootCmd.AddCommand(&cobra.Command{Use: "ls"}, &cobra.Command{Use: "lint"})
+
+	for _, tt := range []struct {
+		args     []string
+		expected bool
+	}{
+		{[]string{"ls"}, false},
+		{[]string{"--log-level", "debug", "ls"}, false},
+		{[]string{"--log-level=debug", "lint"}, false},
+		{[]string{"-c", "config.yaml", "ls"}, false},
+		{[]string{"--with-caller", "ls"}, false},
+		{[]string{"--log-level", "debug", "reports", "orders"}, true},
+		{[]string{"--with-caller", "reports"}, true},
+		{[]string{"help", "--log-level", "debug", "ls"}, false},
+		{[]string{"help", "reports", "orders"}, true},
+		{[]string{"completion", "bash"}, false},
+		{[]string{"--log-level", "debug"}, false},
+	} {
+		assert.Equal(t, tt.expected, mightRunProgramCommand(rootCmd, tt.args), tt.args)
+	}
+}
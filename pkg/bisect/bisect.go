@@ -0,0 +1,95 @@
+// Package bisect finds the first build of a tool in an ordered list of builds
+// for which a program behaves differently.
+package bisect
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// Verdict tells whether a build behaves as expected. Detail describes why
+// a build is bad, for example a diff summary.
+type Verdict struct {
+	Good   bool
+	Detail string
+}
+
+// Predicate checks a single build. An error aborts the bisection.
+type Predicate func(ctx context.Context, build string) (*Verdict, error)
+
+// Step is a build that was checked during the bisection.
+type Step struct {
+	Index int
+	Build string
+	*Verdict
+}
+
+// Outcome is the result of a bisection.
+type Outcome struct {
+	// Steps are the checked builds, in the order they were checked.
+	Steps []*Step
+	// FirstBad is the index of the first bad build, or -1 if all builds are good.
+	FirstBad int
+}
+
+// Bisect binary searches builds for the first bad build, assuming that all builds
+// before it are good and all builds after it are bad.
+//
+// The last build is checked first, so that a search where all builds are good
+// only costs a single run. If the first build is bad, it is reported as the
+// first bad build.
+func Bisect(ctx context.Context, builds []string, isGood Predicate) (*Outcome, error) {
+	if len(builds) == 0 {
+		return nil, errors.New("no builds to bisect")
+	}
+
+	ret := &Outcome{FirstBad: -1}
+	check := func(i int) (bool, error) {
+		v, err := isGood(ctx, builds[i])
+		if err != nil {
+			return false, errors.Wrapf(err, "could not check build %s", builds[i])
+		}
+		ret.Steps = append(ret.Steps, &Step{Index: i, Build: builds[i], Verdict: v})
+		return v.Good, nil
+	}
+
+	last := len(builds) - 1
+	good, err := check(last)
+	if err != nil {
+		return nil, err
+	}
+	if good {
+		return ret, nil
+	}
+	if last == 0 {
+		ret.FirstBad = 0
+		return ret, nil
+	}
+
+	good, err = check(0)
+	if err != nil {
+		return nil, err
+	}
+	if !good {
+		ret.FirstBad = 0
+		return ret, nil
+	}
+
+	// builds[lo] is good and builds[hi] is bad
+	lo, hi := 0, last
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		good, err = check(mid)
+		if err != nil {
+			return nil, err
+		}
+		if good {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	ret.FirstBad = hi
+
+	return ret, nil
+}
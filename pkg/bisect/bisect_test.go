@@ -0,0 +1,45 @@
+package bisect
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+)
+
+func TestBisect(t *testing.T) {
+	builds := []string{}
+	for i := 0; i < 10; i++ {
+		builds = append(builds, strconv.Itoa(i))
+	}
+
+	for firstBad := 0; firstBad <= len(builds); firstBad++ {
+		checked := 0
+		outcome, err := Bisect(context.Background(), builds, func(ctx context.Context, build string) (*Verdict, error) {
+			checked++
+			i, _ := strconv.Atoi(build)
+			return &Verdict{Good: i < firstBad}, nil
+		})
+		require.NoError(t, err)
+
+		expected := firstBad
+		if firstBad == len(builds) {
+			expected = -1
+		}
+		assert.Equal(t, expected, outcome.FirstBad, fmt.Sprintf("first bad build %d", firstBad))
+		assert.Equal(t, checked, len(outcome.Steps))
+		assert.LessOrEqual(t, checked, 6)
+	}
+}
+
+func TestBisectErrors(t *testing.T) {
+	_, err := Bisect(context.Background(), []string{}, nil)
+	assert.Error(t, err)
+
+	_, err = Bisect(context.Background(), []string{"a", "b"}, func(ctx context.Context, build string) (*Verdict, error) {
+		return nil, fmt.Errorf("broken")
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"sort"
+	"time"
+)
+
+// ChangeType is the kind of change reported by a ChangeEvent.
+type ChangeType string
+
+const (
+	// ChangeAdded means that a new program file was loaded.
+	ChangeAdded ChangeType = "added"
+	// ChangeUpdated means that a program file was reloaded after being written.
+	ChangeUpdated ChangeType = "updated"
+	// ChangeRemoved means that a program file was removed.
+	ChangeRemoved ChangeType = "removed"
+	// ChangeRenamed means that a program file was moved to another path.
+	ChangeRenamed ChangeType = "renamed"
+	// ChangeLoadError means that a program file was written but couldn't be loaded.
+	// The program previously loaded from the file, if any, is kept.
+	ChangeLoadError ChangeType = "load-error"
+)
+
+// DefaultRenameWindow is how long the removal of a program file is held back, to
+// find out whether it is followed by the creation of the same program at another
+// path, see WithRenameWindow.
+const DefaultRenameWindow = 100 * time.Millisecond
+
+// ChangeEvent reports a change of the programs of a watched repository.
+type ChangeEvent struct {
+	Type ChangeType
+	// Path is the path of the program file, its new path for renamed programs.
+	Path string
+	// OldPath is the previous path of renamed programs, and Path otherwise.
+	OldPath string
+	// Name is the qualified name of New, or of Old for removed programs.
+	Name string
+	// OldName is the qualified name of Old, empty for added programs.
+	OldName string
+	// Old is the program before the change, nil for added programs.
+	Old *RepositoryProgram
+	// New is the program after the change, nil for removed programs and load errors.
+	New *RepositoryProgram
+	// Err is the error of ChangeLoadError events.
+	Err error
+}
+
+// newChangeEvent returns the event of the program at path changing from old to new.
+func newChangeEvent(type_ ChangeType, path string, old *RepositoryProgram, new *RepositoryProgram) *ChangeEvent {
+	ret := &ChangeEvent{
+		Type:    type_,
+		Path:    path,
+		OldPath: path,
+		Old:     old,
+		New:     new,
+	}
+	if old != nil {
+		ret.OldPath = old.path
+		ret.OldName = old.QualifiedName()
+		ret.Name = ret.OldName
+	}
+	if new != nil {
+		ret.Name = new.QualifiedName()
+	}
+	return ret
+}
+
+// ChangeHandler is called for each change of the programs of a watched repository.
+type ChangeHandler func(event *ChangeEvent)
+
+type subscription struct {
+	handler ChangeHandler
+}
+
+// WithRenameWindow sets how long the removal of a program file is held back to detect
+// renames. Moving a program file is reported as a ChangeRenamed event if a program
+// with the same name is created within the window, and replacing a file, as editors
+// do when saving, is reported as a ChangeUpdated event.
+func WithRenameWindow(window time.Duration) RepositoryOption {
+	return func(r *Repository) {
+		r.renameWindow = window
+	}
+}
+
+// Subscribe registers handler to be called with the changes of the programs while the
+// repository is watched. Handlers are called one event at a time, in the order of the
+// changes, without holding the lock of the repository, so that they can look up
+// programs. No other change is applied until the handlers return. The returned
+// function unregisters the handler.
+func (r *Repository) Subscribe(handler ChangeHandler) func() {
+	s := &subscription{handler: handler}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.subscriptions = append(r.subscriptions, s)
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for i, s_ := range r.subscriptions {
+			if s_ == s {
+				r.subscriptions = append(r.subscriptions[:i:i], r.subscriptions[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// notify calls the handlers with events. It must be called with notifyLock held,
+// which the change the events report has been applied with, and without holding the
+// lock.
+func (r *Repository) notify(events ...*ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	r.lock.RLock()
+	subscriptions := append([]*subscription{}, r.subscriptions...)
+	r.lock.RUnlock()
+
+	for _, e := range events {
+		for _, s := range subscriptions {
+			s.handler(e)
+		}
+	}
+}
+
+// pendingRemoval is the removal of a program file, held back until the rename window
+// expires.
+type pendingRemoval struct {
+	rp    *RepositoryProgram
+	timer *time.Timer
+}
+
+// removeProgram holds back the removal of the program at path. It has to be called
+// with the lock held.
+func (r *Repository) removeProgram(path string) {
+	rp, ok := r.programs[path]
+	if !ok {
+		return
+	}
+	if _, ok := r.pendingRemovals[path]; ok {
+		return
+	}
+
+	p := &pendingRemoval{rp: rp}
+	r.pendingRemovals[path] = p
+	p.timer = time.AfterFunc(r.renameWindow, func() {
+		r.notifyLock.Lock()
+		defer r.notifyLock.Unlock()
+
+		r.lock.Lock()
+		e := r.applyRemoval(path, p)
+		r.lock.Unlock()
+
+		if e != nil {
+			r.notify(e)
+		}
+	})
+}
+
+// applyRemoval removes the program of the pending removal p, if it is still pending.
+// It has to be called with the lock held.
+func (r *Repository) applyRemoval(path string, p *pendingRemoval) *ChangeEvent {
+	if r.pendingRemovals[path] != p {
+		return nil
+	}
+	delete(r.pendingRemovals, path)
+	delete(r.programs, path)
+	r.reindex()
+	return newChangeEvent(ChangeRemoved, path, p.rp, nil)
+}
+
+// takePendingRemoval cancels the pending removal of the program at path, or
+// otherwise of a program named like rp that might have been moved to the path of rp.
+// It returns the path of the program whose removal was cancelled. It has to be
+// called with the lock held.
+func (r *Repository) takePendingRemoval(path string, rp *RepositoryProgram) (string, bool) {
+	if p, ok := r.pendingRemovals[path]; ok {
+		p.timer.Stop()
+		delete(r.pendingRemovals, path)
+		return path, true
+	}
+
+	for oldPath, p := range r.pendingRemovals {
+		if rp == nil || p.rp.root != rp.root || p.rp.program.Name != rp.program.Name {
+			continue
+		}
+		p.timer.Stop()
+		delete(r.pendingRemovals, oldPath)
+		return oldPath, true
+	}
+
+	return "", false
+}
+
+// flushPendingRemovals applies all the pending removals, ordered by path, once the
+// repository is not watched anymore.
+func (r *Repository) flushPendingRemovals() {
+	events := []*ChangeEvent{}
+
+	r.notifyLock.Lock()
+	defer r.notifyLock.Unlock()
+
+	r.lock.Lock()
+	for path, p := range r.pendingRemovals {
+		p.timer.Stop()
+		if e := r.applyRemoval(path, p); e != nil {
+			events = append(events, e)
+		}
+	}
+	r.lock.Unlock()
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Path < events[j].Path
+	})
+
+	r.notify(events...)
+}
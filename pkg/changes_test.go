@@ -0,0 +1,239 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// watchedRepository is a repository loaded from a temporary directory, whose watcher
+// callbacks are called directly by the tests.
+type watchedRepository struct {
+	*Repository
+	dir    string
+	events chan *ChangeEvent
+}
+
+func newWatchedRepository(t *testing.T, renameWindow time.Duration, files map[string]string) *watchedRepository {
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+
+	r := NewRepository([]string{dir}, WithRenameWindow(renameWindow))
+	require.NoError(t, r.Load())
+	ret := &watchedRepository{Repository: r, dir: dir, events: make(chan *ChangeEvent, 16)}
+	r.Subscribe(func(e *ChangeEvent) {
+		ret.events <- e
+	})
+	return ret
+}
+
+func (w *watchedRepository) path(name string) string {
+	return filepath.Join(w.dir, name)
+}
+
+// write writes the file name and calls the write callback.
+func (w *watchedRepository) write(t *testing.T, name string, content string) {
+	writeFiles(t, w.dir, map[string]string{name: content})
+	require.NoError(t, w.onWrite(w.path(name)))
+}
+
+// remove removes the file name and calls the remove callback.
+func (w *watchedRepository) remove(t *testing.T, name string) {
+	require.NoError(t, os.Remove(w.path(name)))
+	require.NoError(t, w.onRemove(w.path(name)))
+}
+
+func (w *watchedRepository) next(t *testing.T) *ChangeEvent {
+	select {
+	case e := <-w.events:
+		return e
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no change event")
+		return nil
+	}
+}
+
+func (w *watchedRepository) assertNoEvent(t *testing.T) {
+	select {
+	case e := <-w.events:
+		assert.Failf(t, "unexpected change event", "%s %s", e.Type, e.Path)
+	default:
+	}
+}
+
+func TestWatchAddUpdate(t *testing.T) {
+	w := newWatchedRepository(t, time.Minute, map[string]string{})
+	namespace := filepath.Base(w.dir)
+
+	w.write(t, "echo.yaml", "name: echo\npath: echo\n")
+	e := w.next(t)
+	assert.Equal(t, ChangeAdded, e.Type)
+	assert.Equal(t, w.path("echo.yaml"), e.Path)
+	assert.Equal(t, namespace+"/echo", e.Name)
+	assert.Equal(t, "", e.OldName)
+	assert.Nil(t, e.Old)
+
+	rp, err := w.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, "echo", rp.Program().Path)
+
+	w.write(t, "echo.yaml", "name: echo\npath: /bin/echo\n")
+	e = w.next(t)
+	assert.Equal(t, ChangeUpdated, e.Type)
+	assert.Equal(t, "echo", e.Old.Program().Path)
+	assert.Equal(t, "/bin/echo", e.New.Program().Path)
+
+	rp, err = w.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/echo", rp.Program().Path)
+	w.assertNoEvent(t)
+}
+
+func TestWatchIgnoresOtherFiles(t *testing.T) {
+	w := newWatchedRepository(t, time.Minute, map[string]string{})
+
+	w.write(t, "README.md", "# programs\n")
+	w.write(t, "export.workflow.yaml", "name: export\nsteps: []\n")
+	w.assertNoEvent(t)
+}
+
+func TestWatchRename(t *testing.T) {
+	w := newWatchedRepository(t, time.Minute, map[string]string{
+		"echo.yaml": "name: echo\npath: echo\n",
+	})
+	namespace := filepath.Base(w.dir)
+
+	w.remove(t, "echo.yaml")
+	w.assertNoEvent(t)
+	w.write(t, "sub/echo.yaml", "name: echo\npath: echo\n")
+
+	e := w.next(t)
+	assert.Equal(t, ChangeRenamed, e.Type)
+	assert.Equal(t, w.path("sub/echo.yaml"), e.Path)
+	assert.Equal(t, w.path("echo.yaml"), e.OldPath)
+	assert.Equal(t, namespace+"/sub/echo", e.Name)
+	assert.Equal(t, namespace+"/echo", e.OldName)
+
+	_, err := w.Lookup(namespace + "/echo")
+	assert.Error(t, err)
+	rp, err := w.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, w.path("sub/echo.yaml"), rp.Path())
+
+	// the removal was taken back, it is not reported when flushing
+	w.flushPendingRemovals()
+	w.assertNoEvent(t)
+}
+
+func TestWatchReplaceOnSave(t *testing.T) {
+	w := newWatchedRepository(t, time.Minute, map[string]string{
+		"echo.yaml": "name: echo\npath: echo\n",
+	})
+
+	w.remove(t, "echo.yaml")
+	w.write(t, "echo.yaml", "name: echo\npath: /bin/echo\n")
+
+	e := w.next(t)
+	assert.Equal(t, ChangeUpdated, e.Type)
+	assert.Equal(t, w.path("echo.yaml"), e.OldPath)
+	assert.Equal(t, "/bin/echo", e.New.Program().Path)
+
+	w.flushPendingRemovals()
+	w.assertNoEvent(t)
+}
+
+func TestWatchLoadError(t *testing.T) {
+	w := newWatchedRepository(t, time.Minute, map[string]string{
+		"echo.yaml": "name: echo\npath: echo\n",
+	})
+
+	w.write(t, "echo.yaml", "name: echo\nflags: [\n")
+	e := w.next(t)
+	assert.Equal(t, ChangeLoadError, e.Type)
+	assert.Error(t, e.Err)
+	require.NotNil(t, e.Old)
+	assert.Nil(t, e.New)
+
+	// the program previously loaded is kept
+	rp, err := w.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, "echo", rp.Program().Path)
+
+	w.write(t, "new.yaml", "flags: [\n")
+	e = w.next(t)
+	assert.Equal(t, ChangeLoadError, e.Type)
+	assert.Nil(t, e.Old)
+	assert.Equal(t, w.path("new.yaml"), e.Path)
+}
+
+func TestWatchRemove(t *testing.T) {
+	w := newWatchedRepository(t, 10*time.Millisecond, map[string]string{
+		"echo.yaml": "name: echo\npath: echo\n",
+		"cat.yaml":  "name: cat\npath: cat\n",
+	})
+
+	w.remove(t, "echo.yaml")
+	e := w.next(t)
+	assert.Equal(t, ChangeRemoved, e.Type)
+	assert.Equal(t, w.path("echo.yaml"), e.Path)
+	assert.Nil(t, e.New)
+
+	_, err := w.Lookup("echo")
+	assert.Error(t, err)
+	_, err = w.Lookup("cat")
+	assert.NoError(t, err)
+}
+
+func TestWatchFlushesRemovalsOnCancel(t *testing.T) {
+	w := newWatchedRepository(t, time.Hour, map[string]string{
+		"echo.yaml": "name: echo\npath: echo\n",
+		"cat.yaml":  "name: cat\npath: cat\n",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx)
+	}()
+
+	w.remove(t, "echo.yaml")
+	w.remove(t, "cat.yaml")
+	w.assertNoEvent(t)
+	cancel()
+	<-done
+
+	e := w.next(t)
+	assert.Equal(t, ChangeRemoved, e.Type)
+	assert.Equal(t, w.path("cat.yaml"), e.Path)
+	e = w.next(t)
+	assert.Equal(t, ChangeRemoved, e.Type)
+	assert.Equal(t, w.path("echo.yaml"), e.Path)
+	assert.Empty(t, w.GetOrderedRepositoryPrograms())
+}
+
+func TestWatchDeliversEventsInOrder(t *testing.T) {
+	w := newWatchedRepository(t, time.Millisecond, map[string]string{
+		"echo.yaml": "name: echo\npath: echo\n",
+	})
+
+	// each handler call sees the repository as of its own event
+	seen := make(chan bool, 16)
+	w.Subscribe(func(e *ChangeEvent) {
+		_, err := w.Lookup("echo")
+		seen <- err == nil
+	})
+
+	w.remove(t, "echo.yaml")
+	e := w.next(t)
+	assert.Equal(t, ChangeRemoved, e.Type)
+	w.write(t, "echo.yaml", "name: echo\npath: echo\n")
+	e = w.next(t)
+	assert.Equal(t, ChangeAdded, e.Type)
+
+	assert.False(t, <-seen)
+	assert.True(t, <-seen)
+}
@@ -0,0 +1,350 @@
+// Package compare compares structured program outputs (JSON, YAML, CSV) as data,
+// instead of as text.
+//
+// This makes comparisons insensitive to key ordering and number formatting, and
+// reports differences as paths into the data, for example
+//
+//	[3].amount: 12.5 != 12.6
+package compare
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatCSV  Format = "csv"
+	FormatTSV  Format = "tsv"
+)
+
+// Options describes how the output of a program gets compared.
+type Options struct {
+	// Format is the format of the output. If empty, it is detected from the
+	// value of the program's output flag.
+	Format Format `yaml:"format,omitempty"`
+	// IgnoreFields lists the names of fields that are not compared, at any depth.
+	IgnoreFields []string `yaml:"ignoreFields,omitempty"`
+	// IgnoreOrder compares the top-level rows without regard to their order.
+	IgnoreOrder bool `yaml:"ignoreOrder,omitempty"`
+}
+
+// DetectFormat maps the value of a glazed --output flag to a Format.
+func DetectFormat(output string) Format {
+	switch strings.ToLower(output) {
+	case "json":
+		return FormatJSON
+	case "yaml", "yml":
+		return FormatYAML
+	case "csv":
+		return FormatCSV
+	case "tsv":
+		return FormatTSV
+	default:
+		return FormatText
+	}
+}
+
+// Difference is a single value that differs between the expected and actual data.
+type Difference struct {
+	Path     string
+	Expected interface{}
+	Actual   interface{}
+}
+
+// missing is used as the value of a Difference when one side doesn't have the value.
+type missing struct{}
+
+func (m missing) String() string {
+	return "<missing>"
+}
+
+func (d *Difference) String() string {
+	return fmt.Sprintf("%s: %s != %s", d.Path, formatValue(d.Expected), formatValue(d.Actual))
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case missing:
+		return v.String()
+	case string:
+		return strconv.Quote(v)
+	case json.Number:
+		return v.String()
+	case nil:
+		return "null"
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(b)
+	}
+}
+
+// Parse parses s into generic data: maps, slices, strings, booleans, nil,
+// and numbers as json.Number so that they keep their original formatting.
+//
+// CSV and TSV are parsed into a list of objects, using the first line as header.
+func Parse(s string, format Format) (interface{}, error) {
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(strings.NewReader(s))
+		decoder.UseNumber()
+		var v interface{}
+		err := decoder.Decode(&v)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse JSON")
+		}
+		return v, nil
+
+	case FormatYAML:
+		var v interface{}
+		err := yaml.Unmarshal([]byte(s), &v)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse YAML")
+		}
+		return canonicalize(v), nil
+
+	case FormatCSV, FormatTSV:
+		r := csv.NewReader(bytes.NewReader([]byte(s)))
+		if format == FormatTSV {
+			r.Comma = '\t'
+		}
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s", format)
+		}
+		rows := []interface{}{}
+		if len(records) == 0 {
+			return rows, nil
+		}
+		header := records[0]
+		for _, record := range records[1:] {
+			row := map[string]interface{}{}
+			for i, cell := range record {
+				if i >= len(header) {
+					break
+				}
+				row[header[i]] = parseCell(cell)
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+
+	case FormatText:
+		return s, nil
+
+	default:
+		return nil, errors.Errorf("unknown format %s", format)
+	}
+}
+
+func parseCell(cell string) interface{} {
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return json.Number(cell)
+	}
+	return cell
+}
+
+// canonicalize converts the types produced by the YAML decoder to the ones
+// produced by the JSON decoder.
+func canonicalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, v_ := range v {
+			ret[k] = canonicalize(v_)
+		}
+		return ret
+	case map[interface{}]interface{}:
+		ret := map[string]interface{}{}
+		for k, v_ := range v {
+			ret[fmt.Sprintf("%v", k)] = canonicalize(v_)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, v_ := range v {
+			ret[i] = canonicalize(v_)
+		}
+		return ret
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		return v
+	}
+}
+
+// Compare parses expected and actual and returns the list of differences between them.
+func Compare(expected string, actual string, options *Options) ([]*Difference, error) {
+	e, err := Parse(expected, options.Format)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse expected output")
+	}
+	a, err := Parse(actual, options.Format)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse actual output")
+	}
+
+	c := &comparer{ignoreFields: map[string]bool{}}
+	for _, f := range options.IgnoreFields {
+		c.ignoreFields[f] = true
+	}
+
+	if options.IgnoreOrder {
+		e_, ok1 := e.([]interface{})
+		a_, ok2 := a.([]interface{})
+		if ok1 && ok2 {
+			c.compareUnordered("", e_, a_)
+			return c.differences, nil
+		}
+	}
+
+	c.compare("", e, a)
+	return c.differences, nil
+}
+
+type comparer struct {
+	ignoreFields map[string]bool
+	differences  []*Difference
+}
+
+func (c *comparer) add(path string, expected interface{}, actual interface{}) {
+	if path == "" {
+		path = "."
+	}
+	c.differences = append(c.differences, &Difference{
+		Path:     path,
+		Expected: expected,
+		Actual:   actual,
+	})
+}
+
+func (c *comparer) compare(path string, expected interface{}, actual interface{}) {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			c.add(path, expected, actual)
+			return
+		}
+		keys := map[string]bool{}
+		for k := range e {
+			keys[k] = true
+		}
+		for k := range a {
+			keys[k] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for k := range keys {
+			if !c.ignoreFields[k] {
+				sortedKeys = append(sortedKeys, k)
+			}
+		}
+		sort.Strings(sortedKeys)
+
+		for _, k := range sortedKeys {
+			path_ := k
+			if path != "" {
+				path_ = path + "." + k
+			}
+			ev, eok := e[k]
+			av, aok := a[k]
+			switch {
+			case !eok:
+				c.add(path_, missing{}, av)
+			case !aok:
+				c.add(path_, ev, missing{})
+			default:
+				c.compare(path_, ev, av)
+			}
+		}
+
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			c.add(path, expected, actual)
+			return
+		}
+		for i := 0; i < len(e) || i < len(a); i++ {
+			path_ := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(e):
+				c.add(path_, missing{}, a[i])
+			case i >= len(a):
+				c.add(path_, e[i], missing{})
+			default:
+				c.compare(path_, e[i], a[i])
+			}
+		}
+
+	case json.Number:
+		a, ok := actual.(json.Number)
+		if !ok || !numbersEqual(e, a) {
+			c.add(path, expected, actual)
+		}
+
+	default:
+		if expected != actual {
+			c.add(path, expected, actual)
+		}
+	}
+}
+
+// compareUnordered matches each expected row with an equal actual row, and reports
+// the rows that couldn't be matched.
+func (c *comparer) compareUnordered(path string, expected []interface{}, actual []interface{}) {
+	matched := make([]bool, len(actual))
+
+	for i, e := range expected {
+		found := false
+		for j, a := range actual {
+			if matched[j] {
+				continue
+			}
+			c_ := &comparer{ignoreFields: c.ignoreFields}
+			c_.compare("", e, a)
+			if len(c_.differences) == 0 {
+				matched[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.add(fmt.Sprintf("%s[%d]", path, i), e, missing{})
+		}
+	}
+
+	for j, a := range actual {
+		if !matched[j] {
+			c.add(fmt.Sprintf("%s[%d]", path, j), missing{}, a)
+		}
+	}
+}
+
+func numbersEqual(a json.Number, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	af, err1 := a.Float64()
+	bf, err2 := b.Float64()
+	return err1 == nil && err2 == nil && af == bf
+}
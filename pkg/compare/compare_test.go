@@ -0,0 +1,68 @@
+package compare
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func differenceStrings(ds []*Difference) []string {
+	ret := []string{}
+	for _, d := range ds {
+		ret = append(ret, d.String())
+	}
+	return ret
+}
+
+func TestCompareJSON(t *testing.T) {
+	ds, err := Compare(
+		`[{"name": "foo", "amount": 12.5}, {"name": "bar", "amount": 3}]`,
+		`[{"amount": 12.50, "name": "foo"}, {"amount": 4, "name": "bar", "extra": true}]`,
+		&Options{Format: FormatJSON},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"[1].amount: 3 != 4",
+		"[1].extra: <missing> != true",
+	}, differenceStrings(ds))
+}
+
+func TestCompareYAMLIgnoreFields(t *testing.T) {
+	ds, err := Compare(
+		"name: foo\ncreated_at: 2023-01-01\nitems: [1, 2]\n",
+		"items: [1.0, 2]\ncreated_at: 2024-01-01\nname: foo\n",
+		&Options{Format: FormatYAML, IgnoreFields: []string{"created_at"}},
+	)
+	require.NoError(t, err)
+	assert.Empty(t, ds)
+}
+
+func TestCompareCSVIgnoreOrder(t *testing.T) {
+	expected := "name,amount\nfoo,12.5\nbar,3\n"
+	actual := "name,amount\nbar,3.0\nfoo,12.50\n"
+
+	ds, err := Compare(expected, actual, &Options{Format: FormatCSV, IgnoreOrder: true})
+	require.NoError(t, err)
+	assert.Empty(t, ds)
+
+	ds, err = Compare(expected, actual, &Options{Format: FormatCSV})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`[0].amount: 12.5 != 3.0`,
+		`[0].name: "foo" != "bar"`,
+		`[1].amount: 3 != 12.50`,
+		`[1].name: "bar" != "foo"`,
+	}, differenceStrings(ds))
+
+	ds, err = Compare(expected, "name,amount\nfoo,12.5\nbaz,3\n", &Options{Format: FormatCSV, IgnoreOrder: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`[1]: {"amount":3,"name":"bar"} != <missing>`,
+		`[1]: <missing> != {"amount":3,"name":"baz"}`,
+	}, differenceStrings(ds))
+}
+
+func TestDetectFormat(t *testing.T) {
+	assert.Equal(t, FormatJSON, DetectFormat("json"))
+	assert.Equal(t, FormatText, DetectFormat("table"))
+}
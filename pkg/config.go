@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg/environment"
+	"github.com/go-go-golems/cliopatra/pkg/normalize"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+)
+
+// RepositoryConfigFileName is the name of the optional configuration file at the root
+// of a repository. Since it starts with a ., it is never loaded as a program.
+const RepositoryConfigFileName = ".cliopatra.yaml"
+
+// CommandNesting decides how the programs of a repository are grouped when they are
+// exposed as cliopatra subcommands.
+type CommandNesting string
+
+const (
+	// CommandNestingDirectory groups programs by the directory of their program file,
+	// relative to the repository. This is the default.
+	CommandNestingDirectory CommandNesting = "directory"
+	// CommandNestingVerbs groups programs by the verbs they pass to their executable.
+	CommandNestingVerbs CommandNesting = "verbs"
+)
+
+// DefaultEnvFile is loaded as the default environment of a repository if it exists at its
+// root and the repository configuration doesn't list its own envFiles.
+const DefaultEnvFile = ".env"
+
+// EnvProfile is a set of environment variables, loaded from .env files and declared
+// inline. The inline variables override the ones of the files.
+type EnvProfile struct {
+	Env      map[string]string `yaml:"env,omitempty"`
+	EnvFiles []string          `yaml:"envFiles,omitempty"`
+
+	// files are the variables of EnvFiles, in order
+	files []map[string]string
+}
+
+// layers returns the variables of the profile, from lowest to highest precedence.
+func (e *EnvProfile) layers() []map[string]string {
+	return append(append([]map[string]string{}, e.files...), e.Env)
+}
+
+// load reads the env files of the profile from f.
+func (e *EnvProfile) load(f fs.FS) error {
+	e.files = nil
+	for _, name := range e.EnvFiles {
+		file, err := f.Open(name)
+		if err != nil {
+			return errors.Wrapf(err, "could not open env file %s", name)
+		}
+		env, err := environment.ParseDotEnv(file)
+		_ = file.Close()
+		if err != nil {
+			return errors.Wrapf(err, "could not parse env file %s", name)
+		}
+		e.files = append(e.files, env)
+	}
+	return nil
+}
+
+// RepositoryConfig contains the settings that apply to all the programs of a repository.
+type RepositoryConfig struct {
+	// EnvProfile is the default environment of the programs.
+	EnvProfile `yaml:",inline"`
+	// Profiles are named environments, such as dev, staging or prod, that are layered
+	// on top of the default environment when selected.
+	Profiles map[string]*EnvProfile `yaml:"profiles,omitempty"`
+
+	// Normalize is applied to the output of all programs, before the program's own filters.
+	Normalize normalize.Pipeline `yaml:"normalize,omitempty"`
+	// CommandNesting groups the programs exposed as subcommands, either by directory
+	// or by verbs.
+	CommandNesting CommandNesting `yaml:"commandNesting,omitempty"`
+	// Namespace is the first component of the qualified names of the programs,
+	// the name of the repository directory by default.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Interpolate replaces the `${VAR}` references in the env entries, raw flags and
+	// flag and argument values of the programs. Without it, they are passed as written.
+	Interpolate bool `yaml:"interpolate,omitempty"`
+}
+
+// LoadRepositoryConfigFromFS loads the repository configuration file at the root of f.
+// An empty configuration is returned if the file doesn't exist.
+//
+// The env files of the default environment and of the profiles are loaded as well,
+// relative to the root of f.
+func LoadRepositoryConfigFromFS(f fs.FS) (*RepositoryConfig, error) {
+	config := &RepositoryConfig{}
+
+	s, err := fs.ReadFile(f, RepositoryConfigFileName)
+	switch {
+	case err == nil:
+		err = yaml.Unmarshal(s, config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not decode %s", RepositoryConfigFileName)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, errors.Wrapf(err, "could not read %s", RepositoryConfigFileName)
+	}
+	switch config.CommandNesting {
+	case "", CommandNestingDirectory, CommandNestingVerbs:
+	default:
+		return nil, errors.Errorf("unknown commandNesting %s in %s", config.CommandNesting, RepositoryConfigFileName)
+	}
+
+	if config.EnvFiles == nil {
+		if _, err := fs.Stat(f, DefaultEnvFile); err == nil {
+			config.EnvFiles = []string{DefaultEnvFile}
+		}
+	}
+	err = config.EnvProfile.load(f)
+	if err != nil {
+		return nil, err
+	}
+	for name, profile := range config.Profiles {
+		if profile == nil {
+			profile = &EnvProfile{}
+			config.Profiles[name] = profile
+		}
+		err = profile.load(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load profile %s", name)
+		}
+	}
+
+	return config, nil
+}
+
+// HasProfile returns true if the repository declares the profile name.
+func (c *RepositoryConfig) HasProfile(name string) bool {
+	_, ok := c.Profiles[name]
+	return ok
+}
+
+// envLayers returns the environment of the repository when the profile is selected,
+// from lowest to highest precedence: the default env files and variables, then the
+// ones of the profile. A profile that the repository doesn't declare is ignored.
+func (c *RepositoryConfig) envLayers(profile string) []map[string]string {
+	ret := c.EnvProfile.layers()
+	if p, ok := c.Profiles[profile]; ok {
+		ret = append(ret, p.layers()...)
+	}
+	return ret
+}
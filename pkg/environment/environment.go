@@ -0,0 +1,201 @@
+// Package environment computes the environment variables programs are run with.
+//
+// Variables are merged in layers, for example the defaults of a repository, then a
+// profile such as `prod`, then the program and then the command line. Values can
+// refer to other variables as `${VAR}` or `${VAR:-default}`, which are looked up in
+// the layers below and in the environment of cliopatra. `$${` is a literal `${`.
+package environment
+
+import (
+	"bufio"
+	"github.com/go-go-golems/cliopatra/pkg/helpers/maps"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// Lookup returns the value of a variable, and whether it is set. os.LookupEnv is a Lookup.
+type Lookup func(name string) (string, bool)
+
+// Chain returns a Lookup that tries each lookup in turn.
+func Chain(lookups ...Lookup) Lookup {
+	return func(name string) (string, bool) {
+		for _, lookup := range lookups {
+			if v, ok := lookup(name); ok {
+				return v, true
+			}
+		}
+		return "", false
+	}
+}
+
+// MapLookup returns a Lookup over the variables of m.
+func MapLookup(m map[string]string) Lookup {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+// Interpolate replaces the `${VAR}` and `${VAR:-default}` references in s with
+// their value. Referring to a variable that isn't set and has no default is an error.
+func Interpolate(s string, lookup Lookup) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	sb := strings.Builder{}
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			// $${ is an escaped ${
+			sb.WriteString(s[:i])
+			sb.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		sb.WriteString(s[:i])
+
+		end := strings.Index(s[i:], "}")
+		if end < 0 {
+			return "", errors.Errorf("unterminated variable reference in %q", s)
+		}
+		ref := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		name, default_, hasDefault := strings.Cut(ref, ":-")
+		if !isValidName(name) {
+			return "", errors.Errorf("invalid variable name %q", name)
+		}
+		v, ok := lookup(name)
+		if !ok || (v == "" && hasDefault) {
+			if !hasDefault {
+				return "", errors.Errorf("variable %s is not set", name)
+			}
+			v = default_
+		}
+		sb.WriteString(v)
+	}
+}
+
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Merge merges layers of variables, each layer overriding the ones before it. The
+// values of a layer are interpolated with the variables of the layers before it,
+// falling back to fallback, usually os.LookupEnv.
+func Merge(fallback Lookup, layers ...map[string]string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, layer := range layers {
+		lookup := Chain(MapLookup(ret), fallback)
+		values := map[string]string{}
+		for _, k := range maps.SortedKeys(layer) {
+			v, err := Interpolate(layer[k], lookup)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not interpolate %s", k)
+			}
+			values[k] = v
+		}
+		for k, v := range values {
+			ret[k] = v
+		}
+	}
+	return ret, nil
+}
+
+// ParseDotEnv parses a .env file of KEY=VALUE lines. Empty lines, comments starting
+// with # and a leading `export` are skipped. Values can be quoted with single or
+// double quotes, double-quoted values support \n, \t, \" and \\ escapes. Values are
+// interpolated when the file is merged as a layer, except for single-quoted values,
+// whose `${` are escaped.
+func ParseDotEnv(r io.Reader) (map[string]string, error) {
+	ret := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || !isValidName(k) {
+			return nil, errors.Errorf("line %d: expected KEY=VALUE", lineNumber)
+		}
+		v, err := parseDotEnvValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber)
+		}
+		ret[k] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func parseDotEnvValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+
+	switch v[0] {
+	case '\'':
+		end := strings.Index(v[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated single quote")
+		}
+		return strings.ReplaceAll(v[1:end+1], "${", "$${"), nil
+
+	case '"':
+		sb := strings.Builder{}
+		for i := 1; i < len(v); i++ {
+			c := v[i]
+			switch {
+			case c == '"':
+				return sb.String(), nil
+			case c == '\\' && i+1 < len(v):
+				i++
+				switch v[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				default:
+					sb.WriteByte(v[i])
+				}
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", errors.New("unterminated double quote")
+
+	default:
+		// strip trailing comments
+		if i := strings.Index(v, " #"); i >= 0 {
+			v = strings.TrimSpace(v[:i])
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,76 @@
+package environment
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	lookup := MapLookup(map[string]string{"PROFILE": "prod.ttc", "EMPTY": ""})
+
+	for _, tc := range []struct {
+		s        string
+		expected string
+	}{
+		{"no variables", "no variables"},
+		{"${PROFILE}", "prod.ttc"},
+		{"profile=${PROFILE}, again ${PROFILE}", "profile=prod.ttc, again prod.ttc"},
+		{"${MISSING:-localhost.ttc}", "localhost.ttc"},
+		{"${EMPTY:-default}", "default"},
+		{"${EMPTY}", ""},
+		{"$PROFILE", "$PROFILE"},
+		{"$${PROFILE}", "${PROFILE}"},
+	} {
+		v, err := Interpolate(tc.s, lookup)
+		require.NoError(t, err, tc.s)
+		assert.Equal(t, tc.expected, v, tc.s)
+	}
+
+	for _, s := range []string{"${MISSING}", "${PROFILE", "${1X}"} {
+		_, err := Interpolate(s, lookup)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	fallback := MapLookup(map[string]string{"HOME": "/home/ttc"})
+	env, err := Merge(fallback,
+		map[string]string{"DBT_PROFILE": "localhost.ttc", "DBT_DIR": "${HOME}/dbt"},
+		map[string]string{"DBT_PROFILE": "prod.ttc"},
+		map[string]string{"PROFILE_FLAG": "--dbt-profile=${DBT_PROFILE}"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"DBT_PROFILE":  "prod.ttc",
+		"DBT_DIR":      "/home/ttc/dbt",
+		"PROFILE_FLAG": "--dbt-profile=prod.ttc",
+	}, env)
+
+	_, err = Merge(fallback, map[string]string{"A": "${B}"})
+	assert.Error(t, err)
+}
+
+func TestParseDotEnv(t *testing.T) {
+	env, err := ParseDotEnv(strings.NewReader(`
+# database
+DBT_PROFILE=localhost.ttc
+export DBT_DIR = /home/ttc/dbt # comment
+QUOTED="a \"b\"\nc"
+SINGLE='${NOT_INTERPOLATED}'
+EMPTY=
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"DBT_PROFILE": "localhost.ttc",
+		"DBT_DIR":     "/home/ttc/dbt",
+		"QUOTED":      "a \"b\"\nc",
+		"SINGLE":      "$${NOT_INTERPOLATED}",
+		"EMPTY":       "",
+	}, env)
+
+	_, err = ParseDotEnv(strings.NewReader("A=1\nnot a variable\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
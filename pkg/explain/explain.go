@@ -0,0 +1,352 @@
+// Package explain describes how a program would be run without running it: the
+// shell-quoted command line, the environment variables set on top of the current
+// environment, where stdin comes from, and where the value of each parameter
+// comes from.
+package explain
+
+import (
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg/helpers/maps"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Parameter describes a flag or an argument of the program.
+type Parameter struct {
+	Name       string
+	IsArgument bool
+	// Rendered is the parameter as passed on the command line, for example
+	// `--output csv`. It is empty for bool flags without value that are false.
+	Rendered []string
+	// Source tells where the value comes from.
+	Source string
+	// Recorded is the value stored in the program, if it was overridden.
+	Recorded string
+	// Log is the provenance recorded in the program file.
+	Log []*parameters.ParseStep
+}
+
+// EnvVariable is a variable that the program sets on top of the current environment.
+type EnvVariable struct {
+	Name  string
+	Value string
+	// Previous is the value in the current environment, if the variable was set.
+	Previous *string
+}
+
+// Explanation describes how a program would be run.
+type Explanation struct {
+	Dir string
+	// PlannedDir describes the working directory the program would be run in, when
+	// it is not created yet.
+	PlannedDir string
+	Path       string
+	Args       []string
+	Env        []*EnvVariable
+	Stdin      string
+	Parameters []*Parameter
+}
+
+type settings struct {
+	dir            string
+	plannedDir     string
+	stdinSource    string
+	recorded       *cliopatra.Program
+	overrideSource string
+	log            func(name string) []*parameters.ParseStep
+	environ        []string
+}
+
+type Option func(s *settings)
+
+// WithDir sets the working directory the program is run in.
+func WithDir(dir string) Option {
+	return func(s *settings) {
+		s.dir = dir
+	}
+}
+
+// WithPlannedDir describes the working directory the program would be run in, for
+// example a temporary directory that is only created when running the program.
+func WithPlannedDir(description string) Option {
+	return func(s *settings) {
+		s.plannedDir = description
+	}
+}
+
+// WithStdinSource describes the stdin of programs that don't declare their own.
+// The default is "none".
+func WithStdinSource(stdinSource string) Option {
+	return func(s *settings) {
+		s.stdinSource = stdinSource
+	}
+}
+
+// WithRecorded attributes the parameter values that differ from the ones of
+// recorded to source, for example "command line" or "template".
+func WithRecorded(recorded *cliopatra.Program, source string) Option {
+	return func(s *settings) {
+		s.recorded = recorded
+		s.overrideSource = source
+	}
+}
+
+// WithLog passes the provenance recorded for each parameter in the program file.
+func WithLog(log func(name string) []*parameters.ParseStep) Option {
+	return func(s *settings) {
+		s.log = log
+	}
+}
+
+// WithEnviron sets the environment the program would inherit, which defaults to
+// the current environment.
+func WithEnviron(environ []string) Option {
+	return func(s *settings) {
+		s.environ = environ
+	}
+}
+
+// Explain computes the command line of p and the provenance of its parameters.
+func Explain(p *cliopatra.Program, options ...Option) (*Explanation, error) {
+	s := &settings{
+		stdinSource: "none",
+		environ:     os.Environ(),
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	path := p.Path
+	if path == "" {
+		path = p.Name
+		if path_, err := exec.LookPath(p.Name); err == nil {
+			path = path_
+		}
+	}
+	args, err := p.ComputeArgs(parameters.NewParsedParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Explanation{
+		Dir:        s.dir,
+		PlannedDir: s.plannedDir,
+		Path:       path,
+		Args:       args,
+		Stdin:      s.stdinSource,
+	}
+	if p.Stdin != "" {
+		ret.Stdin = fmt.Sprintf("declared by the program (%d bytes)", len(p.Stdin))
+	}
+
+	environ := map[string]string{}
+	for _, kv := range s.environ {
+		k, v, _ := strings.Cut(kv, "=")
+		environ[k] = v
+	}
+	for _, k := range maps.SortedKeys(p.Env) {
+		v := &EnvVariable{Name: k, Value: p.Env[k]}
+		if previous, ok := environ[k]; ok {
+			v.Previous = &previous
+		}
+		ret.Env = append(ret.Env, v)
+	}
+
+	recorded := map[string]*cliopatra.Parameter{}
+	if s.recorded != nil {
+		for _, param := range append(append([]*cliopatra.Parameter{}, s.recorded.Flags...), s.recorded.Args...) {
+			recorded[param.Name] = param
+		}
+	}
+
+	explain := func(param *cliopatra.Parameter, isArgument bool) error {
+		rendered, err := render(param, isArgument)
+		if err != nil {
+			return err
+		}
+		ret_ := &Parameter{
+			Name:       param.Name,
+			IsArgument: isArgument,
+			Rendered:   rendered,
+			Source:     "program",
+		}
+		if param.Raw != "" {
+			ret_.Source = "raw value of the program"
+		}
+		if r, ok := recorded[param.Name]; ok {
+			recordedRendered, err := render(r, isArgument)
+			if err != nil {
+				return err
+			}
+			if strings.Join(recordedRendered, " ") != strings.Join(rendered, " ") {
+				ret_.Source = s.overrideSource
+				ret_.Recorded = valueOf(recordedRendered, isArgument)
+			}
+		}
+		if s.log != nil {
+			ret_.Log = s.log(param.Name)
+		}
+		ret.Parameters = append(ret.Parameters, ret_)
+		return nil
+	}
+	for _, f := range p.Flags {
+		err = explain(f, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range p.Args {
+		err = explain(a, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// render renders a parameter with cliopatra.Program.ComputeArgs, as the only
+// parameter of an otherwise empty program.
+func render(param *cliopatra.Parameter, isArgument bool) ([]string, error) {
+	p := &cliopatra.Program{}
+	if isArgument {
+		p.Args = []*cliopatra.Parameter{param}
+	} else {
+		p.Flags = []*cliopatra.Parameter{param}
+	}
+	ret, err := p.ComputeArgs(parameters.NewParsedParameters())
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not render %s", param.Name)
+	}
+	return ret, nil
+}
+
+// valueOf returns the value of a rendered parameter, without the flag.
+func valueOf(rendered []string, isArgument bool) string {
+	switch {
+	case len(rendered) == 0:
+		return "false"
+	case isArgument || len(rendered) == 2:
+		return rendered[len(rendered)-1]
+	default:
+		return "true"
+	}
+}
+
+// CommandLine returns the command as it can be pasted into a shell, prefixed with
+// the environment variables set by the program and the change of directory.
+func (e *Explanation) CommandLine() string {
+	words := []string{}
+	if e.Dir != "" {
+		words = append(words, "cd", Quote(e.Dir), "&&")
+	}
+	for _, v := range e.Env {
+		words = append(words, v.Name+"="+Quote(v.Value))
+	}
+	words = append(words, Quote(e.Path))
+	for _, arg := range e.Args {
+		words = append(words, Quote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// Write writes the explanation in a human readable form.
+func (e *Explanation) Write(w io.Writer) error {
+	sb := &strings.Builder{}
+	sb.WriteString("command:\n  " + e.CommandLine() + "\n\n")
+
+	sb.WriteString("environment:")
+	if len(e.Env) == 0 {
+		sb.WriteString(" unchanged\n")
+	} else {
+		sb.WriteString("\n")
+		for _, v := range e.Env {
+			switch {
+			case v.Previous == nil:
+				sb.WriteString(fmt.Sprintf("  + %s=%s\n", v.Name, v.Value))
+			case *v.Previous != v.Value:
+				sb.WriteString(fmt.Sprintf("  ~ %s=%s (was %s)\n", v.Name, v.Value, *v.Previous))
+			default:
+				sb.WriteString(fmt.Sprintf("  = %s=%s\n", v.Name, v.Value))
+			}
+		}
+	}
+	sb.WriteString("\nstdin: " + e.Stdin + "\n")
+	if e.PlannedDir != "" {
+		sb.WriteString("\nworking directory: " + e.PlannedDir + "\n")
+	}
+
+	if len(e.Parameters) > 0 {
+		sb.WriteString("\nparameters:\n")
+	}
+	for _, param := range e.Parameters {
+		rendered := strings.Join(quoteAll(param.Rendered), " ")
+		if param.IsArgument {
+			rendered = fmt.Sprintf("<%s> %s", param.Name, rendered)
+		} else if rendered == "" {
+			rendered = fmt.Sprintf("--%s (not passed)", param.Name)
+		}
+		sb.WriteString("  " + rendered + "\n")
+
+		source := param.Source
+		if param.Recorded != "" {
+			source += fmt.Sprintf(" (recorded: %s)", param.Recorded)
+		}
+		sb.WriteString("    source: " + source + "\n")
+		if len(param.Log) > 0 {
+			sb.WriteString("    log:\n")
+			for _, step := range param.Log {
+				sb.WriteString("      " + formatStep(step) + "\n")
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (e *Explanation) String() string {
+	sb := &strings.Builder{}
+	_ = e.Write(sb)
+	return sb.String()
+}
+
+// formatStep formats a parse step as `source: value (key=value, ...)`.
+func formatStep(step *parameters.ParseStep) string {
+	ret := fmt.Sprintf("%s: %v", step.Source, step.Value)
+	if s, ok := step.Value.(string); ok {
+		ret = fmt.Sprintf("%s: %q", step.Source, s)
+	}
+	metadata := []string{}
+	for _, k := range maps.SortedKeys(step.Metadata) {
+		metadata = append(metadata, fmt.Sprintf("%s=%v", k, step.Metadata[k]))
+	}
+	if len(metadata) > 0 {
+		ret += " (" + strings.Join(metadata, ", ") + ")"
+	}
+	return ret
+}
+
+var safeWord = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// Quote quotes s so that a POSIX shell reads it as a single word.
+func Quote(s string) string {
+	if safeWord.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func quoteAll(words []string) []string {
+	ret := make([]string, len(words))
+	for i, w := range words {
+		ret[i] = Quote(w)
+	}
+	return ret
+}
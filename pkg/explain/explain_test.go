@@ -0,0 +1,101 @@
+package explain
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, "--output", Quote("--output"))
+	assert.Equal(t, "a/b.yaml", Quote("a/b.yaml"))
+	assert.Equal(t, "''", Quote(""))
+	assert.Equal(t, "'hello world'", Quote("hello world"))
+	assert.Equal(t, `'it'\''s'`, Quote("it's"))
+	assert.Equal(t, "'$HOME'", Quote("$HOME"))
+}
+
+func TestExplain(t *testing.T) {
+	recorded := cliopatra.NewProgram(
+		cliopatra.WithName("ttc-orders"),
+		cliopatra.WithPath("/usr/bin/sqleton"),
+		cliopatra.WithVerbs("ttc", "orders"),
+		cliopatra.WithEnv(map[string]string{"DBT_DIR": "/dbt", "HOME": "/home/ttc"}),
+		cliopatra.WithFlags(
+			&cliopatra.Parameter{Name: "dbt-profile", Type: parameters.ParameterTypeString, Value: "localhost.ttc"},
+			&cliopatra.Parameter{Name: "use-dbt-profiles", Type: parameters.ParameterTypeBool, Value: true, NoValue: true},
+			&cliopatra.Parameter{Name: "where", Type: parameters.ParameterTypeString, Raw: "id = 1"},
+		),
+		cliopatra.WithArgs(&cliopatra.Parameter{Name: "table", Type: parameters.ParameterTypeString, Value: "orders"}),
+	)
+	p := recorded.Clone()
+	require.NoError(t, p.SetFlagValue("dbt-profile", "prod.ttc"))
+
+	log := []*parameters.ParseStep{
+		{Source: "defaults", Value: ""},
+		{Source: "viper", Value: "localhost.ttc", Metadata: map[string]interface{}{"flag": "dbt-profile", "layer": "Dbt flags"}},
+	}
+	e, err := Explain(p,
+		WithRecorded(recorded, "command line"),
+		WithLog(func(name string) []*parameters.ParseStep {
+			if name == "dbt-profile" {
+				return log
+			}
+			return nil
+		}),
+		WithEnviron([]string{"HOME=/root", "PATH=/bin"}),
+		WithStdinSource("inherited"),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t,
+		"DBT_DIR=/dbt HOME=/home/ttc /usr/bin/sqleton ttc orders --dbt-profile prod.ttc --use-dbt-profiles --where 'id = 1' orders",
+		e.CommandLine())
+	assert.Equal(t, `command:
+  DBT_DIR=/dbt HOME=/home/ttc /usr/bin/sqleton ttc orders --dbt-profile prod.ttc --use-dbt-profiles --where 'id = 1' orders
+
+environment:
+  + DBT_DIR=/dbt
+  ~ HOME=/home/ttc (was /root)
+
+stdin: inherited
+
+parameters:
+  --dbt-profile prod.ttc
+    source: command line (recorded: localhost.ttc)
+    log:
+      defaults: ""
+      viper: "localhost.ttc" (flag=dbt-profile, layer=Dbt flags)
+  --use-dbt-profiles
+    source: program
+  --where 'id = 1'
+    source: raw value of the program
+  <table> orders
+    source: program
+`, e.String())
+}
+
+func TestExplainDirAndStdin(t *testing.T) {
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("cat"),
+		cliopatra.WithPath("cat"),
+		cliopatra.WithStdin("hello\n"),
+	)
+	e, err := Explain(p, WithDir("/tmp/work dir"), WithEnviron([]string{}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "cd '/tmp/work dir' && cat", e.CommandLine())
+	assert.Equal(t, "declared by the program (6 bytes)", e.Stdin)
+	assert.Empty(t, e.Env)
+}
+
+func TestExplainPlannedDir(t *testing.T) {
+	p := cliopatra.NewProgram(cliopatra.WithName("cat"), cliopatra.WithPath("cat"))
+	e, err := Explain(p, WithPlannedDir("a new temporary directory"), WithEnviron([]string{}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "cat", e.CommandLine())
+	assert.Contains(t, e.String(), "\nworking directory: a new temporary directory\n")
+}
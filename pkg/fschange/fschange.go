@@ -0,0 +1,187 @@
+// Package fschange detects the files a program creates, modifies and deletes, by
+// comparing snapshots of its working directory taken before and after the run.
+package fschange
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/pkg/errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+)
+
+type ChangeType string
+
+const (
+	ChangeCreated  ChangeType = "created"
+	ChangeModified ChangeType = "modified"
+	ChangeDeleted  ChangeType = "deleted"
+)
+
+// MaxContentSize is the size above which the content of a changed file is not
+// stored, only its hash.
+const MaxContentSize = 64 * 1024
+
+// Change is a file that was created, modified or deleted by a program.
+//
+// The content of created and modified files is stored if it is text and smaller
+// than MaxContentSize, otherwise only its SHA-256 hash is stored.
+type Change struct {
+	Path    string     `yaml:"path" json:"path"`
+	Type    ChangeType `yaml:"change" json:"change"`
+	Content string     `yaml:"content,omitempty" json:"content,omitempty"`
+	SHA256  string     `yaml:"sha256,omitempty" json:"sha256,omitempty"`
+
+	// hash is the hash of the actual file, even when only its content is stored
+	hash string
+}
+
+// Hash returns the SHA-256 hash of a file detected by Diff.
+func (c *Change) Hash() string {
+	return c.hash
+}
+
+// Snapshot records the hashes of the files in a directory.
+type Snapshot struct {
+	dir    string
+	ignore []string
+	hashes map[string]string
+}
+
+// TakeSnapshot hashes all the files in dir. Files matching one of the ignore
+// doublestar globs, relative to dir, are left out.
+func TakeSnapshot(dir string, ignore []string) (*Snapshot, error) {
+	for _, pattern := range ignore {
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, errors.Errorf("invalid ignore pattern %s", pattern)
+		}
+	}
+
+	s := &Snapshot{
+		dir:    dir,
+		ignore: ignore,
+		hashes: map[string]string{},
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.isIgnored(rel) {
+			return nil
+		}
+
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		s.hashes[rel] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not snapshot %s", dir)
+	}
+
+	return s, nil
+}
+
+// Ignore returns the globs of the files left out of the snapshot.
+func (s *Snapshot) Ignore() []string {
+	return s.ignore
+}
+
+func (s *Snapshot) isIgnored(path string) bool {
+	for _, pattern := range s.ignore {
+		if ok, _ := doublestar.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Diff returns the changes between two snapshots of the same directory, sorted by path.
+// The content of created and modified files is read from the directory.
+func Diff(before *Snapshot, after *Snapshot) ([]*Change, error) {
+	ret := []*Change{}
+
+	for path, hash := range after.hashes {
+		oldHash, ok := before.hashes[path]
+		if ok && oldHash == hash {
+			continue
+		}
+		c := &Change{Path: path, Type: ChangeModified, SHA256: hash, hash: hash}
+		if !ok {
+			c.Type = ChangeCreated
+		}
+		err := c.readContent(after.dir)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+
+	for path := range before.hashes {
+		if _, ok := after.hashes[path]; !ok {
+			ret = append(ret, &Change{Path: path, Type: ChangeDeleted})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+
+	return ret, nil
+}
+
+// readContent stores the content of the file instead of its hash if it is small text.
+func (c *Change) readContent(dir string) error {
+	path := filepath.Join(dir, filepath.FromSlash(c.Path))
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 || info.Size() > MaxContentSize {
+		return nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(b) {
+		return nil
+	}
+	c.Content = string(b)
+	c.SHA256 = ""
+	return nil
+}
@@ -0,0 +1,59 @@
+package fschange
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path string, content []byte) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, path), content, 0644))
+	}
+	write("keep.txt", []byte("keep\n"))
+	write("modified.txt", []byte("before\n"))
+	write("deleted.txt", []byte("deleted\n"))
+	write("cache/a.bin", []byte("a"))
+
+	before, err := TakeSnapshot(dir, []string{"cache/**"})
+	require.NoError(t, err)
+
+	write("modified.txt", []byte("after\n"))
+	require.NoError(t, os.Remove(filepath.Join(dir, "deleted.txt")))
+	write("out/created.txt", []byte("created\n"))
+	write("out/binary.dat", []byte{0xff, 0xfe, 0x00})
+	write("cache/b.bin", []byte("b"))
+
+	after, err := TakeSnapshot(dir, before.Ignore())
+	require.NoError(t, err)
+
+	changes, err := Diff(before, after)
+	require.NoError(t, err)
+	require.Len(t, changes, 4)
+
+	assert.Equal(t, "deleted.txt", changes[0].Path)
+	assert.Equal(t, ChangeDeleted, changes[0].Type)
+
+	assert.Equal(t, "modified.txt", changes[1].Path)
+	assert.Equal(t, ChangeModified, changes[1].Type)
+	assert.Equal(t, "after\n", changes[1].Content)
+	assert.Equal(t, "", changes[1].SHA256)
+	assert.NotEmpty(t, changes[1].Hash())
+
+	assert.Equal(t, "out/binary.dat", changes[2].Path)
+	assert.Equal(t, ChangeCreated, changes[2].Type)
+	assert.Equal(t, "", changes[2].Content)
+	assert.Len(t, changes[2].SHA256, 64)
+
+	assert.Equal(t, "out/created.txt", changes[3].Path)
+	assert.Equal(t, "created\n", changes[3].Content)
+}
+
+func TestInvalidIgnorePattern(t *testing.T) {
+	_, err := TakeSnapshot(t.TempDir(), []string{"[a"})
+	assert.Error(t, err)
+}
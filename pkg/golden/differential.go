@@ -0,0 +1,114 @@
+package golden
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/pkg/errors"
+	"path/filepath"
+)
+
+// NewDifferentialFunc returns a ProgramFunc that runs a program twice, once with
+// the baseline executable and once with the candidate executable, and compares
+// the outputs of both runs instead of comparing them with stored expectations.
+//
+// Only programs running tool, matched by its full path or by its base name, have
+// their executable replaced. Other programs are not run and have StatusSkip.
+//
+// Outputs are normalized and stdout is compared as data as in RunProgram. The
+// result has StatusPass if both runs behaved the same, and StatusFail otherwise.
+// Its Output is the output of the candidate.
+func NewDifferentialFunc(tool string, baseline string, candidate string) ProgramFunc {
+	return func(ctx context.Context, rp *pkg.RepositoryProgram, options ...Option) *Result {
+		res := &Result{
+			Name:          rp.Program().Name,
+			QualifiedName: rp.QualifiedName(),
+			Path:          rp.Path(),
+		}
+
+		if !RunsExecutable(rp, tool) {
+			res.Status = StatusSkip
+			return res
+		}
+
+		runWith := func(path string) (*Result, error) {
+			options_ := append(append([]Option{}, options...), WithPathOverride(func(string) string {
+				return path
+			}))
+			r := ExecuteProgram(ctx, rp, options_...)
+			return r, r.Err
+		}
+
+		base, err := runWith(baseline)
+		if err != nil {
+			res.Status = StatusError
+			res.Err = errors.Wrap(err, "baseline")
+			return res
+		}
+		cand, err := runWith(candidate)
+		if err != nil {
+			res.Status = StatusError
+			res.Err = errors.Wrap(err, "candidate")
+			return res
+		}
+		res.Output = cand.Output
+		res.Duration = cand.Duration
+
+		err = res.compare(rp, base, cand)
+		if err != nil {
+			res.Status = StatusError
+			res.Err = err
+			return res
+		}
+
+		res.Status = StatusPass
+		if len(res.FailedChecks()) > 0 {
+			res.Status = StatusFail
+		}
+		return res
+	}
+}
+
+// RunsExecutable returns true if the executable of the program is path, or has path
+// as its base name. Programs without a path run the executable named like them.
+func RunsExecutable(rp *pkg.RepositoryProgram, path string) bool {
+	executable := rp.Program().Path
+	if executable == "" {
+		executable = rp.Program().Name
+	}
+	return executable == path || filepath.Base(executable) == path
+}
+
+// compare checks the outputs of the candidate against the ones of the baseline.
+func (r *Result) compare(rp *pkg.RepositoryProgram, baseline *Result, candidate *Result) error {
+	exitCode := &Check{Name: "exit-code", Status: StatusPass}
+	if baseline.Output.ExitCode != candidate.Output.ExitCode {
+		exitCode.Status = StatusFail
+		exitCode.Diff = fmt.Sprintf("baseline %d, candidate %d", baseline.Output.ExitCode, candidate.Output.ExitCode)
+	}
+	r.Checks = append(r.Checks, exitCode)
+
+	c, err := newStdoutCheck(rp.CompareOptions(), baseline.Output.Stdout, candidate.Output.Stdout)
+	if err != nil {
+		return err
+	}
+	r.Checks = append(r.Checks, c)
+
+	c, err = newDiffCheck("stderr", baseline.Output.Stderr, candidate.Output.Stderr)
+	if err != nil {
+		return err
+	}
+	r.Checks = append(r.Checks, c)
+
+	if rp.Spec().CapturesFileChanges() {
+		checks, err := newFileChangeChecks(baseline.FileChanges, candidate.FileChanges, func(s string) string {
+			return s
+		})
+		if err != nil {
+			return err
+		}
+		r.Checks = append(r.Checks, checks...)
+	}
+
+	return nil
+}
@@ -0,0 +1,600 @@
+// Package golden runs cliopatra programs and compares their output against
+// the expectations recorded in the program file.
+package golden
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/compare"
+	"github.com/go-go-golems/cliopatra/pkg/fschange"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/rs/zerolog/log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusPass  Status = "pass"
+	StatusFail  Status = "fail"
+	StatusError Status = "error"
+	// StatusSkip is used for programs that don't declare any expectation, or that
+	// don't run the executable being compared.
+	StatusSkip Status = "skip"
+	// StatusUpdated is used when running in update mode and the stored output was rewritten.
+	StatusUpdated Status = "updated"
+	// StatusUnchanged is used when running in update mode and the output didn't change.
+	StatusUnchanged Status = "unchanged"
+)
+
+// Check is the outcome of a single expectation of a program, for example
+// its stdout or its exit code.
+type Check struct {
+	// Name is one of stdout, stderr, stderr-pattern, exit-code, file:<path>,
+	// change:<path> or file-changes
+	Name   string
+	Status Status
+	Diff   string
+}
+
+// DiffSummary returns a short description of the diff between the expected
+// and the actual value, for example "+3 -1 lines".
+func (c *Check) DiffSummary() string {
+	if c.Diff == "" {
+		return ""
+	}
+
+	added, removed := 0, 0
+	for _, line := range strings.Split(c.Diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			continue
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+
+	if added == 0 && removed == 0 {
+		// not a line diff, but a list of value mismatches such as an exit code
+		// or the differences of a structured comparison
+		lines := strings.Split(strings.TrimSuffix(c.Diff, "\n"), "\n")
+		if len(lines) == 1 {
+			return lines[0]
+		}
+		return fmt.Sprintf("%d differences", len(lines))
+	}
+
+	return fmt.Sprintf("+%d -%d lines", added, removed)
+}
+
+// Result is the outcome of running a single program as a golden test.
+type Result struct {
+	Name     string
+	Path     string
+	Status   Status
+	Duration time.Duration
+	Output   *runner.Output
+	Checks   []*Check
+	Err      error
+	// FileChanges are the files changed by the program, if the program captures them.
+	FileChanges []*fschange.Change
+	// OutputPath is the program file written by UpdateProgram when using WithOutputDir.
+	OutputPath string
+	// QualifiedName is the qualified name of the program, unlike Name unique in its
+	// repository.
+	QualifiedName string
+
+	workdir *runner.Workdir
+}
+
+// FailedChecks returns the checks that didn't pass.
+func (r *Result) FailedChecks() []*Check {
+	ret := []*Check{}
+	for _, c := range r.Checks {
+		if c.Status != StatusPass {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// HasExpectations returns true if the program declares anything to check its output against.
+func HasExpectations(rp *pkg.RepositoryProgram) bool {
+	p := rp.Program()
+	return p.ExpectedStdout != "" ||
+		p.ExpectedError != "" ||
+		p.ExpectedStatusCode != 0 ||
+		len(p.ExpectedFiles) > 0 ||
+		rp.Spec().ExpectedStderrPattern != "" ||
+		rp.Spec().CapturesFileChanges()
+}
+
+// RunProgram runs the program and checks its output against the expectations
+// stored in the program file.
+//
+// The exit code is always checked, while stdout, stderr and files are only checked
+// if the program declares them. Programs without any expectation are reported as skipped.
+func RunProgram(ctx context.Context, rp *pkg.RepositoryProgram, options ...Option) *Result {
+	res := &Result{
+		Name:          rp.Program().Name,
+		QualifiedName: rp.QualifiedName(),
+		Path:          rp.Path(),
+	}
+
+	if !HasExpectations(rp) {
+		res.Status = StatusSkip
+		return res
+	}
+
+	cleanup, err := res.run(ctx, rp, newSettings(options...))
+	defer cleanup()
+	if err == nil {
+		err = res.check(rp)
+	}
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return res
+	}
+
+	res.Status = StatusPass
+	if len(res.FailedChecks()) > 0 {
+		res.Status = StatusFail
+	}
+
+	return res
+}
+
+// ExecuteProgram runs the program without checking its outputs, which are normalized.
+// The result has StatusPass if the program could be run, whatever its exit code.
+func ExecuteProgram(ctx context.Context, rp *pkg.RepositoryProgram, options ...Option) *Result {
+	res := &Result{
+		Name:          rp.Program().Name,
+		QualifiedName: rp.QualifiedName(),
+		Path:          rp.Path(),
+	}
+
+	cleanup, err := res.run(ctx, rp, newSettings(options...))
+	defer cleanup()
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return res
+	}
+
+	res.Status = StatusPass
+	return res
+}
+
+// CheckOutputPaths returns an error if UpdateProgram would write the program files of
+// several of rps to the same path with the WithOutputDir of options.
+func CheckOutputPaths(rps []*pkg.RepositoryProgram, options ...Option) error {
+	s := newSettings(options...)
+	if s.outputDir == "" {
+		return nil
+	}
+
+	paths := map[string]*pkg.RepositoryProgram{}
+	for _, rp := range rps {
+		path := s.outputPath(rp)
+		if other, ok := paths[path]; ok {
+			return errors.Errorf("%s and %s would both be written to %s", other.Path(), rp.Path(), path)
+		}
+		paths[path] = rp
+	}
+	return nil
+}
+
+// UpdateProgram runs the program and rewrites the expectations stored in the
+// program file if the output changed.
+//
+// Outputs are normalized before being stored. The stdout and exit code are always
+// recorded, stderr only if it is not empty or was already declared, and files only
+// if they were already declared.
+//
+// With WithOutputDir, the program file is written to the output directory instead,
+// and the expectations of rp are left untouched.
+func UpdateProgram(ctx context.Context, rp *pkg.RepositoryProgram, options ...Option) *Result {
+	p := rp.Program()
+	res := &Result{
+		Name: p.Name,
+		Path: rp.Path(),
+	}
+	s := newSettings(options...)
+
+	cleanup, err := res.run(ctx, rp, s)
+	defer cleanup()
+	if err == nil {
+		err = res.check(rp)
+	}
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return res
+	}
+
+	// stdout is only checked if it was declared, so we need to catch new outputs separately
+	newStdout := p.ExpectedStdout == "" && res.Output.Stdout != ""
+	changed := newStdout || len(res.FailedChecks()) > 0
+	if !changed && s.outputDir == "" {
+		res.Status = StatusUnchanged
+		return res
+	}
+
+	e := &Expectations{
+		Stdout:   res.Output.Stdout,
+		Stderr:   res.Output.Stderr,
+		ExitCode: res.Output.ExitCode,
+		Files:    map[string]string{},
+	}
+	for file := range p.ExpectedFiles {
+		b, err := os.ReadFile(res.resolve(file))
+		if err != nil {
+			res.Status = StatusError
+			res.Err = errors.Wrapf(err, "could not read expected file %s", file)
+			return res
+		}
+		e.Files[file] = rp.Normalizers().Apply(string(b))
+	}
+	if rp.Spec().CapturesFileChanges() {
+		e.FileChanges = res.FileChanges
+	}
+
+	if s.outputDir != "" {
+		res.OutputPath = s.outputPath(rp)
+		if rp.IsOnDisk() {
+			err = CopyUpdatedProgramFile(rp.Path(), res.OutputPath, e)
+		} else {
+			err = writeUpdatedProgramFile(rp, res.OutputPath, e)
+		}
+		if err != nil {
+			res.Status = StatusError
+			res.Err = err
+			return res
+		}
+		res.Status = StatusUnchanged
+		if changed {
+			res.Status = StatusUpdated
+		}
+		return res
+	}
+
+	if !rp.IsOnDisk() {
+		res.Status = StatusError
+		res.Err = errors.Errorf("program file %s is not on disk and can't be updated", rp.Path())
+		return res
+	}
+	err = UpdateProgramFile(rp.Path(), e)
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return res
+	}
+	p.ExpectedStdout = e.Stdout
+	p.ExpectedStatusCode = e.ExitCode
+	if p.ExpectedError != "" || e.Stderr != "" {
+		p.ExpectedError = e.Stderr
+	}
+	for file, content := range e.Files {
+		p.ExpectedFiles[file] = content
+	}
+	if e.FileChanges != nil {
+		rp.Spec().ExpectedFileChanges = e.FileChanges
+	}
+	res.Status = StatusUpdated
+
+	return res
+}
+
+// run runs the program, in a temporary working directory if it declares fixtures.
+// The returned cleanup function removes the working directory, and has to be called
+// once the outputs and files have been checked.
+func (r *Result) run(ctx context.Context, rp *pkg.RepositoryProgram, s *settings) (func(), error) {
+	cleanup := func() {}
+
+	p, workdir, err := rp.PrepareRun(s.keepWorkdir)
+	if err != nil {
+		return cleanup, err
+	}
+
+	if s.pathOverride != nil {
+		path := p.Path
+		if path == "" {
+			path = p.Name
+		}
+		p.Path = s.pathOverride(path)
+	}
+
+	options := append([]runner.Option{}, s.runnerOptions...)
+	if workdir != nil {
+		r.workdir = workdir
+		cleanup = func() {
+			err := workdir.Close()
+			if err != nil {
+				log.Warn().Err(err).Str("path", workdir.Path).Msg("could not remove working directory")
+			}
+		}
+		options = append(options, runner.WithDir(workdir.Path))
+	}
+	if rp.Spec().Timeout > 0 {
+		options = append(options, runner.WithTimeout(rp.Spec().Timeout))
+	}
+
+	var before *fschange.Snapshot
+	if rp.Spec().CapturesFileChanges() {
+		before, err = fschange.TakeSnapshot(r.resolve("."), rp.Spec().IgnoreFileChanges)
+		if err != nil {
+			return cleanup, err
+		}
+	}
+
+	output, err := runner.NewRunner(options...).Run(ctx, p)
+	if output != nil {
+		r.Output = output
+		r.Duration = output.Duration
+	}
+	if err != nil {
+		return cleanup, err
+	}
+	normalizers := rp.Normalizers()
+	output.Stdout = normalizers.Apply(output.Stdout)
+	output.Stderr = normalizers.Apply(output.Stderr)
+
+	if before != nil {
+		after, err := fschange.TakeSnapshot(r.resolve("."), rp.Spec().IgnoreFileChanges)
+		if err != nil {
+			return cleanup, err
+		}
+		r.FileChanges, err = fschange.Diff(before, after)
+		if err != nil {
+			return cleanup, err
+		}
+		for _, c := range r.FileChanges {
+			c.Content = normalizers.Apply(c.Content)
+		}
+	}
+
+	return cleanup, nil
+}
+
+// resolve returns the path of a file written by the program, which is relative to
+// the working directory of the run.
+func (r *Result) resolve(file string) string {
+	if r.workdir == nil {
+		return file
+	}
+	return r.workdir.Resolve(file)
+}
+
+// check compares the output to the expectations of the program. Expected values
+// are normalized as well, so that hand-written expectations can be compared too.
+func (r *Result) check(rp *pkg.RepositoryProgram) error {
+	p := rp.Program()
+	output := r.Output
+	normalizers := rp.Normalizers()
+
+	exitCode := &Check{Name: "exit-code", Status: StatusPass}
+	if output.ExitCode != p.ExpectedStatusCode {
+		exitCode.Status = StatusFail
+		exitCode.Diff = fmt.Sprintf("expected %d, got %d", p.ExpectedStatusCode, output.ExitCode)
+	}
+	r.Checks = append(r.Checks, exitCode)
+
+	if p.ExpectedStdout != "" {
+		c, err := newStdoutCheck(rp.CompareOptions(), normalizers.Apply(p.ExpectedStdout), output.Stdout)
+		if err != nil {
+			return err
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	if p.ExpectedError != "" {
+		c, err := newDiffCheck("stderr", normalizers.Apply(p.ExpectedError), output.Stderr)
+		if err != nil {
+			return err
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	if pattern := rp.Spec().ExpectedStderrPattern; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid expectedStderrPattern %s", pattern)
+		}
+		c := &Check{Name: "stderr-pattern", Status: StatusPass}
+		if !re.MatchString(output.Stderr) {
+			c.Status = StatusFail
+			c.Diff = fmt.Sprintf("stderr does not match %s", pattern)
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	files := make([]string, 0, len(p.ExpectedFiles))
+	for file := range p.ExpectedFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		name := "file:" + file
+		b, err := os.ReadFile(r.resolve(file))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return errors.Wrapf(err, "could not read expected file %s", file)
+			}
+			r.Checks = append(r.Checks, &Check{
+				Name:   name,
+				Status: StatusFail,
+				Diff:   "file was not created",
+			})
+			continue
+		}
+		c, err := newDiffCheck(name,
+			normalizers.Apply(p.ExpectedFiles[file]),
+			normalizers.Apply(string(b)))
+		if err != nil {
+			return err
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	if rp.Spec().CapturesFileChanges() {
+		checks, err := newFileChangeChecks(rp.Spec().ExpectedFileChanges, r.FileChanges, normalizers.Apply)
+		if err != nil {
+			return err
+		}
+		r.Checks = append(r.Checks, checks...)
+	}
+
+	return nil
+}
+
+// newFileChangeChecks returns a change:<path> check for each expected change, and
+// a file-changes check listing the changes that were not expected.
+func newFileChangeChecks(
+	expected []*fschange.Change,
+	actual []*fschange.Change,
+	normalize func(string) string,
+) ([]*Check, error) {
+	ret := []*Check{}
+
+	actualByPath := map[string]*fschange.Change{}
+	for _, c := range actual {
+		actualByPath[c.Path] = c
+	}
+	expectedPaths := map[string]bool{}
+
+	for _, e := range expected {
+		expectedPaths[e.Path] = true
+		c := &Check{Name: "change:" + e.Path, Status: StatusFail}
+		ret = append(ret, c)
+
+		a, ok := actualByPath[e.Path]
+		switch {
+		case !ok:
+			c.Diff = fmt.Sprintf("expected file to be %s, but it was not changed", e.Type)
+		case a.Type != e.Type:
+			c.Diff = fmt.Sprintf("expected file to be %s, but it was %s", e.Type, a.Type)
+		case e.Content != "":
+			diff, err := Diff(normalize(e.Content), a.Content)
+			if err != nil {
+				return nil, err
+			}
+			c.Diff = diff
+		case e.SHA256 != "" && e.SHA256 != a.Hash():
+			c.Diff = fmt.Sprintf("expected sha256 %s, got %s", e.SHA256, a.Hash())
+		}
+		if c.Diff == "" {
+			c.Status = StatusPass
+		}
+	}
+
+	unexpected := []string{}
+	for _, a := range actual {
+		if !expectedPaths[a.Path] {
+			unexpected = append(unexpected, fmt.Sprintf("unexpected %s file %s", a.Type, a.Path))
+		}
+	}
+	c := &Check{Name: "file-changes", Status: StatusPass}
+	if len(unexpected) > 0 {
+		c.Status = StatusFail
+		c.Diff = strings.Join(unexpected, "\n") + "\n"
+	}
+	ret = append(ret, c)
+
+	return ret, nil
+}
+
+// newStdoutCheck compares stdout as data if the output is structured. If either side
+// can't be parsed in the expected format, it falls back to a textual diff.
+func newStdoutCheck(options *compare.Options, expected string, actual string) (*Check, error) {
+	if options.Format == compare.FormatText {
+		return newDiffCheck("stdout", expected, actual)
+	}
+
+	differences, err := compare.Compare(expected, actual, options)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not compare outputs as data, falling back to text")
+		return newDiffCheck("stdout", expected, actual)
+	}
+
+	c := &Check{Name: "stdout", Status: StatusPass}
+	if len(differences) > 0 {
+		c.Status = StatusFail
+		lines := make([]string, 0, len(differences))
+		for _, d := range differences {
+			lines = append(lines, d.String())
+		}
+		c.Diff = strings.Join(lines, "\n") + "\n"
+	}
+	return c, nil
+}
+
+func newDiffCheck(name string, expected string, actual string) (*Check, error) {
+	diff, err := Diff(expected, actual)
+	if err != nil {
+		return nil, err
+	}
+	c := &Check{Name: name, Status: StatusPass, Diff: diff}
+	if diff != "" {
+		c.Status = StatusFail
+	}
+	return c, nil
+}
+
+// Diff returns a unified diff between expected and actual, or an empty string
+// if they are equal.
+func Diff(expected string, actual string) (string, error) {
+	if expected == actual {
+		return "", nil
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(expected),
+		B:        difflib.SplitLines(actual),
+		FromFile: "expected",
+		ToFile:   "actual",
+		Context:  3,
+	})
+}
+
+// ProgramFunc is the signature of RunProgram and UpdateProgram.
+type ProgramFunc func(ctx context.Context, rp *pkg.RepositoryProgram, options ...Option) *Result
+
+// RunAll runs f for each program on the pool, honoring the exclusivity group of
+// the programs. The results are returned in the order of rps.
+func RunAll(
+	ctx context.Context,
+	pool *runner.Pool,
+	rps []*pkg.RepositoryProgram,
+	f ProgramFunc,
+	options ...Option,
+) ([]*Result, error) {
+	results := make([]*Result, len(rps))
+	tasks := make([]*runner.Task, len(rps))
+	for i, rp := range rps {
+		i, rp := i, rp
+		tasks[i] = &runner.Task{
+			Group: rp.Spec().Exclusive,
+			Run: func(ctx context.Context) error {
+				results[i] = f(ctx, rp, options...)
+				return nil
+			},
+		}
+	}
+
+	err := pool.Run(ctx, tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,323 @@
+package golden
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func loadTestProgram(t *testing.T, s string) *pkg.RepositoryProgram {
+	rp, err := pkg.NewRepositoryProgramFromYAML(strings.NewReader(s), "test.yaml")
+	require.NoError(t, err)
+	return rp
+}
+
+func TestDiff(t *testing.T) {
+	d, err := Diff("foo\nbar\n", "foo\nbar\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", d)
+
+	d, err = Diff("foo\nbar\n", "foo\nbaz\nblop\n")
+	require.NoError(t, err)
+	c := &Check{Diff: d}
+	assert.Equal(t, "+2 -1 lines", c.DiffSummary())
+}
+
+func TestRunProgram(t *testing.T) {
+	rp := loadTestProgram(t, `
+name: echo
+path: echo
+rawFlags: [hello]
+expectedStdout: "hello\n"
+`)
+	res := RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusPass, res.Status)
+
+	rp.Program().ExpectedStdout = "goodbye\n"
+	res = RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusFail, res.Status)
+	require.Len(t, res.FailedChecks(), 1)
+	assert.Equal(t, "stdout", res.FailedChecks()[0].Name)
+	assert.Equal(t, "+1 -1 lines", res.FailedChecks()[0].DiffSummary())
+
+	rp.Program().ExpectedStdout = ""
+	res = RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusSkip, res.Status)
+}
+
+func TestRunFailingProgram(t *testing.T) {
+	rp := loadTestProgram(t, `
+name: sh
+path: sh
+rawFlags: [-c, "echo oops >&2; exit 3"]
+expectedStatusCode: 3
+expectedStderrPattern: "^oo"
+`)
+	res := RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusPass, res.Status)
+	assert.Len(t, res.Checks, 2)
+
+	rp.Program().ExpectedStatusCode = 0
+	rp.Program().ExpectedError = "oops\n"
+	res = RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusFail, res.Status)
+	require.Len(t, res.FailedChecks(), 1)
+	assert.Equal(t, "exit-code", res.FailedChecks()[0].Name)
+	assert.Equal(t, "expected 0, got 3", res.FailedChecks()[0].DiffSummary())
+}
+
+func TestRunProgramNormalized(t *testing.T) {
+	rp := loadTestProgram(t, `
+name: echo
+path: echo
+rawFlags: [run at 2023-03-17T10:00:00Z took 12ms]
+normalize:
+  - mask-iso-dates
+  - replace: '\d+ms'
+    with: '<duration>'
+expectedStdout: "run at 2024-01-01 took 3ms\n"
+`)
+	res := RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusPass, res.Status)
+	assert.Equal(t, "run at <date> took <duration>\n", res.Output.Stdout)
+}
+
+func TestRunProgramStructured(t *testing.T) {
+	rp := loadTestProgram(t, `
+name: echo
+path: echo
+rawFlags: ['{"b": 1.50, "a": "x", "ts": 2}', --output, json]
+compare:
+  ignoreFields: [ts]
+expectedStdout: '{"a": "x", "b": 1.5, "ts": 1}'
+`)
+	res := RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusPass, res.Status)
+
+	rp.Program().ExpectedStdout = `{"a": "y", "b": 1.5}`
+	res = RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusFail, res.Status)
+	require.Len(t, res.FailedChecks(), 1)
+	assert.Equal(t, `a: "y" != "x"`, res.FailedChecks()[0].DiffSummary())
+}
+
+func TestRunProgramWithFixtures(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(base, "input.txt"), []byte("hello\n"), 0644))
+
+	rp, err := pkg.NewRepositoryProgramFromYAML(strings.NewReader(`
+name: sh
+path: sh
+rawFlags: [-c, "cat input.txt; echo done > out.txt"]
+fixtures: [input.txt]
+expectedStdout: "hello\n"
+expectedFiles:
+  out.txt: "done\n"
+`), filepath.Join(base, "test.yaml"))
+	require.NoError(t, err)
+
+	res := RunProgram(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusPass, res.Status)
+
+	_, err = os.Stat(filepath.Join(base, "out.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunProgramFileChanges(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(base, "input.txt"), []byte("hello\n"), 0644))
+
+	rp, err := pkg.NewRepositoryProgramFromYAML(strings.NewReader(`
+name: sh
+path: sh
+rawFlags: [-c, "rm input.txt; echo done > out.txt; echo x > debug.log"]
+fixtures: [input.txt]
+ignoreFileChanges: ["*.log"]
+expectedFileChanges:
+  - path: input.txt
+    change: deleted
+  - path: out.txt
+    change: created
+    content: "done\n"
+`), filepath.Join(base, "test.yaml"))
+	require.NoError(t, err)
+
+	res := RunProgram(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusPass, res.Status)
+	assert.Len(t, res.Checks, 4)
+
+	rp.Spec().ExpectedFileChanges = rp.Spec().ExpectedFileChanges[1:]
+	res = RunProgram(context.Background(), rp)
+	assert.Equal(t, StatusFail, res.Status)
+	require.Len(t, res.FailedChecks(), 1)
+	assert.Equal(t, "file-changes", res.FailedChecks()[0].Name)
+	assert.Equal(t, "unexpected deleted file input.txt", res.FailedChecks()[0].DiffSummary())
+}
+
+func TestRunProgramFileChangesIsHermetic(t *testing.T) {
+	rp := loadTestProgram(t, `
+name: sh
+path: sh
+rawFlags: [-c, "ls; echo done > out.txt"]
+captureFileChanges: true
+expectedStdout: ""
+expectedFileChanges:
+  - path: out.txt
+    change: created
+    content: "done\n"
+`)
+
+	res := RunProgram(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusPass, res.Status)
+	assert.Equal(t, "", res.Output.Stdout)
+
+	_, err := os.Stat("out.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUpdateProgramOutputDir(t *testing.T) {
+	base := t.TempDir()
+	path := filepath.Join(base, "echo.yaml")
+	s := "name: echo\npath: echo\nrawFlags: [hello]\nexpectedStdout: \"hello\\n\"\n"
+	require.NoError(t, os.WriteFile(path, []byte(s), 0644))
+	rp, err := pkg.NewRepositoryProgramFromYAML(strings.NewReader(s), path)
+	require.NoError(t, err)
+
+	out := t.TempDir()
+	res := UpdateProgram(context.Background(), rp,
+		WithOutputDir(out),
+		WithPathOverride(func(path string) string {
+			assert.Equal(t, "echo", path)
+			return "printf"
+		}),
+	)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusUpdated, res.Status)
+	assert.Equal(t, filepath.Join(out, path), res.OutputPath)
+
+	b, err := os.ReadFile(res.OutputPath)
+	require.NoError(t, err)
+	assert.Equal(t, "name: echo\npath: echo\nrawFlags: [hello]\nexpectedStdout: hello\n", string(b))
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, s, string(b))
+	assert.Equal(t, "hello\n", rp.Program().ExpectedStdout)
+
+	res = UpdateProgram(context.Background(), rp, WithOutputDir(out))
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusUnchanged, res.Status)
+}
+
+func TestCheckOutputPaths(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	for _, dir := range []string{first, second} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "echo.yaml"), []byte("name: echo\n"), 0644))
+	}
+	r := pkg.NewRepository([]string{first, second})
+	require.NoError(t, r.Load())
+	rps := r.GetOrderedRepositoryPrograms()
+	require.Len(t, rps, 2)
+
+	out := t.TempDir()
+	err := CheckOutputPaths(rps, WithOutputDir(out))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "would both be written to "+filepath.Join(out, "echo.yaml"))
+
+	assert.NoError(t, CheckOutputPaths(rps, WithOutputDir(out), WithOutputDirPerRepository(true)))
+	assert.NoError(t, CheckOutputPaths(rps))
+
+	res := UpdateProgram(context.Background(), rps[1], WithOutputDir(out), WithOutputDirPerRepository(true))
+	require.NoError(t, res.Err)
+	assert.Equal(t, filepath.Join(out, filepath.Base(second), "echo.yaml"), res.OutputPath)
+}
+
+func TestDifferential(t *testing.T) {
+	rp := loadTestProgram(t, `
+name: echo
+path: echo
+rawFlags: ['{"a": 1, "b": 2}']
+compare:
+  format: json
+`)
+	res := NewDifferentialFunc("echo", "echo", "echo")(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusPass, res.Status)
+
+	// the output is compared as data, so the missing newline doesn't matter
+	res = NewDifferentialFunc("echo", "echo", "printf")(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusPass, res.Status)
+
+	candidate := filepath.Join(t.TempDir(), "candidate")
+	require.NoError(t, os.WriteFile(candidate, []byte("#!/bin/sh\necho '{\"a\": 1, \"b\": 3}'\n"), 0755))
+	res = NewDifferentialFunc("echo", "echo", candidate)(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusFail, res.Status)
+	require.Len(t, res.FailedChecks(), 1)
+	assert.Equal(t, "stdout", res.FailedChecks()[0].Name)
+	assert.Equal(t, "b: 2 != 3", res.FailedChecks()[0].DiffSummary())
+
+	res = NewDifferentialFunc("echo", "echo", "/does/not/exist")(context.Background(), rp)
+	assert.Equal(t, StatusError, res.Status)
+
+	// programs running another executable are left alone
+	res = NewDifferentialFunc("glaze", "echo", "/does/not/exist")(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusSkip, res.Status)
+	assert.Empty(t, res.Checks)
+
+	rp.Program().Path = "/bin/echo"
+	res = NewDifferentialFunc("echo", "echo", "/does/not/exist")(context.Background(), rp)
+	assert.Equal(t, StatusError, res.Status)
+	res = NewDifferentialFunc("/bin/echo", "echo", "/does/not/exist")(context.Background(), rp)
+	assert.Equal(t, StatusError, res.Status)
+}
+
+func TestRunProgramFromFSSource(t *testing.T) {
+	f := fstest.MapFS{
+		".cliopatra.yaml": {Data: []byte("namespace: builtin\n")},
+		"tools/cat.yaml": {Data: []byte(`
+name: cat
+path: cat
+fixtures: [data/input.txt]
+args:
+  - name: file
+    type: string
+    value: data/input.txt
+expectedStdout: "hello\n"
+`)},
+		"tools/data/input.txt": {Data: []byte("hello\n"), Mode: 0644},
+	}
+	r := pkg.NewRepositoryFromSources([]*pkg.Source{pkg.NewFSSource("embedded", f)})
+	require.NoError(t, r.Load())
+
+	rp, err := r.Lookup("builtin/tools/cat")
+	require.NoError(t, err)
+	assert.False(t, rp.IsOnDisk())
+	assert.Equal(t, "embedded/tools/cat.yaml", rp.Path())
+
+	res := RunProgram(context.Background(), rp)
+	require.NoError(t, res.Err)
+	assert.Equal(t, StatusPass, res.Status)
+
+	out := t.TempDir()
+	res = UpdateProgram(context.Background(), rp, WithOutputDir(out))
+	require.NoError(t, res.Err)
+	_, err = os.Stat(filepath.Join(out, "tools", "cat.yaml"))
+	assert.NoError(t, err)
+
+	// in-place updates need the program file to be on disk
+	rp.Program().ExpectedStdout = "goodbye\n"
+	res = UpdateProgram(context.Background(), rp)
+	assert.Equal(t, StatusError, res.Status)
+}
@@ -0,0 +1,77 @@
+package golden
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"path/filepath"
+)
+
+type settings struct {
+	runnerOptions []runner.Option
+	keepWorkdir   bool
+	pathOverride  func(path string) string
+	outputDir     string
+	// outputDirPerRepository prefixes the paths in outputDir with the namespaces
+	outputDirPerRepository bool
+}
+
+type Option func(s *settings)
+
+// WithRunnerOptions passes options to the runner. The timeout declared by a program
+// overrides the one passed here.
+func WithRunnerOptions(options ...runner.Option) Option {
+	return func(s *settings) {
+		s.runnerOptions = append(s.runnerOptions, options...)
+	}
+}
+
+// WithKeepWorkdir keeps the temporary working directories of hermetic programs around
+// after the run, for debugging.
+func WithKeepWorkdir(keepWorkdir bool) Option {
+	return func(s *settings) {
+		s.keepWorkdir = keepWorkdir
+	}
+}
+
+// WithPathOverride replaces the executable of the programs, for example to run them
+// against a new build of a tool. f is passed the path of the program, or its name
+// if it doesn't declare a path, and returns the executable to run.
+func WithPathOverride(f func(path string) string) Option {
+	return func(s *settings) {
+		s.pathOverride = f
+	}
+}
+
+// WithOutputDir makes UpdateProgram write the updated program files to a directory
+// tree parallel to the repository instead of rewriting them in place. Files are
+// written even if the outputs didn't change, so that the tree is complete.
+func WithOutputDir(dir string) Option {
+	return func(s *settings) {
+		s.outputDir = dir
+	}
+}
+
+// WithOutputDirPerRepository makes WithOutputDir write the program files of each
+// repository to a subdirectory named after the namespace of the repository, so that
+// programs of several repositories at the same relative path don't overwrite each other.
+func WithOutputDirPerRepository(perRepository bool) Option {
+	return func(s *settings) {
+		s.outputDirPerRepository = perRepository
+	}
+}
+
+// outputPath returns the path of the program file of rp in the output directory.
+func (s *settings) outputPath(rp *pkg.RepositoryProgram) string {
+	if s.outputDirPerRepository && rp.Namespace() != "" {
+		return filepath.Join(s.outputDir, rp.Namespace(), rp.RelativePath())
+	}
+	return filepath.Join(s.outputDir, rp.RelativePath())
+}
+
+func newSettings(options ...Option) *settings {
+	s := &settings{}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
@@ -0,0 +1,154 @@
+package golden
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/fschange"
+	"github.com/go-go-golems/cliopatra/pkg/yamlnode"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Expectations are the fields of a program file that get rewritten when updating
+// the golden outputs of a program.
+type Expectations struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Files maps the path of an expected file to its content
+	Files map[string]string
+	// FileChanges are the captured file changes. nil leaves them untouched.
+	FileChanges []*fschange.Change
+}
+
+// UpdateProgramFile rewrites the expectation fields of the program file at path.
+//
+// The file is edited at the yaml.Node level, so that key order, comments and
+// fields unknown to cliopatra.Program (for example the `log` provenance blocks)
+// are left untouched. Existing expectation keys are updated in place, missing
+// ones are appended at the end of the program.
+func UpdateProgramFile(path string, e *Expectations) error {
+	return CopyUpdatedProgramFile(path, path, e)
+}
+
+// CopyUpdatedProgramFile is UpdateProgramFile writing the updated program to dst,
+// creating its directory if necessary, instead of rewriting src.
+func CopyUpdatedProgramFile(src string, dst string, e *Expectations) error {
+	s, err := os.ReadFile(src)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", src)
+	}
+
+	b, err := UpdateProgramYAML(s, e)
+	if err != nil {
+		return errors.Wrapf(err, "could not update %s", src)
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "could not create directory for %s", dst)
+	}
+
+	return os.WriteFile(dst, b, fi.Mode())
+}
+
+// writeUpdatedProgramFile is CopyUpdatedProgramFile for programs whose file isn't on
+// disk, such as programs embedded into a tool.
+func writeUpdatedProgramFile(rp *pkg.RepositoryProgram, dst string, e *Expectations) error {
+	s, err := rp.ReadProgramFile()
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", rp.Path())
+	}
+
+	b, err := UpdateProgramYAML(s, e)
+	if err != nil {
+		return errors.Wrapf(err, "could not update %s", rp.Path())
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "could not create directory for %s", dst)
+	}
+
+	return os.WriteFile(dst, b, 0644)
+}
+
+// UpdateProgramYAML is the in-memory version of UpdateProgramFile.
+func UpdateProgramYAML(s []byte, e *Expectations) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(s, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("program file is not a YAML mapping")
+	}
+	root := doc.Content[0]
+
+	// only record empty outputs and the exit code when they are relevant, to keep program files small
+	if e.Stdout != "" || yamlnode.Get(root, "expectedStdout") != nil {
+		yamlnode.Set(root, "expectedStdout", yamlnode.NewString(e.Stdout))
+	}
+	if e.Stderr != "" || yamlnode.Get(root, "expectedError") != nil {
+		yamlnode.Set(root, "expectedError", yamlnode.NewString(e.Stderr))
+	}
+	if e.ExitCode != 0 || yamlnode.Get(root, "expectedStatusCode") != nil {
+		yamlnode.Set(root, "expectedStatusCode", &yaml.Node{
+			Kind:  yaml.ScalarNode,
+			Tag:   "!!int",
+			Value: strconv.Itoa(e.ExitCode),
+		})
+	}
+	if len(e.Files) > 0 {
+		files := yamlnode.Get(root, "expectedFiles")
+		if files == nil || files.Kind != yaml.MappingNode {
+			files = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			yamlnode.Set(root, "expectedFiles", files)
+		}
+		names := make([]string, 0, len(e.Files))
+		for name := range e.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			yamlnode.Set(files, name, yamlnode.NewString(e.Files[name]))
+		}
+	}
+
+	if e.FileChanges != nil {
+		if len(e.FileChanges) == 0 {
+			yamlnode.Delete(root, "expectedFileChanges")
+		} else {
+			yamlnode.Set(root, "expectedFileChanges", newFileChangesNode(e.FileChanges))
+		}
+	}
+
+	return yamlnode.Encode(&doc, s)
+}
+
+// newFileChangesNode returns the sequence of file changes, with the file contents
+// as literal blocks.
+func newFileChangesNode(changes []*fschange.Change) *yaml.Node {
+	ret := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, c := range changes {
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		yamlnode.Set(n, "path", yamlnode.NewString(c.Path))
+		yamlnode.Set(n, "change", yamlnode.NewString(string(c.Type)))
+		if c.Content != "" {
+			yamlnode.Set(n, "content", yamlnode.NewString(c.Content))
+		}
+		if c.SHA256 != "" {
+			yamlnode.Set(n, "sha256", yamlnode.NewString(c.SHA256))
+		}
+		ret.Content = append(ret.Content, n)
+	}
+	return ret
+}
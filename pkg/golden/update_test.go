@@ -0,0 +1,72 @@
+package golden
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg/fschange"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const testProgram = `# a comment that should be kept
+name: ttc-orders
+path: sqleton
+verbs:
+    - ttc
+    - orders
+flags:
+    - name: dbt-profile
+      short: dbt profile to use
+      type: string
+      value: localhost.ttc
+      log:
+        - source: defaults
+          value: ""
+          metadata: {}
+`
+
+func TestUpdateProgramYAMLAppends(t *testing.T) {
+	b, err := UpdateProgramYAML([]byte(testProgram), &Expectations{Stdout: "foo\nbar\n"})
+	require.NoError(t, err)
+	assert.Equal(t, testProgram+"expectedStdout: |\n    foo\n    bar\n", string(b))
+}
+
+func TestUpdateProgramYAMLReplaces(t *testing.T) {
+	s := "name: foo # the name\nexpectedStdout: old\ndescription: blop\n"
+	b, err := UpdateProgramYAML([]byte(s), &Expectations{Stdout: "new"})
+	require.NoError(t, err)
+	assert.Equal(t, "name: foo # the name\nexpectedStdout: new\ndescription: blop\n", string(b))
+}
+
+func TestUpdateProgramYAMLStderrAndFiles(t *testing.T) {
+	s := "name: foo\nexpectedFiles:\n  out.txt: old\n"
+	b, err := UpdateProgramYAML([]byte(s), &Expectations{
+		Stdout:   "",
+		Stderr:   "oops\n",
+		ExitCode: 2,
+		Files:    map[string]string{"out.txt": "new"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t,
+		"name: foo\nexpectedFiles:\n  out.txt: new\nexpectedError: |\n  oops\nexpectedStatusCode: 2\n",
+		string(b))
+}
+
+func TestUpdateProgramYAMLFileChanges(t *testing.T) {
+	s := "name: foo\ncaptureFileChanges: true\n"
+	b, err := UpdateProgramYAML([]byte(s), &Expectations{
+		FileChanges: []*fschange.Change{
+			{Path: "out.txt", Type: fschange.ChangeCreated, Content: "a\nb\n"},
+			{Path: "old.txt", Type: fschange.ChangeDeleted},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t,
+		"name: foo\ncaptureFileChanges: true\nexpectedFileChanges:\n"+
+			"  - path: out.txt\n    change: created\n    content: |\n      a\n      b\n"+
+			"  - path: old.txt\n    change: deleted\n",
+		string(b))
+
+	b, err = UpdateProgramYAML(b, &Expectations{FileChanges: []*fschange.Change{}})
+	require.NoError(t, err)
+	assert.Equal(t, s, string(b))
+}
@@ -0,0 +1,14 @@
+// Package maps contains helpers for maps that are used across packages.
+package maps
+
+import "sort"
+
+// SortedKeys returns the keys of m in lexical order, to iterate over m deterministically.
+func SortedKeys[V any](m map[string]V) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,574 @@
+// Package lint checks the programs of repositories for problems that otherwise only
+// surface when running them, such as binaries missing from $PATH or flag values that
+// don't match their type, and fixes the mechanical ones in place.
+package lint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/schema"
+	"github.com/go-go-golems/cliopatra/pkg/yamlnode"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check is the name of a lint check.
+type Check string
+
+const (
+	// CheckLoad reports program files that can't be loaded, for example because they
+	// are not valid YAML.
+	CheckLoad Check = "load"
+	// CheckDuplicateName reports programs that can't be addressed by their name because
+	// other programs have the same name.
+	CheckDuplicateName Check = "duplicate-name"
+	// CheckMissingBinary reports programs whose path can't be found in $PATH.
+	CheckMissingBinary Check = "missing-binary"
+	// CheckMissingVerb reports verbs that the program doesn't know, according to the
+	// output of `<path> <verbs> --help`.
+	CheckMissingVerb Check = "missing-verb"
+	// CheckValueType reports flag and argument values that don't match their type.
+	CheckValueType Check = "value-type"
+	// CheckMissingFixture reports fixtures that don't exist.
+	CheckMissingFixture Check = "missing-fixture"
+	// CheckParameterLog reports the `log` provenance blocks left in program files by
+	// recording commands.
+	CheckParameterLog Check = "parameter-log"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Issue is a problem found in a program file.
+type Issue struct {
+	Check    Check
+	Severity Severity
+	Path     string
+	// Line is the line of the program file the issue is on, 0 if it is not known.
+	Line int
+	// Program is the qualified name of the program, empty if it couldn't be loaded.
+	Program string
+	Message string
+	// Fixable is true if the issue can be fixed with WithFix.
+	Fixable bool
+	Fixed   bool
+}
+
+type Linter struct {
+	fix          bool
+	probeVerbs   bool
+	probeTimeout time.Duration
+	lookPath     func(file string) (string, error)
+	// probes are the results of probing verbs, by command line
+	probes map[string]error
+}
+
+type Option func(l *Linter)
+
+// WithFix rewrites the program files to fix the fixable issues.
+func WithFix(fix bool) Option {
+	return func(l *Linter) {
+		l.fix = fix
+	}
+}
+
+// WithProbeVerbs runs `<path> <verbs> --help` to check that the verbs of the programs
+// exist. It is enabled by default.
+func WithProbeVerbs(probeVerbs bool) Option {
+	return func(l *Linter) {
+		l.probeVerbs = probeVerbs
+	}
+}
+
+// WithProbeTimeout sets the timeout of each verb probe, 5 seconds by default.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(l *Linter) {
+		l.probeTimeout = timeout
+	}
+}
+
+// WithLookPath replaces exec.LookPath to resolve the binaries of the programs.
+func WithLookPath(lookPath func(file string) (string, error)) Option {
+	return func(l *Linter) {
+		l.lookPath = lookPath
+	}
+}
+
+func NewLinter(options ...Option) *Linter {
+	ret := &Linter{
+		probeVerbs:   true,
+		probeTimeout: 5 * time.Second,
+		lookPath:     exec.LookPath,
+		probes:       map[string]error{},
+	}
+	for _, option := range options {
+		option(ret)
+	}
+	return ret
+}
+
+// Lint loads the programs of directories, and returns their issues ordered by path
+// and line. Program files that can't be loaded or run, see RepositoryProgram.Err,
+// are reported as issues instead of failing.
+func (l *Linter) Lint(ctx context.Context, directories []string, options ...pkg.RepositoryOption) ([]*Issue, error) {
+	ret := []*Issue{}
+
+	type loadError struct {
+		path string
+		err  error
+	}
+	loadErrors := []loadError{}
+	options = append(options, pkg.WithLoadErrorHandler(func(path string, err error) {
+		loadErrors = append(loadErrors, loadError{path, err})
+	}))
+	r := pkg.NewRepository(directories, options...)
+	err := r.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range loadErrors {
+		issues, err := l.lintInvalidProgram(e.path, e.err)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, issues...)
+	}
+
+	rps := r.GetOrderedRepositoryPrograms()
+	for _, s := range r.GetShadows() {
+		switch s.Kind {
+		case pkg.ShadowQualifiedName:
+			rps = append(rps, s.Shadowed)
+			ret = append(ret, &Issue{
+				Check:    CheckDuplicateName,
+				Severity: SeverityError,
+				Path:     s.Shadowed.Path(),
+				Line:     nameLine(s.Shadowed),
+				Program:  s.Name,
+				Message:  fmt.Sprintf("%s is also the qualified name of %s, this program can't be run", s.Name, s.Program.Path()),
+			})
+		case pkg.ShadowAmbiguous:
+			ret = append(ret, &Issue{
+				Check:    CheckDuplicateName,
+				Severity: SeverityWarning,
+				Path:     s.Shadowed.Path(),
+				Line:     nameLine(s.Shadowed),
+				Program:  s.Shadowed.QualifiedName(),
+				Message:  fmt.Sprintf("%s is the name of several programs of the repository, use %s", s.Name, s.Shadowed.QualifiedName()),
+			})
+		case pkg.ShadowShortName:
+			// programs of repositories with a higher precedence override others on purpose
+		}
+	}
+
+	for _, rp := range rps {
+		if rp.Err() != nil {
+			issues, err := l.lintInvalidProgram(rp.Path(), rp.Err())
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, issues...)
+			continue
+		}
+		issues, err := l.lintProgram(ctx, rp)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, issues...)
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Path != ret[j].Path {
+			return ret[i].Path < ret[j].Path
+		}
+		return ret[i].Line < ret[j].Line
+	})
+
+	return ret, nil
+}
+
+// programFile is the YAML document of a program file, along with its issues.
+type programFile struct {
+	path    string
+	program string
+	s       []byte
+	doc     yaml.Node
+	root    *yaml.Node
+	issues  []*Issue
+	// changed is true once fixes were applied to doc
+	changed bool
+}
+
+func newProgramFile(path string, s []byte) (*programFile, error) {
+	ret := &programFile{path: path, s: s}
+	err := yaml.Unmarshal(s, &ret.doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", path)
+	}
+	if ret.doc.Kind != yaml.DocumentNode || len(ret.doc.Content) != 1 || ret.doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.Errorf("program file %s is not a YAML mapping", path)
+	}
+	ret.root = ret.doc.Content[0]
+	return ret, nil
+}
+
+func (f *programFile) addIssue(check Check, severity Severity, line int, message string) *Issue {
+	issue := &Issue{
+		Check:    check,
+		Severity: severity,
+		Path:     f.path,
+		Line:     line,
+		Program:  f.program,
+		Message:  message,
+	}
+	f.issues = append(f.issues, issue)
+	return issue
+}
+
+// parameters returns the mapping nodes of the flags and arguments.
+func (f *programFile) parameters() []*yaml.Node {
+	ret := []*yaml.Node{}
+	for _, key := range []string{"flags", "args"} {
+		seq := yamlnode.Get(f.root, key)
+		if seq == nil || seq.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, n := range seq.Content {
+			if n.Kind == yaml.MappingNode {
+				ret = append(ret, n)
+			}
+		}
+	}
+	return ret
+}
+
+// parameterPathRegexp matches the schema path of the value of a flag or argument
+var parameterPathRegexp = regexp.MustCompile(`^(flags|args)\[(\d+)\]\.value(\[\d+\])?$`)
+
+// lintInvalidProgram reports why the program file at path couldn't be loaded. Values
+// that don't match their type are reported as CheckValueType issues, which can be
+// fixed even though the program can't be loaded.
+func (l *Linter) lintInvalidProgram(path string, err error) ([]*Issue, error) {
+	var validationError *schema.ValidationError
+	if !errors.As(err, &validationError) {
+		return []*Issue{{
+			Check:    CheckLoad,
+			Severity: SeverityError,
+			Path:     path,
+			Line:     errorLine(err),
+			Message:  err.Error(),
+		}}, nil
+	}
+
+	s, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", path)
+	}
+	f, err := newProgramFile(path, s)
+	if err != nil {
+		return nil, err
+	}
+
+	// the elements of list values are reported once for the whole value
+	reported := map[*yaml.Node]bool{}
+	for _, v := range validationError.Violations {
+		m := parameterPathRegexp.FindStringSubmatch(v.Path)
+		if m == nil {
+			f.addIssue(CheckLoad, SeverityError, v.Line, v.Path+": "+v.Message)
+			continue
+		}
+
+		i, _ := strconv.Atoi(m[2])
+		n := yamlnode.Get(f.root, m[1]).Content[i]
+		if reported[n] {
+			continue
+		}
+		reported[n] = true
+		param := &cliopatra.Parameter{}
+		if name := yamlnode.Get(n, "name"); name != nil {
+			param.Name = name.Value
+		}
+		if type_ := yamlnode.Get(n, "type"); type_ != nil {
+			param.Type = parameters.ParameterType(type_.Value)
+		}
+		l.addValueIssue(f, param, yamlnode.Get(n, "value"), param.Name+": "+v.Message)
+	}
+	l.lintParameterLogs(f)
+
+	return f.issues, f.write()
+}
+
+// lintProgram checks rp, and rewrites its program file if fixes were applied.
+func (l *Linter) lintProgram(ctx context.Context, rp *pkg.RepositoryProgram) ([]*Issue, error) {
+	s, err := rp.ReadProgramFile()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", rp.Path())
+	}
+	f, err := newProgramFile(rp.Path(), s)
+	if err != nil {
+		return nil, err
+	}
+	f.program = rp.QualifiedName()
+
+	p := rp.Program()
+	binary := p.Path
+	if binary == "" {
+		binary = p.Name
+	}
+	resolved, err := l.lookPath(binary)
+	if err != nil {
+		f.addIssue(CheckMissingBinary, SeverityError, keyLine(f.root, "path"),
+			fmt.Sprintf("%s is not in $PATH", binary))
+	} else if l.probeVerbs && len(p.Verbs) > 0 {
+		err = l.probe(ctx, resolved, p)
+		if err != nil {
+			f.addIssue(CheckMissingVerb, SeverityError, keyLine(f.root, "verbs"), err.Error())
+		}
+	}
+
+	if rp.IsOnDisk() {
+		fixtures := yamlnode.Get(f.root, "fixtures")
+		for i, fixture := range rp.Spec().Fixtures {
+			_, err := os.Stat(filepath.Join(filepath.Dir(rp.Path()), fixture))
+			if err == nil {
+				continue
+			}
+			line := keyLine(f.root, "fixtures")
+			if fixtures != nil && fixtures.Kind == yaml.SequenceNode && i < len(fixtures.Content) {
+				line = fixtures.Content[i].Line
+			}
+			f.addIssue(CheckMissingFixture, SeverityError, line, fmt.Sprintf("fixture %s does not exist", fixture))
+		}
+	}
+
+	// the schema checks the values as written, this checks them once interpolated
+	params := append(append([]*cliopatra.Parameter{}, p.Flags...), p.Args...)
+	for i, n := range f.parameters() {
+		if i >= len(params) {
+			break
+		}
+		param := params[i]
+		value := yamlnode.Get(n, "value")
+		if value == nil || param.Raw != "" {
+			continue
+		}
+		err = checkValue(param)
+		if err != nil {
+			l.addValueIssue(f, param, value, err.Error())
+		}
+	}
+	l.lintParameterLogs(f)
+
+	return f.issues, f.write()
+}
+
+// addValueIssue reports that the value of param doesn't match its type, and fixes it
+// if possible.
+func (l *Linter) addValueIssue(f *programFile, param *cliopatra.Parameter, value *yaml.Node, message string) {
+	line := 0
+	if value != nil {
+		line = value.Line
+	}
+	issue := f.addIssue(CheckValueType, SeverityError, line, message)
+	if value == nil {
+		return
+	}
+	fixed, ok := fixValue(param, value)
+	issue.Fixable = ok
+	if ok && l.fix {
+		*value = *fixed
+		issue.Fixed = true
+		f.changed = true
+	}
+}
+
+// lintParameterLogs reports the log provenance blocks of the flags and arguments, and
+// strips them when fixing.
+func (l *Linter) lintParameterLogs(f *programFile) {
+	for _, n := range f.parameters() {
+		line := keyLine(n, "log")
+		if line == 0 {
+			continue
+		}
+		name := ""
+		if name_ := yamlnode.Get(n, "name"); name_ != nil {
+			name = name_.Value
+		}
+		issue := f.addIssue(CheckParameterLog, SeverityWarning, line,
+			fmt.Sprintf("%s has a log provenance block", name))
+		issue.Fixable = true
+		if l.fix {
+			yamlnode.Delete(n, "log")
+			issue.Fixed = true
+			f.changed = true
+		}
+	}
+}
+
+// probe runs `<path> <verbs> --help` and checks that the output mentions the verbs,
+// as the usage line of cobra commands does. Commands that don't know about a verb
+// usually fail, or print the help of their parent command.
+func (l *Linter) probe(ctx context.Context, path string, p *cliopatra.Program) error {
+	verbs := strings.Join(p.Verbs, " ")
+	commandLine := path + " " + verbs + " --help"
+	if err, ok := l.probes[commandLine]; ok {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.probeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, append(append([]string{}, p.Verbs...), "--help")...)
+	cmd.Env = os.Environ()
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out, err := cmd.CombinedOutput()
+
+	switch {
+	case err != nil:
+		err = errors.Errorf("%s failed: %s", commandLine, firstLine(out, err))
+	case !bytes.Contains(out, []byte(verbs)):
+		err = errors.Errorf("the output of %s does not mention %s", commandLine, verbs)
+	}
+	l.probes[commandLine] = err
+	return err
+}
+
+// checkValue checks that the value of param matches its type. Choices are not known
+// from program files, and file types hold their content, so they are not checked.
+func checkValue(param *cliopatra.Parameter) error {
+	//exhaustive:ignore
+	switch param.Type {
+	case parameters.ParameterTypeChoice,
+		parameters.ParameterTypeChoiceList,
+		parameters.ParameterTypeFile,
+		parameters.ParameterTypeFileList,
+		parameters.ParameterTypeObjectFromFile,
+		parameters.ParameterTypeObjectListFromFile,
+		parameters.ParameterTypeObjectListFromFiles,
+		parameters.ParameterTypeStringFromFile,
+		parameters.ParameterTypeStringFromFiles,
+		parameters.ParameterTypeStringListFromFile,
+		parameters.ParameterTypeStringListFromFiles:
+		return nil
+	default:
+		return parameters.NewParameterDefinition(param.Name, param.Type).CheckValueValidity(param.Value)
+	}
+}
+
+// fixValue parses the strings of value according to the type of param, for example
+// `"12"` for an int flag, and returns the node of the parsed value. Values referring
+// to environment variables are left alone.
+func fixValue(param *cliopatra.Parameter, value *yaml.Node) (*yaml.Node, bool) {
+	strs := []string{}
+	switch value.Kind {
+	case yaml.ScalarNode:
+		strs = append(strs, value.Value)
+	case yaml.SequenceNode:
+		for _, n := range value.Content {
+			if n.Kind != yaml.ScalarNode {
+				return nil, false
+			}
+			strs = append(strs, n.Value)
+		}
+	case yaml.DocumentNode, yaml.MappingNode, yaml.AliasNode:
+		return nil, false
+	}
+	for _, s := range strs {
+		if strings.Contains(s, "${") {
+			return nil, false
+		}
+	}
+
+	parsed, err := parameters.NewParameterDefinition(param.Name, param.Type).ParseParameter(strs)
+	if err != nil {
+		return nil, false
+	}
+	ret := &yaml.Node{}
+	err = ret.Encode(parsed.Value)
+	if err != nil {
+		return nil, false
+	}
+	ret.HeadComment = value.HeadComment
+	ret.LineComment = value.LineComment
+	ret.FootComment = value.FootComment
+	return ret, true
+}
+
+var lineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// errorLine returns the line number mentioned in a YAML error, 0 if there is none.
+func errorLine(err error) int {
+	m := lineRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	ret, _ := strconv.Atoi(m[1])
+	return ret
+}
+
+func firstLine(out []byte, err error) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if line == "" {
+		return err.Error()
+	}
+	return line
+}
+
+// nameLine returns the line of the name of rp, 0 if its program file can't be read.
+func nameLine(rp *pkg.RepositoryProgram) int {
+	s, err := rp.ReadProgramFile()
+	if err != nil {
+		return 0
+	}
+	var doc yaml.Node
+	if yaml.Unmarshal(s, &doc) != nil || len(doc.Content) != 1 {
+		return 0
+	}
+	return keyLine(doc.Content[0], "name")
+}
+
+// keyLine returns the line of key in the mapping node, 0 if it is not present.
+func keyLine(mapping *yaml.Node, key string) int {
+	n := yamlnode.Key(mapping, key)
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
+
+// write encodes the document back to the program file if fixes were applied, with
+// the indentation of the original content.
+func (f *programFile) write() error {
+	if !f.changed {
+		return nil
+	}
+
+	b, err := yamlnode.Encode(&f.doc, f.s)
+	if err != nil {
+		return errors.Wrapf(err, "could not encode %s", f.path)
+	}
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.path, b, fi.Mode())
+}
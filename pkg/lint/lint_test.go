@@ -0,0 +1,164 @@
+package lint
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0755))
+	}
+}
+
+func lookPath(file string) (string, error) {
+	if file == "missing" {
+		return "", errors.New("not found")
+	}
+	return file, nil
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".cliopatra.yaml": "interpolate: true\n",
+		"broken.yaml":     "name: broken\npath: echo\nflags: [\n",
+		"unset.yaml":      "name: unset\npath: echo\nrawFlags: ['${CLIOPATRA_TEST_UNSET}']\n",
+		"a/echo.yaml":     "name: echo\npath: echo\n",
+		"b/echo.yaml":     "name: echo\npath: echo\n",
+		"missing.yaml": `name: missing
+path: missing
+fixtures: [data.csv, missing.csv]
+`,
+		"data.csv": "a,b\n",
+		"values.yaml": `name: values
+path: echo
+flags:
+  - name: count
+    type: int
+    value: "12"
+    log:
+      - source: defaults
+        value: 0
+  - name: limit
+    type: int
+    value: many
+  - name: from
+    type: date
+    value: 2023-01-01
+args:
+  - name: names
+    type: stringList
+    value: [a, b]
+`,
+	})
+
+	issues, err := NewLinter(WithLookPath(lookPath)).Lint(context.Background(), []string{dir})
+	require.NoError(t, err)
+
+	type issue struct {
+		Check   Check
+		Path    string
+		Line    int
+		Fixable bool
+	}
+	actual := []issue{}
+	for _, i := range issues {
+		rel, err := filepath.Rel(dir, i.Path)
+		require.NoError(t, err)
+		actual = append(actual, issue{i.Check, rel, i.Line, i.Fixable})
+	}
+	assert.Equal(t, []issue{
+		{CheckDuplicateName, "a/echo.yaml", 1, false},
+		{CheckDuplicateName, "b/echo.yaml", 1, false},
+		{CheckLoad, "broken.yaml", 3, false},
+		{CheckMissingBinary, "missing.yaml", 2, false},
+		{CheckMissingFixture, "missing.yaml", 3, false},
+		{CheckLoad, "unset.yaml", 0, false},
+		{CheckValueType, "values.yaml", 6, true},
+		{CheckParameterLog, "values.yaml", 7, true},
+		{CheckValueType, "values.yaml", 12, false},
+	}, actual)
+}
+
+func TestLintFix(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"values.yaml": `name: values
+path: echo
+flags:
+  # the number of rows
+  - name: count
+    type: int
+    value: "12"
+    log:
+      - source: defaults
+        value: 0
+  - name: ratios
+    type: floatList
+    value: ["0.5", "2"]
+`,
+	})
+
+	issues, err := NewLinter(WithLookPath(lookPath), WithFix(true)).Lint(context.Background(), []string{dir})
+	require.NoError(t, err)
+	require.Len(t, issues, 3)
+	for _, i := range issues {
+		assert.True(t, i.Fixed, i.Message)
+	}
+
+	s, err := os.ReadFile(filepath.Join(dir, "values.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, `name: values
+path: echo
+flags:
+  # the number of rows
+  - name: count
+    type: int
+    value: 12
+  - name: ratios
+    type: floatList
+    value:
+      - 0.5
+      - 2
+`, string(s))
+
+	issues, err = NewLinter(WithLookPath(lookPath)).Lint(context.Background(), []string{dir})
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+}
+
+func TestLintProbesVerbs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tool": `#!/bin/sh
+if [ "$1" = "orders" ]; then echo "Usage: tool orders [flags]"; exit 0; fi
+echo "unknown command $1" >&2
+exit 1
+`,
+		"orders.yaml":    "name: orders\npath: tool\nverbs: [orders]\n",
+		"customers.yaml": "name: customers\npath: tool\nverbs:\n  - customers\n",
+	})
+	tool := filepath.Join(dir, "tool")
+	toolPath := func(file string) (string, error) {
+		return tool, nil
+	}
+
+	issues, err := NewLinter(WithLookPath(toolPath)).Lint(context.Background(), []string{dir})
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, CheckMissingVerb, issues[0].Check)
+	assert.Equal(t, 3, issues[0].Line)
+	assert.Contains(t, issues[0].Message, "unknown command customers")
+
+	issues, err = NewLinter(WithLookPath(toolPath), WithProbeVerbs(false)).Lint(context.Background(), []string{dir})
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"github.com/pkg/errors"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// repositoryNamespace returns the first component of the qualified names of the
+// programs of repository, which is the namespace declared in its configuration, or the
+// name of its directory.
+func repositoryNamespace(repository string, config *RepositoryConfig) string {
+	if config != nil && config.Namespace != "" {
+		return config.Namespace
+	}
+	if abs, err := filepath.Abs(repository); err == nil {
+		repository = abs
+	}
+	return filepath.Base(repository)
+}
+
+// Namespace returns the first component of the qualified name of the program, empty
+// if it wasn't loaded from a repository.
+func (rp *RepositoryProgram) Namespace() string {
+	return rp.namespace
+}
+
+// QualifiedName returns the name of the program prefixed with the namespace of its
+// repository and the directory of its program file, for example
+// `reports/sqleton/ttc-orders`. Programs that weren't loaded from a repository are
+// only known by their name.
+func (rp *RepositoryProgram) QualifiedName() string {
+	if rp.root == "" {
+		return rp.program.Name
+	}
+	components := []string{rp.namespace}
+	if dir := filepath.Dir(rp.RelativePath()); dir != "." {
+		components = append(components, filepath.ToSlash(dir))
+	}
+	return strings.Join(append(components, rp.program.Name), "/")
+}
+
+// ShadowKind tells how a program is hidden by other programs.
+type ShadowKind string
+
+const (
+	// ShadowQualifiedName means that another program has the same qualified name, and
+	// the shadowed program can't be addressed at all.
+	ShadowQualifiedName ShadowKind = "qualified-name"
+	// ShadowShortName means that a program of a repository with higher precedence has
+	// the same name, and the shadowed program has to be addressed by its qualified name.
+	ShadowShortName ShadowKind = "short-name"
+	// ShadowAmbiguous means that several programs of the repository with the highest
+	// precedence have the same name, and all the programs with that name have to be
+	// addressed by their qualified name.
+	ShadowAmbiguous ShadowKind = "ambiguous"
+)
+
+// Shadow reports a program that can't be addressed by Name.
+type Shadow struct {
+	Kind ShadowKind
+	Name string
+	// Program is the program that Name resolves to, nil if Name is ambiguous.
+	Program  *RepositoryProgram
+	Shadowed *RepositoryProgram
+}
+
+// programIndex resolves qualified and short names to programs.
+//
+// Programs are ordered by precedence: programs of repositories listed first come
+// first, and programs of the same repository are ordered by path. A qualified name
+// resolves to the first program with that qualified name. A short name resolves to
+// the program with that name in the first repository declaring it, unless that
+// repository declares it several times.
+type programIndex struct {
+	// programs are the programs that can be addressed by their qualified name, in
+	// order of precedence
+	programs    []*RepositoryProgram
+	byQualified map[string]*RepositoryProgram
+	byName      map[string]*RepositoryProgram
+	ambiguous   map[string][]*RepositoryProgram
+	shadows     []*Shadow
+}
+
+// newProgramIndex indexes rps, directories being the repositories in order of precedence.
+func newProgramIndex(rps []*RepositoryProgram, directories []string) *programIndex {
+	rank := map[string]int{}
+	for i, d := range directories {
+		if _, ok := rank[d]; !ok {
+			rank[d] = i
+		}
+	}
+	sorted := append([]*RepositoryProgram{}, rps...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, rj := rank[sorted[i].root], rank[sorted[j].root]
+		if ri != rj {
+			return ri < rj
+		}
+		return sorted[i].path < sorted[j].path
+	})
+
+	ret := &programIndex{
+		byQualified: map[string]*RepositoryProgram{},
+		byName:      map[string]*RepositoryProgram{},
+		ambiguous:   map[string][]*RepositoryProgram{},
+	}
+
+	names := []string{}
+	candidates := map[string][]*RepositoryProgram{}
+	for _, rp := range sorted {
+		qualifiedName := rp.QualifiedName()
+		if other, ok := ret.byQualified[qualifiedName]; ok {
+			ret.shadows = append(ret.shadows, &Shadow{
+				Kind:     ShadowQualifiedName,
+				Name:     qualifiedName,
+				Program:  other,
+				Shadowed: rp,
+			})
+			continue
+		}
+		ret.byQualified[qualifiedName] = rp
+		ret.programs = append(ret.programs, rp)
+
+		name := rp.program.Name
+		if _, ok := candidates[name]; !ok {
+			names = append(names, name)
+		}
+		candidates[name] = append(candidates[name], rp)
+	}
+
+	for _, name := range names {
+		rps := candidates[name]
+		first := rps[0]
+		top := 1
+		for top < len(rps) && rps[top].root == first.root {
+			top++
+		}
+
+		if top > 1 {
+			ret.ambiguous[name] = rps
+			for _, rp := range rps {
+				ret.shadows = append(ret.shadows, &Shadow{Kind: ShadowAmbiguous, Name: name, Shadowed: rp})
+			}
+			continue
+		}
+
+		ret.byName[name] = first
+		for _, rp := range rps[1:] {
+			ret.shadows = append(ret.shadows, &Shadow{
+				Kind:     ShadowShortName,
+				Name:     name,
+				Program:  first,
+				Shadowed: rp,
+			})
+		}
+	}
+
+	sort.SliceStable(ret.shadows, func(i, j int) bool {
+		return ret.shadows[i].Name < ret.shadows[j].Name
+	})
+
+	return ret
+}
+
+// lookup resolves a qualified name, or a short name if it isn't ambiguous.
+func (i *programIndex) lookup(name string) (*RepositoryProgram, error) {
+	if rp, ok := i.byQualified[name]; ok {
+		return rp, nil
+	}
+	if rp, ok := i.byName[name]; ok {
+		return rp, nil
+	}
+	if rps, ok := i.ambiguous[name]; ok {
+		qualifiedNames := make([]string, len(rps))
+		for j, rp := range rps {
+			qualifiedNames[j] = rp.QualifiedName()
+		}
+		return nil, errors.Errorf("program %s is ambiguous, use one of %s", name, strings.Join(qualifiedNames, ", "))
+	}
+	return nil, errors.Errorf("program %s not found", name)
+}
@@ -0,0 +1,243 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testProgram struct {
+	repository string
+	namespace  string
+	file       string
+	name       string
+}
+
+func (p testProgram) repositoryProgram() *RepositoryProgram {
+	namespace := p.namespace
+	if namespace == "" {
+		namespace = p.repository
+	}
+	return &RepositoryProgram{
+		path:      filepath.Join(p.repository, p.file),
+		fsPath:    p.file,
+		root:      p.repository,
+		namespace: namespace,
+		program:   &cliopatra.Program{Name: p.name},
+	}
+}
+
+func TestProgramIndex(t *testing.T) {
+	tests := []struct {
+		name         string
+		repositories []string
+		programs     []testProgram
+		// lookups are the paths the names resolve to, or the errors they fail with
+		lookups map[string]string
+		shadows []string
+	}{
+		{
+			name:         "unique names",
+			repositories: []string{"a", "b"},
+			programs: []testProgram{
+				{repository: "a", file: "echo.yaml", name: "echo"},
+				{repository: "b", file: "sub/cat.yaml", name: "cat"},
+			},
+			lookups: map[string]string{
+				"echo":      "a/echo.yaml",
+				"a/echo":    "a/echo.yaml",
+				"cat":       "b/sub/cat.yaml",
+				"b/sub/cat": "b/sub/cat.yaml",
+				"b/cat":     "error: program b/cat not found",
+				"ls":        "error: program ls not found",
+			},
+		},
+		{
+			name:         "same name in two repositories",
+			repositories: []string{"b", "a"},
+			programs: []testProgram{
+				{repository: "a", file: "echo.yaml", name: "echo"},
+				{repository: "b", file: "echo.yaml", name: "echo"},
+			},
+			lookups: map[string]string{
+				"echo":   "b/echo.yaml",
+				"a/echo": "a/echo.yaml",
+				"b/echo": "b/echo.yaml",
+			},
+			shadows: []string{"short-name echo: a/echo.yaml by b/echo.yaml"},
+		},
+		{
+			name:         "same name twice in a repository",
+			repositories: []string{"a", "b"},
+			programs: []testProgram{
+				{repository: "a", file: "echo.yaml", name: "echo"},
+				{repository: "a", file: "sub/echo.yaml", name: "echo"},
+				{repository: "b", file: "echo.yaml", name: "echo"},
+			},
+			lookups: map[string]string{
+				"echo":       "error: program echo is ambiguous, use one of a/echo, a/sub/echo, b/echo",
+				"a/echo":     "a/echo.yaml",
+				"a/sub/echo": "a/sub/echo.yaml",
+				"b/echo":     "b/echo.yaml",
+			},
+			shadows: []string{
+				"ambiguous echo: a/echo.yaml",
+				"ambiguous echo: a/sub/echo.yaml",
+				"ambiguous echo: b/echo.yaml",
+			},
+		},
+		{
+			name:         "same name twice in a lower repository",
+			repositories: []string{"a", "b"},
+			programs: []testProgram{
+				{repository: "a", file: "echo.yaml", name: "echo"},
+				{repository: "b", file: "echo.yaml", name: "echo"},
+				{repository: "b", file: "sub/echo.yaml", name: "echo"},
+			},
+			lookups: map[string]string{
+				"echo": "a/echo.yaml",
+			},
+			shadows: []string{
+				"short-name echo: b/echo.yaml by a/echo.yaml",
+				"short-name echo: b/sub/echo.yaml by a/echo.yaml",
+			},
+		},
+		{
+			name:         "same qualified name in a repository",
+			repositories: []string{"a"},
+			programs: []testProgram{
+				{repository: "a", file: "echo2.yaml", name: "echo"},
+				{repository: "a", file: "echo.yaml", name: "echo"},
+			},
+			lookups: map[string]string{
+				"echo":   "a/echo.yaml",
+				"a/echo": "a/echo.yaml",
+			},
+			shadows: []string{"qualified-name a/echo: a/echo2.yaml by a/echo.yaml"},
+		},
+		{
+			name:         "same qualified name in two repositories",
+			repositories: []string{"b", "a"},
+			programs: []testProgram{
+				{repository: "a", namespace: "shared", file: "echo.yaml", name: "echo"},
+				{repository: "b", namespace: "shared", file: "echo.yaml", name: "echo"},
+				{repository: "a", namespace: "shared", file: "cat.yaml", name: "cat"},
+			},
+			lookups: map[string]string{
+				"echo":        "b/echo.yaml",
+				"shared/echo": "b/echo.yaml",
+				"shared/cat":  "a/cat.yaml",
+			},
+			shadows: []string{"qualified-name shared/echo: a/echo.yaml by b/echo.yaml"},
+		},
+		{
+			name:         "qualified name of another program as a name",
+			repositories: []string{"a"},
+			programs: []testProgram{
+				{repository: "a", file: "sub/echo.yaml", name: "echo"},
+				{repository: "a", file: "other.yaml", name: "a/sub/echo"},
+			},
+			lookups: map[string]string{
+				"a/sub/echo": "a/sub/echo.yaml",
+				"echo":       "a/sub/echo.yaml",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rps := []*RepositoryProgram{}
+			for _, p := range tt.programs {
+				rps = append(rps, p.repositoryProgram())
+			}
+			index := newProgramIndex(rps, tt.repositories)
+
+			for name, expected := range tt.lookups {
+				rp, err := index.lookup(name)
+				if err != nil {
+					assert.Equal(t, expected, "error: "+err.Error(), name)
+					continue
+				}
+				assert.Equal(t, expected, rp.path, name)
+			}
+
+			shadows := []string{}
+			for _, s := range index.shadows {
+				shadow := fmt.Sprintf("%s %s: %s", s.Kind, s.Name, s.Shadowed.path)
+				if s.Program != nil {
+					shadow += " by " + s.Program.path
+				}
+				shadows = append(shadows, shadow)
+			}
+			assert.ElementsMatch(t, tt.shadows, shadows)
+			assert.Len(t, index.programs, len(tt.programs)-countKind(index.shadows, ShadowQualifiedName))
+		})
+	}
+}
+
+func countKind(shadows []*Shadow, kind ShadowKind) int {
+	ret := 0
+	for _, s := range shadows {
+		if s.Kind == kind {
+			ret++
+		}
+	}
+	return ret
+}
+
+func TestProgramIndexOrder(t *testing.T) {
+	rps := []*RepositoryProgram{
+		testProgram{repository: "a", file: "z.yaml", name: "z"}.repositoryProgram(),
+		testProgram{repository: "b", file: "a.yaml", name: "a"}.repositoryProgram(),
+		testProgram{repository: "a", file: "m.yaml", name: "m"}.repositoryProgram(),
+	}
+	index := newProgramIndex(rps, []string{"b", "a"})
+
+	paths := []string{}
+	for _, rp := range index.programs {
+		paths = append(paths, rp.path)
+	}
+	assert.Equal(t, []string{"b/a.yaml", "a/m.yaml", "a/z.yaml"}, paths)
+}
+
+func TestRepositoryShadowsWhenWatching(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writeFiles(t, first, map[string]string{"echo.yaml": "name: echo\npath: echo\n"})
+	writeFiles(t, second, map[string]string{"echo.yaml": "name: echo\npath: /bin/echo\n"})
+
+	r := NewRepository([]string{first, second}, WithRenameWindow(time.Millisecond))
+	require.NoError(t, r.Load())
+	removed := make(chan struct{}, 1)
+	r.Subscribe(func(e *ChangeEvent) {
+		if e.Type == ChangeRemoved {
+			removed <- struct{}{}
+		}
+	})
+
+	rp, err := r.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(first, "echo.yaml"), rp.Path())
+	shadows := r.GetShadows()
+	require.Len(t, shadows, 1)
+	assert.Equal(t, ShadowShortName, shadows[0].Kind)
+	assert.Equal(t, filepath.Join(second, "echo.yaml"), shadows[0].Shadowed.Path())
+
+	// removing the program makes the shadowed one reachable
+	require.NoError(t, r.onRemove(filepath.Join(first, "echo.yaml")))
+	<-removed
+	rp, err = r.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(second, "echo.yaml"), rp.Path())
+	assert.Empty(t, r.GetShadows())
+
+	// adding it back shadows it again
+	require.NoError(t, r.onWrite(filepath.Join(first, "echo.yaml")))
+	rp, err = r.Lookup("echo")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(first, "echo.yaml"), rp.Path())
+	assert.Len(t, r.GetShadows(), 1)
+}
@@ -0,0 +1,162 @@
+// Package normalize provides filters that are applied to the output of a program
+// before it gets compared to or stored as its expected output.
+//
+// This is used to remove the parts of an output that change from run to run,
+// like timestamps, durations, temporary paths or UUIDs.
+//
+// Filters are declared in YAML as a list, either by name or, for replacements,
+// as a map:
+//
+//	normalize:
+//	  - trim-trailing-whitespace
+//	  - mask-iso-dates
+//	  - replace: '\d+(\.\d+)?ms'
+//	    with: '<duration>'
+package normalize
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type FilterType string
+
+const (
+	FilterReplace                FilterType = "replace"
+	FilterTrimTrailingWhitespace FilterType = "trim-trailing-whitespace"
+	FilterSortLines              FilterType = "sort-lines"
+	FilterMaskISODates           FilterType = "mask-iso-dates"
+	FilterMaskUUIDs              FilterType = "mask-uuids"
+)
+
+var (
+	isoDateRegexp = regexp.MustCompile(
+		`\d{4}-\d{2}-\d{2}([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?)?`)
+	uuidRegexp = regexp.MustCompile(
+		`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+)
+
+type Filter struct {
+	Type FilterType
+	// Pattern and With are only used by FilterReplace
+	Pattern string
+	With    string
+
+	re *regexp.Regexp
+}
+
+func NewReplaceFilter(pattern string, with string) (*Filter, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid replace pattern %s", pattern)
+	}
+	return &Filter{
+		Type:    FilterReplace,
+		Pattern: pattern,
+		With:    with,
+		re:      re,
+	}, nil
+}
+
+func NewFilter(t FilterType) (*Filter, error) {
+	switch t {
+	case FilterTrimTrailingWhitespace, FilterSortLines, FilterMaskISODates, FilterMaskUUIDs:
+		return &Filter{Type: t}, nil
+	case FilterReplace:
+		return nil, errors.New("replace filters need a pattern, use NewReplaceFilter")
+	default:
+		return nil, errors.Errorf("unknown normalization filter %s", t)
+	}
+}
+
+func (f *Filter) UnmarshalYAML(value *yaml.Node) error {
+	var f_ *Filter
+	var err error
+
+	switch value.Kind {
+	case yaml.ScalarNode:
+		f_, err = NewFilter(FilterType(value.Value))
+
+	case yaml.MappingNode:
+		s := struct {
+			Replace string `yaml:"replace"`
+			With    string `yaml:"with"`
+		}{}
+		err = value.Decode(&s)
+		if err != nil {
+			return err
+		}
+		if s.Replace == "" {
+			return errors.Errorf("line %d: normalization filter map needs a replace key", value.Line)
+		}
+		f_, err = NewReplaceFilter(s.Replace, s.With)
+
+	default:
+		return errors.Errorf("line %d: invalid normalization filter", value.Line)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "line %d", value.Line)
+	}
+	*f = *f_
+	return nil
+}
+
+func (f *Filter) MarshalYAML() (interface{}, error) {
+	if f.Type == FilterReplace {
+		return map[string]string{
+			"replace": f.Pattern,
+			"with":    f.With,
+		}, nil
+	}
+	return string(f.Type), nil
+}
+
+func (f *Filter) Apply(s string) string {
+	switch f.Type {
+	case FilterReplace:
+		return f.re.ReplaceAllString(s, f.With)
+	case FilterTrimTrailingWhitespace:
+		return mapLines(s, func(lines []string) []string {
+			for i, line := range lines {
+				lines[i] = strings.TrimRight(line, " \t\r")
+			}
+			return lines
+		})
+	case FilterSortLines:
+		return mapLines(s, func(lines []string) []string {
+			sort.Strings(lines)
+			return lines
+		})
+	case FilterMaskISODates:
+		return isoDateRegexp.ReplaceAllString(s, "<date>")
+	case FilterMaskUUIDs:
+		return uuidRegexp.ReplaceAllString(s, "<uuid>")
+	}
+
+	return s
+}
+
+// mapLines applies f to the lines of s, keeping the final newline in place.
+func mapLines(s string, f func(lines []string) []string) string {
+	trailingNewline := strings.HasSuffix(s, "\n")
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	s = strings.Join(f(lines), "\n")
+	if trailingNewline {
+		s += "\n"
+	}
+	return s
+}
+
+// Pipeline is an ordered list of filters.
+type Pipeline []*Filter
+
+func (p Pipeline) Apply(s string) string {
+	for _, f := range p {
+		s = f.Apply(s)
+	}
+	return s
+}
@@ -0,0 +1,41 @@
+package normalize
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+func TestPipelineFromYAML(t *testing.T) {
+	var p Pipeline
+	err := yaml.Unmarshal([]byte(`
+- trim-trailing-whitespace
+- mask-iso-dates
+- mask-uuids
+- replace: '\d+ms'
+  with: '<duration>'
+- sort-lines
+`), &p)
+	require.NoError(t, err)
+	require.Len(t, p, 5)
+
+	s := p.Apply("took 12ms  \ncreated 2023-03-17T10:12:00Z\nid 9f1b3c2e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\n")
+	assert.Equal(t, "created <date>\nid <uuid>\ntook <duration>\n", s)
+}
+
+func TestInvalidFilters(t *testing.T) {
+	var p Pipeline
+	err := yaml.Unmarshal([]byte(`[foobar]`), &p)
+	assert.Error(t, err)
+
+	err = yaml.Unmarshal([]byte(`[{replace: '('}]`), &p)
+	assert.Error(t, err)
+}
+
+func TestSortLinesKeepsTrailingNewline(t *testing.T) {
+	f, err := NewFilter(FilterSortLines)
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", f.Apply("b\na\n"))
+	assert.Equal(t, "a\nb", f.Apply("b\na"))
+}
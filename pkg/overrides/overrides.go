@@ -0,0 +1,261 @@
+// Package overrides exposes the flags and arguments of a program as command line
+// flags and positional arguments, so that their recorded values can be overridden
+// when running the program, for example:
+//
+//	cliopatra run ttc-orders --dbt-profile prod.ttc --output csv
+//
+// The recorded value of a parameter is used as the default of its flag.
+package overrides
+
+import (
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"strconv"
+	"strings"
+)
+
+// annotation marks the flags registered for program flags, to tell them apart
+// from the other flags of the command.
+const annotation = "cliopatra-program-flag"
+
+// AddFlags registers a flag for each flag of p on fs, named after the parameter
+// and typed after its type. Program flags that collide with an existing flag of
+// fs are not exposed.
+func AddFlags(fs *pflag.FlagSet, p *cliopatra.Program) error {
+	for _, f := range p.Flags {
+		if fs.Lookup(f.Name) != nil {
+			log.Warn().Str("program", p.Name).Str("flag", f.Name).
+				Msg("flag of the program collides with a cliopatra flag and can't be overridden")
+			continue
+		}
+
+		err := addFlag(fs, f)
+		if err != nil {
+			return err
+		}
+		err = fs.SetAnnotation(f.Name, annotation, []string{f.Name})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addFlag registers the flag for f, typed after its type. Types that pflag doesn't
+// know about are registered as strings, and parsed when the flags are applied.
+func addFlag(fs *pflag.FlagSet, f *cliopatra.Parameter) error {
+	if f.Type == parameters.ParameterTypeBool {
+		v, _ := f.Value.(bool)
+		fs.Bool(f.Name, v, f.Short)
+		return nil
+	}
+
+	default_, err := renderDefault(f)
+	if err != nil {
+		return err
+	}
+
+	//exhaustive:ignore
+	switch f.Type {
+	case parameters.ParameterTypeInteger:
+		if v, err := strconv.Atoi(default_); err == nil || default_ == "" {
+			fs.Int(f.Name, v, f.Short)
+			return nil
+		}
+	case parameters.ParameterTypeFloat:
+		if v, err := strconv.ParseFloat(default_, 64); err == nil || default_ == "" {
+			fs.Float64(f.Name, v, f.Short)
+			return nil
+		}
+	}
+
+	if f.Type.IsList() {
+		l := []string{}
+		if default_ != "" {
+			l = strings.Split(default_, ",")
+		}
+		fs.StringSlice(f.Name, l, f.Short)
+	} else {
+		fs.String(f.Name, default_, f.Short)
+	}
+	return nil
+}
+
+// ArgsUsage returns the usage string of the arguments of p, such as `[db] [tables...]`.
+func ArgsUsage(p *cliopatra.Program) string {
+	ret := []string{}
+	for _, a := range p.Args {
+		if a.Type.IsList() {
+			ret = append(ret, fmt.Sprintf("[%s...]", a.Name))
+		} else {
+			ret = append(ret, fmt.Sprintf("[%s]", a.Name))
+		}
+	}
+	return strings.Join(ret, " ")
+}
+
+// Apply returns a copy of p with the values of the program flags that were changed
+// in fs, and with args as the values of its arguments, in order. A list argument
+// takes all the remaining values.
+func Apply(fs *pflag.FlagSet, args []string, p *cliopatra.Program) (*cliopatra.Program, error) {
+	ret := p.Clone()
+
+	for _, f := range ret.Flags {
+		flag := fs.Lookup(f.Name)
+		if flag == nil || flag.Annotations[annotation] == nil || !flag.Changed {
+			continue
+		}
+
+		var v []string
+		if sv, ok := flag.Value.(pflag.SliceValue); ok {
+			v = sv.GetSlice()
+		} else {
+			v = []string{flag.Value.String()}
+		}
+		err := setFlag(ret, f, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	consumed := 0
+	for i, a := range ret.Args {
+		if i >= len(args) {
+			break
+		}
+		v := args[i : i+1]
+		if a.Type.IsList() {
+			v = args[i:]
+		}
+		err := setArg(ret, a, v)
+		if err != nil {
+			return nil, err
+		}
+		consumed += len(v)
+	}
+	if consumed < len(args) {
+		return nil, errors.Errorf("program %s takes at most %d arguments, got %d", p.Name, len(ret.Args), len(args))
+	}
+
+	return ret, nil
+}
+
+// SetFlag parses value according to the type of the flag name of p and sets it. The
+// elements of list values are separated by commas.
+func SetFlag(p *cliopatra.Program, name string, value string) error {
+	for _, f := range p.Flags {
+		if f.Name == name {
+			return setFlag(p, f, splitValue(f, value))
+		}
+	}
+	return errors.Errorf("could not find flag %s", name)
+}
+
+// SetArg parses value according to the type of the argument name of p and sets it.
+// The elements of list values are separated by commas.
+func SetArg(p *cliopatra.Program, name string, value string) error {
+	for _, a := range p.Args {
+		if a.Name == name {
+			return setArg(p, a, splitValue(a, value))
+		}
+	}
+	return errors.Errorf("could not find arg %s", name)
+}
+
+func splitValue(param *cliopatra.Parameter, value string) []string {
+	if param.Type.IsList() {
+		return strings.Split(value, ",")
+	}
+	return []string{value}
+}
+
+func setFlag(p *cliopatra.Program, f *cliopatra.Parameter, v []string) error {
+	value, raw, err := parseValue(f, v)
+	if err != nil {
+		return errors.Wrapf(err, "invalid value for flag %s", f.Name)
+	}
+	if raw != "" {
+		return p.SetFlagRaw(f.Name, raw)
+	}
+	err = p.SetFlagValue(f.Name, value)
+	if err != nil {
+		return err
+	}
+	return p.SetFlagRaw(f.Name, "")
+}
+
+func setArg(p *cliopatra.Program, a *cliopatra.Parameter, v []string) error {
+	value, raw, err := parseValue(a, v)
+	if err != nil {
+		return errors.Wrapf(err, "invalid value for argument %s", a.Name)
+	}
+	if raw != "" {
+		return p.SetArgRaw(a.Name, raw)
+	}
+	err = p.SetArgValue(a.Name, value)
+	if err != nil {
+		return err
+	}
+	return p.SetArgRaw(a.Name, "")
+}
+
+// parseValue parses v according to the type of param with glazed, and returns either
+// the value or the raw value to set.
+//
+// Types whose parsed value can't be rendered back as the original string, such as
+// files which are parsed into their content, are returned as raw values. Dates are
+// validated and kept as written, and choices are kept as is, since program files
+// don't record the available choices.
+func parseValue(param *cliopatra.Parameter, v []string) (interface{}, string, error) {
+	//exhaustive:ignore
+	switch param.Type {
+	case parameters.ParameterTypeString,
+		parameters.ParameterTypeInteger,
+		parameters.ParameterTypeFloat,
+		parameters.ParameterTypeBool,
+		parameters.ParameterTypeStringList,
+		parameters.ParameterTypeIntegerList,
+		parameters.ParameterTypeFloatList:
+		parsed, err := parameters.NewParameterDefinition(param.Name, param.Type).ParseParameter(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return parsed.Value, "", nil
+
+	case parameters.ParameterTypeDate:
+		_, err := parameters.NewParameterDefinition(param.Name, param.Type).ParseParameter(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return v[0], "", nil
+
+	case parameters.ParameterTypeChoice:
+		return v[0], "", nil
+
+	case parameters.ParameterTypeChoiceList:
+		return v, "", nil
+
+	default:
+		return nil, strings.Join(v, ","), nil
+	}
+}
+
+// renderDefault renders the recorded value of a flag, preferring its raw value.
+func renderDefault(f *cliopatra.Parameter) (string, error) {
+	if f.Raw != "" {
+		return f.Raw, nil
+	}
+	if f.Value == nil {
+		return "", nil
+	}
+	ret, err := parameters.RenderValue(f.Type, f.Value)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not render value of flag %s", f.Name)
+	}
+	return ret, nil
+}
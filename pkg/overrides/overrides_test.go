@@ -0,0 +1,128 @@
+package overrides
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func newTestProgram() *cliopatra.Program {
+	return cliopatra.NewProgram(
+		cliopatra.WithName("ttc-orders"),
+		cliopatra.WithFlags(
+			&cliopatra.Parameter{Name: "dbt-profile", Short: "dbt profile", Type: parameters.ParameterTypeString, Value: "dev.ttc"},
+			&cliopatra.Parameter{Name: "output", Type: parameters.ParameterTypeString, Value: "json"},
+			&cliopatra.Parameter{Name: "limit", Type: parameters.ParameterTypeInteger, Value: 10},
+			&cliopatra.Parameter{Name: "verbose", Type: parameters.ParameterTypeBool, Value: false, NoValue: true},
+			&cliopatra.Parameter{Name: "columns", Type: parameters.ParameterTypeStringList, Raw: "a,b"},
+			&cliopatra.Parameter{Name: "timeout", Type: parameters.ParameterTypeString, Value: "1s"},
+		),
+		cliopatra.WithArgs(
+			&cliopatra.Parameter{Name: "db", Type: parameters.ParameterTypeString, Value: "orders"},
+			&cliopatra.Parameter{Name: "tables", Type: parameters.ParameterTypeStringList, Value: []string{"a"}},
+		),
+	)
+}
+
+func TestAddFlags(t *testing.T) {
+	fs := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	fs.Duration("timeout", 0, "cliopatra timeout")
+	p := newTestProgram()
+
+	require.NoError(t, AddFlags(fs, p))
+
+	f := fs.Lookup("dbt-profile")
+	require.NotNil(t, f)
+	assert.Equal(t, "dev.ttc", f.DefValue)
+	assert.Equal(t, "dbt profile", f.Usage)
+	assert.Equal(t, "10", fs.Lookup("limit").DefValue)
+	assert.Equal(t, "bool", fs.Lookup("verbose").Value.Type())
+	assert.Equal(t, "[a,b]", fs.Lookup("columns").DefValue)
+	// the colliding program flag is not exposed
+	assert.Equal(t, "duration", fs.Lookup("timeout").Value.Type())
+
+	assert.Equal(t, "[db] [tables...]", ArgsUsage(p))
+}
+
+func TestApply(t *testing.T) {
+	fs := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	fs.Duration("timeout", 0, "cliopatra timeout")
+	p := newTestProgram()
+	require.NoError(t, AddFlags(fs, p))
+
+	require.NoError(t, fs.Parse([]string{
+		"--dbt-profile", "prod.ttc", "--limit", "20", "--verbose", "--columns", "c",
+		"--timeout", "5s", "customers", "x", "y",
+	}))
+	p2, err := Apply(fs, fs.Args(), p)
+	require.NoError(t, err)
+
+	args, err := p2.ComputeArgs(parameters.NewParsedParameters())
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"--dbt-profile", "prod.ttc",
+		"--output", "json",
+		"--limit", "20",
+		"--verbose",
+		"--columns", "c",
+		"--timeout", "1s",
+		"customers", "x,y",
+	}, args)
+
+	// the original program is left untouched
+	assert.Equal(t, "dev.ttc", p.Flags[0].Value)
+
+	fs = pflag.NewFlagSet("run", pflag.ContinueOnError)
+	require.NoError(t, AddFlags(fs, p))
+	assert.Error(t, fs.Parse([]string{"--limit", "many"}))
+}
+
+func TestApplyInvalidValue(t *testing.T) {
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("report"),
+		cliopatra.WithFlags(&cliopatra.Parameter{Name: "ids", Type: parameters.ParameterTypeIntegerList, Value: []int{1}}),
+		cliopatra.WithArgs(&cliopatra.Parameter{Name: "limit", Type: parameters.ParameterTypeInteger, Value: 1}),
+	)
+	fs := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	require.NoError(t, AddFlags(fs, p))
+
+	require.NoError(t, fs.Parse([]string{"--ids", "1,x"}))
+	_, err := Apply(fs, nil, p)
+	assert.Error(t, err)
+
+	fs = pflag.NewFlagSet("run", pflag.ContinueOnError)
+	require.NoError(t, AddFlags(fs, p))
+	_, err = Apply(fs, []string{"many"}, p)
+	assert.Error(t, err)
+}
+
+func TestApplyTooManyArgs(t *testing.T) {
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("ls"),
+		cliopatra.WithArgs(&cliopatra.Parameter{Name: "dir", Type: parameters.ParameterTypeString, Value: "."}),
+	)
+	fs := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	require.NoError(t, AddFlags(fs, p))
+
+	_, err := Apply(fs, []string{"a", "b"}, p)
+	assert.Error(t, err)
+}
+
+func TestSetFlagAndArg(t *testing.T) {
+	p := newTestProgram()
+
+	require.NoError(t, SetFlag(p, "limit", "5"))
+	assert.Equal(t, 5, p.Flags[2].Value)
+	require.NoError(t, SetFlag(p, "columns", "x,y"))
+	assert.Equal(t, []string{"x", "y"}, p.Flags[4].Value)
+	assert.Equal(t, "", p.Flags[4].Raw)
+	require.NoError(t, SetArg(p, "db", "customers"))
+	assert.Equal(t, "customers", p.Args[0].Value)
+
+	assert.Error(t, SetFlag(p, "limit", "many"))
+	assert.Error(t, SetFlag(p, "missing", "1"))
+	assert.Error(t, SetArg(p, "missing", "1"))
+}
@@ -0,0 +1,277 @@
+// Package record turns an arbitrary command line into a cliopatra program.
+//
+// Since a command line doesn't say which words are verbs, which flags take a value
+// and which words are arguments, the split is a heuristic that can be tuned with
+// options:
+//
+//   - only the number of leading words given with WithVerbs are verbs (`git log`),
+//     since a subcommand can't be told apart from an argument (`echo hello`)
+//   - `--flag=value` is kept as is as a raw flag, since some programs only accept
+//     optional values in that form (`ls --color=always`)
+//   - `--flag value` and `-f value` take the next word as value, unless it
+//     starts with a dash or the flag is declared as a boolean flag
+//   - clustered short flags such as `-la` are boolean flags
+//   - everything after `--` and all remaining words are arguments
+//
+// Cliopatra renders verbs, then raw flags, then flags, then arguments. A command
+// line where a flag comes after an argument, for example `git -C dir log --oneline`,
+// can't be represented in that order and is recorded as raw flags.
+package record
+
+import (
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type splitter struct {
+	verbs      int
+	boolFlags  map[string]bool
+	valueFlags map[string]bool
+	rawFlags   bool
+}
+
+type Option func(s *splitter)
+
+// WithVerbs sets the number of words after the command that are verbs. There are
+// no verbs by default.
+func WithVerbs(verbs int) Option {
+	return func(s *splitter) {
+		s.verbs = verbs
+	}
+}
+
+// WithBoolFlags declares flags that never take a value, for example `--oneline` or `-v`.
+func WithBoolFlags(flags ...string) Option {
+	return func(s *splitter) {
+		for _, f := range flags {
+			s.boolFlags[f] = true
+		}
+	}
+}
+
+// WithValueFlags declares flags that always take the next word as value, even if
+// it starts with a dash.
+func WithValueFlags(flags ...string) Option {
+	return func(s *splitter) {
+		for _, f := range flags {
+			s.valueFlags[f] = true
+		}
+	}
+}
+
+// WithRawFlags stores everything after the verbs as raw flags, without trying to
+// recognize flags and arguments.
+func WithRawFlags(rawFlags bool) Option {
+	return func(s *splitter) {
+		s.rawFlags = rawFlags
+	}
+}
+
+// NewProgramFromArgs creates a program named name from argv, argv[0] being the
+// executable to run.
+func NewProgramFromArgs(name string, argv []string, options ...Option) (*cliopatra.Program, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("no command to record")
+	}
+
+	s := &splitter{
+		boolFlags:  map[string]bool{},
+		valueFlags: map[string]bool{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	if name == "" {
+		name = filepath.Base(argv[0])
+	}
+	p := cliopatra.NewProgram(
+		cliopatra.WithName(name),
+		cliopatra.WithPath(argv[0]),
+	)
+
+	words := argv[1:]
+	if s.verbs < 0 {
+		return nil, errors.Errorf("invalid number of verbs %d", s.verbs)
+	}
+	if s.verbs > len(words) {
+		return nil, errors.Errorf("cannot record %d verbs, the command only has %d words", s.verbs, len(words))
+	}
+	p.Verbs = append(p.Verbs, words[:s.verbs]...)
+	i := s.verbs
+
+	rest := words[i:]
+	if s.rawFlags {
+		p.RawFlags = append(p.RawFlags, rest...)
+		return p, nil
+	}
+	asRawFlags := func() (*cliopatra.Program, error) {
+		p.RawFlags = append([]string{}, rest...)
+		p.Flags = nil
+		p.Args = nil
+		return p, nil
+	}
+
+	for ; i < len(words); i++ {
+		word := words[i]
+
+		if word == "--" {
+			for _, arg := range words[i+1:] {
+				if strings.HasPrefix(arg, "-") {
+					return asRawFlags()
+				}
+				addArg(p, arg)
+			}
+			break
+		}
+
+		if !strings.HasPrefix(word, "-") || word == "-" {
+			addArg(p, word)
+			continue
+		}
+
+		if len(p.Args) > 0 {
+			return asRawFlags()
+		}
+
+		if strings.Contains(word, "=") {
+			p.RawFlags = append(p.RawFlags, word)
+			continue
+		}
+
+		isCluster := !strings.HasPrefix(word, "--") && len(word) > 2
+		hasNext := i+1 < len(words)
+		switch {
+		case s.valueFlags[word] && hasNext:
+			addFlag(p, word, words[i+1])
+			i++
+		case s.boolFlags[word] || isCluster || !hasNext:
+			addBoolFlag(p, word)
+		case strings.HasPrefix(words[i+1], "-") || words[i+1] == "--":
+			addBoolFlag(p, word)
+		default:
+			addFlag(p, word, words[i+1])
+			i++
+		}
+	}
+
+	return p, nil
+}
+
+// flagParameter creates the parameter for flag as written on the command line.
+// The name is the flag without its dashes, and the flag itself is only stored
+// when it is not the default `--name`.
+func flagParameter(flag string) *cliopatra.Parameter {
+	name := strings.TrimLeft(flag, "-")
+	ret := &cliopatra.Parameter{Name: name}
+	if flag != "--"+name {
+		ret.Flag = flag
+	}
+	return ret
+}
+
+func addBoolFlag(p *cliopatra.Program, flag string) {
+	f := flagParameter(flag)
+	f.Type = parameters.ParameterTypeBool
+	f.Value = true
+	f.NoValue = true
+	p.Flags = append(p.Flags, f)
+}
+
+func addFlag(p *cliopatra.Program, flag string, value string) {
+	f := flagParameter(flag)
+	f.Type = parameters.ParameterTypeString
+	f.Value = value
+	p.Flags = append(p.Flags, f)
+}
+
+func addArg(p *cliopatra.Program, value string) {
+	p.Args = append(p.Args, &cliopatra.Parameter{
+		Name:       fmt.Sprintf("arg%d", len(p.Args)+1),
+		Type:       parameters.ParameterTypeString,
+		Value:      value,
+		IsArgument: true,
+	})
+}
+
+// WriteProgram writes p as a YAML program file named after the program into dir,
+// creating dir if necessary, and returns the path of the file. The fields of spec
+// are written after the fields of the program.
+//
+// If dir is a repository that interpolates variables, `${` is escaped as `$${` in the
+// env entries, raw flags and values of p, so that the program is loaded as recorded.
+func WriteProgram(dir string, p *cliopatra.Program, spec *pkg.ProgramSpec, overwrite bool) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create directory %s", dir)
+	}
+
+	config, err := pkg.LoadRepositoryConfigFromFS(os.DirFS(dir))
+	if err != nil {
+		return "", err
+	}
+	if config.Interpolate {
+		p = escapeVariables(p)
+	}
+
+	path := filepath.Join(dir, filepath.Base(p.Name)+".yaml")
+	if !overwrite {
+		if _, err := os.Stat(path); err == nil {
+			return "", errors.Errorf("%s already exists", path)
+		}
+	}
+
+	var programNode, specNode yaml.Node
+	err = programNode.Encode(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not serialize program %s", p.Name)
+	}
+	if spec != nil {
+		err = specNode.Encode(spec)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not serialize program %s", p.Name)
+		}
+		programNode.Content = append(programNode.Content, specNode.Content...)
+	}
+
+	b, err := yaml.Marshal(&programNode)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not serialize program %s", p.Name)
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not write %s", path)
+	}
+
+	return path, nil
+}
+
+// escapeVariables returns a copy of p in which the `${` of the env entries, raw flags
+// and string values are escaped, see pkg.RepositoryConfig.Interpolate.
+func escapeVariables(p *cliopatra.Program) *cliopatra.Program {
+	escape := func(s string) string {
+		return strings.ReplaceAll(s, "${", "$${")
+	}
+
+	ret := p.Clone()
+	for k, v := range ret.Env {
+		ret.Env[k] = escape(v)
+	}
+	for i, f := range ret.RawFlags {
+		ret.RawFlags[i] = escape(f)
+	}
+	for _, param := range append(append([]*cliopatra.Parameter{}, ret.Flags...), ret.Args...) {
+		param.Raw = escape(param.Raw)
+		if v, ok := param.Value.(string); ok {
+			param.Value = escape(v)
+		}
+	}
+	return ret
+}
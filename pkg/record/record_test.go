@@ -0,0 +1,110 @@
+package record
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func computeArgs(t *testing.T, argv []string, options ...Option) []string {
+	p, err := NewProgramFromArgs("test", argv, options...)
+	require.NoError(t, err)
+	args, err := p.ComputeArgs(layers.NewParsedLayers().GetAllParsedParameters())
+	require.NoError(t, err)
+	return args
+}
+
+func TestNewProgramFromArgs(t *testing.T) {
+	p, err := NewProgramFromArgs("", []string{"glaze", "yaml", "--rename", "baz:blop", "-la", "--color=always", "data.yaml"}, WithVerbs(1))
+	require.NoError(t, err)
+	assert.Equal(t, "glaze", p.Name)
+	assert.Equal(t, "glaze", p.Path)
+	assert.Equal(t, []string{"yaml"}, p.Verbs)
+	assert.Equal(t, []string{"--color=always"}, p.RawFlags)
+	require.Len(t, p.Flags, 2)
+	assert.Equal(t, "rename", p.Flags[0].Name)
+	assert.Equal(t, "", p.Flags[0].Flag)
+	assert.Equal(t, "baz:blop", p.Flags[0].Value)
+	assert.Equal(t, "-la", p.Flags[1].Flag)
+	assert.True(t, p.Flags[1].NoValue)
+	require.Len(t, p.Args, 1)
+	assert.Equal(t, "data.yaml", p.Args[0].Value)
+
+	p, err = NewProgramFromArgs("", []string{"echo", "hello"})
+	require.NoError(t, err)
+	assert.Empty(t, p.Verbs)
+	require.Len(t, p.Args, 1)
+	assert.Equal(t, "hello", p.Args[0].Value)
+
+	_, err = NewProgramFromArgs("", []string{"git", "log"}, WithVerbs(2))
+	assert.Error(t, err)
+
+	p, err = NewProgramFromArgs("", []string{"git", "log", "--oneline", "src"}, WithVerbs(1), WithBoolFlags("--oneline"))
+	require.NoError(t, err)
+	require.Len(t, p.Flags, 1)
+	assert.True(t, p.Flags[0].NoValue)
+	require.Len(t, p.Args, 1)
+
+	p, err = NewProgramFromArgs("", []string{"jq", "-c", ".a"}, WithRawFlags(true))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-c", ".a"}, p.RawFlags)
+}
+
+func TestNewProgramFromArgsKeepsOrder(t *testing.T) {
+	for _, argv := range [][]string{
+		{"git", "-C", "dir", "log", "--oneline"},
+		{"ls", "-la", "/tmp"},
+		{"grep", "-i", "foo", "file.txt"},
+		{"cat", "--", "-weird-name"},
+		{"sort", "-", "-r"},
+	} {
+		assert.Equal(t, argv[1:], computeArgs(t, argv), argv)
+	}
+}
+
+func TestWriteProgram(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewProgramFromArgs("echo-hello", []string{"echo", "hello"})
+	require.NoError(t, err)
+	p.ExpectedStdout = "hello\n"
+
+	_, err = WriteProgram(dir, p, nil, false)
+	require.NoError(t, err)
+	_, err = WriteProgram(dir, p, nil, false)
+	assert.Error(t, err)
+
+	programs, err := pkg.LoadProgramsFromFS(os.DirFS(dir), ".")
+	require.NoError(t, err)
+	require.Len(t, programs, 1)
+	assert.Equal(t, "echo-hello", programs[0].Program().Name)
+	assert.Equal(t, "hello\n", programs[0].Program().ExpectedStdout)
+	assert.Equal(t, "hello", programs[0].Program().Args[0].Value)
+}
+
+func TestWriteProgramEscapesVariables(t *testing.T) {
+	argv := []string{"sh", "-c", `echo "[${NOPE_VAR}]"`}
+
+	for _, config := range []string{"", "interpolate: true\n"} {
+		dir := t.TempDir()
+		if config != "" {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, pkg.RepositoryConfigFileName), []byte(config), 0644))
+		}
+		p, err := NewProgramFromArgs("nope", argv, WithRawFlags(true))
+		require.NoError(t, err)
+		p.Env = map[string]string{"GREETING": "${HELLO}"}
+		_, err = WriteProgram(dir, p, nil, false)
+		require.NoError(t, err)
+
+		r := pkg.NewRepository([]string{dir})
+		require.NoError(t, r.Load())
+		rp, err := r.Lookup("nope")
+		require.NoError(t, err)
+		require.NoError(t, rp.Err(), config)
+		assert.Equal(t, argv[1:], rp.Program().RawFlags, config)
+		assert.Equal(t, "${HELLO}", rp.Program().Env["GREETING"], config)
+	}
+}
@@ -4,19 +4,27 @@ import (
 	"context"
 	"fmt"
 	"github.com/bmatcuk/doublestar/v4"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/explain"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
 	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
-	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
 	"github.com/go-go-golems/glazed/pkg/helpers/templating"
 	"github.com/pkg/errors"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
+// Repository provides the programs that templates can look up by name.
 type Repository interface {
-	GetPrograms() map[string]*cliopatra.Program
+	// LookupProgram returns the program called name. Repositories decide how names
+	// resolve, pkg.Repository for example accepts both qualified and short names.
+	LookupProgram(name string) (*cliopatra.Program, error)
 }
 
 // Renderer renders recursive templates by exposing cliopatra specific template functions.
@@ -33,6 +41,8 @@ type Renderer struct {
 	masks                []string
 	verbose              bool
 	renameOutputFiles    map[string]string
+	timeout              time.Duration
+	dryRun               bool
 }
 
 type Option func(r *Renderer)
@@ -91,6 +101,21 @@ func WithRenameOutputFiles(renameOutputFiles map[string]string) Option {
 	}
 }
 
+// WithTimeout sets the timeout of each program run from a template. 0 means no timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Renderer) {
+		r.timeout = timeout
+	}
+}
+
+// WithDryRun makes `run` return how the program would be run, as `explain` does,
+// instead of running it.
+func WithDryRun(dryRun bool) Option {
+	return func(r *Renderer) {
+		r.dryRun = dryRun
+	}
+}
+
 func NewRenderer(options ...Option) *Renderer {
 	r := &Renderer{
 		masks:   []string{},
@@ -107,22 +132,48 @@ func NewRenderer(options ...Option) *Renderer {
 
 type cliopatraTemplateOption func(p *cliopatra.Program) error
 
-func (r *Renderer) clioLookupProgram(name string) (*cliopatra.Program, error) {
+// repositoryProgramLookup is implemented by repositories whose programs are prepared
+// before being run, such as pkg.Repository, which resolves their paths against their
+// program file and runs hermetic programs in a temporary working directory.
+type repositoryProgramLookup interface {
+	Lookup(name string) (*pkg.RepositoryProgram, error)
+}
+
+// clioLookupProgram returns the program called name, along with the repository
+// program it is, if its repository implements repositoryProgramLookup.
+func (r *Renderer) clioLookupProgram(name string) (*cliopatra.Program, *pkg.RepositoryProgram, error) {
 	// NOTE(manuel, 2023-03-27) Not sure about the precedence rules for looking up programs in the templates.
 	// should we go through the fixed commands first? or through the repositories?
 	// and should we go through repositories in reverse order?
+	var lookupErr error
 	for _, repository := range r.repositories {
-		program, ok := repository.GetPrograms()[name]
-		if ok {
-			return program, nil
+		if l, ok := repository.(repositoryProgramLookup); ok {
+			rp, err := l.Lookup(name)
+			if err == nil {
+				return rp.Program(), rp, nil
+			}
+			if lookupErr == nil {
+				lookupErr = err
+			}
+			continue
+		}
+		program, err := repository.LookupProgram(name)
+		if err == nil {
+			return program, nil, nil
+		}
+		if lookupErr == nil {
+			lookupErr = err
 		}
 	}
 
 	program, ok := r.programs[name]
 	if !ok {
-		return nil, errors.Errorf("program %s not found", name)
+		if lookupErr != nil {
+			return nil, nil, lookupErr
+		}
+		return nil, nil, errors.Errorf("program %s not found", name)
 	}
-	return program, nil
+	return program, nil, nil
 }
 
 // CreateTemplate creates a standard glazed template (meaning, with all the sprig functions and co)
@@ -138,7 +189,8 @@ func (r *Renderer) clioLookupProgram(name string) (*cliopatra.Program, error) {
 //
 //   - `verbs`: sets the verbs of a program (a []string)
 //
-//   - `env`: sets the env of a program (a map[string]string)
+//   - `env`: sets environment variables of a program (a map[string]string), on top of
+//     the environment the program was loaded with
 //
 //   - `add_raw_flag`: adds a raw flag to a program (a string)
 //
@@ -155,16 +207,24 @@ func (r *Renderer) clioLookupProgram(name string) (*cliopatra.Program, error) {
 //   - `run`: runs a program and returns the output. It can take an arbitrary number of options.
 //
 //     If the program to be run is a string, it will be looked up in the programs passed to the
-//     renderer. If it is a *pkg.Program, it will be run as is.
+//     renderer. If it is a *pkg.Program, it will be run as is. Programs looked up in a
+//     pkg.Repository are run as `cliopatra run` runs them, with their paths resolved and
+//     their fixtures copied into a temporary working directory.
 //
 //     If a string is passed as an option, it will be appended to the program as a raw flag.
 //
 //     `run` clones the program before modifying it with the passed options.
-func (r *Renderer) CreateTemplate(name string) (*template.Template, error) {
+//     The program is run with ctx, and cancelled if it runs longer than the timeout of the renderer.
+//
+//   - `explain`: takes the same parameters as `run`, but returns the shell-quoted command line
+//     the program would be run with, its environment and stdin, and where the value of each of
+//     its parameters comes from, instead of running it.
+func (r *Renderer) CreateTemplate(ctx context.Context, name string) (*template.Template, error) {
 	t := templating.CreateTemplate(name).
 		Funcs(template.FuncMap{
 			"lookup": func(name string) (*cliopatra.Program, error) {
-				return r.clioLookupProgram(name)
+				p, _, err := r.clioLookupProgram(name)
+				return p, err
 			},
 			"program": func(name string, options ...interface{}) (*cliopatra.Program, error) {
 				if r.allowProgramCreation {
@@ -220,7 +280,12 @@ func (r *Renderer) CreateTemplate(name string) (*template.Template, error) {
 			},
 			"env": func(s map[string]string) cliopatraTemplateOption {
 				return func(p *cliopatra.Program) error {
-					p.Env = s
+					if p.Env == nil {
+						p.Env = map[string]string{}
+					}
+					for k, v := range s {
+						p.Env[k] = v
+					}
 					return nil
 				}
 			},
@@ -257,62 +322,21 @@ func (r *Renderer) CreateTemplate(name string) (*template.Template, error) {
 				}
 			},
 			"run": func(p interface{}, options ...interface{}) (string, error) {
-				var p_ *cliopatra.Program
-				var err error
-
-				switch p := p.(type) {
-				case *cliopatra.Program:
-					p_ = p
-				case string:
-					p_, err = r.clioLookupProgram(p)
-					if err != nil {
-						if r.allowProgramCreation {
-							p_ = &cliopatra.Program{
-								Name: p,
-							}
-						} else {
-							return "", err
-						}
-					}
-				default:
-					return "", errors.Errorf("invalid program type: %T", p)
-				}
-
-				p_ = p_.Clone()
-
-				options_ := []cliopatraTemplateOption{}
-
-				for _, option := range options {
-					switch option := option.(type) {
-					case cliopatraTemplateOption:
-						options_ = append(options_, option)
-
-					case string:
-						// NOTE(manuel, 2023-03-18) What we really want here is to actually do proper flag parsing
-						options_ = append(options_, func(p *cliopatra.Program) error {
-							p.AddRawFlag(option)
-							return nil
-						})
-					}
+				p_, original, rp, err := r.resolveProgram(p, options)
+				if err != nil {
+					return "", err
 				}
-
-				for _, option := range options_ {
-					err := option(p_)
-					if err != nil {
-						return "", err
-					}
+				if r.dryRun {
+					return r.explain(p_, original, rp)
 				}
-
-				parsedLayers := layers.NewParsedLayers()
-				buf := strings.Builder{}
-
-				ctx := context.Background()
-				err = p_.RunIntoWriter(ctx, parsedLayers, &buf)
+				return r.run(ctx, p_, rp)
+			},
+			"explain": func(p interface{}, options ...interface{}) (string, error) {
+				p_, original, rp, err := r.resolveProgram(p, options)
 				if err != nil {
 					return "", err
 				}
-
-				return buf.String(), nil
+				return r.explain(p_, original, rp)
 			},
 		})
 
@@ -326,13 +350,156 @@ func (r *Renderer) CreateTemplate(name string) (*template.Template, error) {
 	return t, nil
 }
 
+// resolveProgram returns a clone of the program p, either a *cliopatra.Program or the
+// name of a program, modified by the template options, along with the program before
+// modification and the repository program it was looked up as, if any.
+func (r *Renderer) resolveProgram(p interface{}, options []interface{}) (*cliopatra.Program, *cliopatra.Program, *pkg.RepositoryProgram, error) {
+	var original *cliopatra.Program
+	var rp *pkg.RepositoryProgram
+	var err error
+
+	switch p := p.(type) {
+	case *cliopatra.Program:
+		original = p
+	case string:
+		original, rp, err = r.clioLookupProgram(p)
+		if err != nil {
+			if r.allowProgramCreation {
+				original = &cliopatra.Program{
+					Name: p,
+				}
+			} else {
+				return nil, nil, nil, err
+			}
+		}
+	default:
+		return nil, nil, nil, errors.Errorf("invalid program type: %T", p)
+	}
+
+	p_ := original.Clone()
+
+	options_ := []cliopatraTemplateOption{}
+
+	for _, option := range options {
+		switch option := option.(type) {
+		case cliopatraTemplateOption:
+			options_ = append(options_, option)
+
+		case string:
+			// NOTE(manuel, 2023-03-18) What we really want here is to actually do proper flag parsing
+			options_ = append(options_, func(p *cliopatra.Program) error {
+				p.AddRawFlag(option)
+				return nil
+			})
+		}
+	}
+
+	for _, option := range options_ {
+		err := option(p_)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return p_, original, rp, nil
+}
+
+// run runs p and returns its stdout and stderr, merged. A non-zero exit code is an
+// error. p is prepared as rp, the repository program it was looked up as, if any.
+func (r *Renderer) run(ctx context.Context, p *cliopatra.Program, rp *pkg.RepositoryProgram) (string, error) {
+	options := []runner.Option{runner.WithTimeout(r.timeout)}
+	if rp != nil {
+		var workdir *runner.Workdir
+		var err error
+		p, workdir, err = rp.WithProgram(p).PrepareRun(false)
+		if err != nil {
+			return "", err
+		}
+		if workdir != nil {
+			defer func() {
+				_ = workdir.Close()
+			}()
+			options = append(options, runner.WithDir(workdir.Path))
+		}
+	}
+
+	w := &syncWriter{w: &strings.Builder{}}
+	options = append(options, runner.WithOutputWriters(w, w))
+	output, err := runner.NewRunner(options...).Run(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	if output.ExitCode != 0 {
+		return "", errors.Errorf("could not run %s: exit status %d", p.Name, output.ExitCode)
+	}
+	return w.w.String(), nil
+}
+
+// syncWriter serializes the writes of stdout and stderr, which are copied concurrently.
+type syncWriter struct {
+	mu sync.Mutex
+	w  *strings.Builder
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
+
+// parameterLogRepository is implemented by repositories that know the provenance
+// of the parameters of their programs, such as pkg.Repository.
+type parameterLogRepository interface {
+	GetParameterLog(program string, parameter string) []*parameters.ParseStep
+}
+
+// explain describes how p would be run, attributing the parameters that differ from
+// original to the template. The program of rp, if any, is planned as it would be run,
+// with its paths resolved, and so is original.
+func (r *Renderer) explain(p *cliopatra.Program, original *cliopatra.Program, rp *pkg.RepositoryProgram) (string, error) {
+	options := []explain.Option{
+		explain.WithLog(func(name string) []*parameters.ParseStep {
+			for _, repository := range r.repositories {
+				if l, ok := repository.(parameterLogRepository); ok {
+					if log := l.GetParameterLog(p.Name, name); log != nil {
+						return log
+					}
+				}
+			}
+			return nil
+		}),
+	}
+	if rp != nil {
+		var hermetic bool
+		var err error
+		p, hermetic, err = rp.WithProgram(p).PlanRun()
+		if err != nil {
+			return "", err
+		}
+		original, _, err = rp.PlanRun()
+		if err != nil {
+			return "", err
+		}
+		if hermetic {
+			options = append(options, explain.WithPlannedDir("a new temporary directory"))
+		}
+	}
+	options = append(options, explain.WithRecorded(original, "template"))
+
+	e, err := explain.Explain(p, options...)
+	if err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
 // NOTE(manuel, 2023-03-18) We should pass in the location of the template file
 // This is so that we can provide a way to lookup program files relative to the
 // template file. This could actually be done in the renderer itself with an option,
 // come to think of it.
 
 // Render renders the template from the given reader and writes the result to the given writer.
-func (r *Renderer) Render(in io.Reader, out io.Writer) error {
+func (r *Renderer) Render(ctx context.Context, in io.Reader, out io.Writer) error {
 	// create template from stream
 	if r.withGoTemplate {
 		// read string
@@ -341,7 +508,7 @@ func (r *Renderer) Render(in io.Reader, out io.Writer) error {
 			return err
 		}
 
-		t, err := r.CreateTemplate("template")
+		t, err := r.CreateTemplate(ctx, "template")
 		if err != nil {
 			return err
 		}
@@ -379,7 +546,7 @@ func (r *Renderer) checkMasks(file string) (bool, error) {
 	return false, nil
 }
 
-func (r *Renderer) RenderFile(file string, outputFile string) error {
+func (r *Renderer) RenderFile(ctx context.Context, file string, outputFile string) error {
 	for k, v := range r.renameOutputFiles {
 		if strings.HasSuffix(outputFile, k) {
 			outputFile = strings.TrimSuffix(outputFile, k) + v
@@ -414,11 +581,16 @@ func (r *Renderer) RenderFile(file string, outputFile string) error {
 		fmt.Printf("Rendering %s -> %s\n", file, outputFile)
 	}
 
-	err = r.Render(f, w)
+	err = r.Render(ctx, f, w)
 	return err
 }
 
-func (r *Renderer) recursiveRenderDirectory(currentDirectory string, baseDirectory string, outputDirectory string) error {
+func (r *Renderer) recursiveRenderDirectory(
+	ctx context.Context,
+	currentDirectory string,
+	baseDirectory string,
+	outputDirectory string,
+) error {
 	err := filepath.Walk(currentDirectory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -429,7 +601,7 @@ func (r *Renderer) recursiveRenderDirectory(currentDirectory string, baseDirecto
 		}
 
 		if info.IsDir() {
-			return r.recursiveRenderDirectory(path, baseDirectory, outputDirectory)
+			return r.recursiveRenderDirectory(ctx, path, baseDirectory, outputDirectory)
 		}
 
 		ok, err := r.checkMasks(path)
@@ -452,18 +624,18 @@ func (r *Renderer) recursiveRenderDirectory(currentDirectory string, baseDirecto
 			return err
 		}
 
-		return r.RenderFile(path, outputFile)
+		return r.RenderFile(ctx, path, outputFile)
 	})
 
 	return err
 }
 
-func (r *Renderer) RenderDirectory(directory string, outputDirectory string) error {
+func (r *Renderer) RenderDirectory(ctx context.Context, directory string, outputDirectory string) error {
 	if !strings.HasSuffix(directory, "/") {
 		directory += "/"
 	}
 
-	return r.recursiveRenderDirectory(directory, directory, outputDirectory)
+	return r.recursiveRenderDirectory(ctx, directory, directory, outputDirectory)
 }
 
 // ComputeBaseDirectory computes the base directory for the given file.
@@ -1,7 +1,16 @@
 package render
 
 import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -47,3 +56,81 @@ func TestComputeBaseDirectoryWithBase(t *testing.T) {
 	s = ComputeBaseDirectory("foobar/foo/test.txt", []string{"foobar/foo/", "foo/"}, "foobar")
 	assert.Equal(t, "foobar", s)
 }
+
+type testRepository struct {
+	programs map[string]*cliopatra.Program
+}
+
+func (t *testRepository) LookupProgram(name string) (*cliopatra.Program, error) {
+	p, ok := t.programs[name]
+	if !ok {
+		return nil, errors.Errorf("program %s not found", name)
+	}
+	return p, nil
+}
+
+func (t *testRepository) GetParameterLog(program string, parameter string) []*parameters.ParseStep {
+	if program == "greet" && parameter == "greeting" {
+		return []*parameters.ParseStep{{Source: "cobra", Value: "hello"}}
+	}
+	return nil
+}
+
+func TestRenderExplain(t *testing.T) {
+	repository := &testRepository{
+		programs: map[string]*cliopatra.Program{
+			"greet": cliopatra.NewProgram(
+				cliopatra.WithName("greet"),
+				cliopatra.WithPath("echo"),
+				cliopatra.WithFlags(&cliopatra.Parameter{Name: "greeting", Type: parameters.ParameterTypeString, Value: "hello"}),
+			),
+		},
+	}
+
+	template := `{{ explain "greet" (flag "greeting" "hi there") }}`
+	for _, r := range []*Renderer{
+		NewRenderer(WithRepositories(repository), WithGoTemplate(true)),
+		NewRenderer(WithRepositories(repository), WithGoTemplate(true), WithDryRun(true)),
+	} {
+		out := &strings.Builder{}
+		err := r.Render(context.Background(), strings.NewReader(template), out)
+		require.NoError(t, err)
+		assert.Contains(t, out.String(), "echo --greeting 'hi there'\n")
+		assert.Contains(t, out.String(), "source: template (recorded: hello)\n")
+		assert.Contains(t, out.String(), `cobra: "hello"`)
+	}
+
+	out := &strings.Builder{}
+	r := NewRenderer(WithRepositories(repository), WithGoTemplate(true), WithDryRun(true))
+	err := r.Render(context.Background(), strings.NewReader(`{{ run "greet" }}`), out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "command:\n  ")
+	assert.Contains(t, out.String(), "echo --greeting hello\n")
+}
+
+func TestRenderRunsRepositoryPrograms(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"cat.yaml":  "name: cat\npath: cat\nargs: [{name: file, type: string, value: input.txt}]\n",
+		"input.txt": "hello\n",
+		"sh.yaml":   "name: sh\npath: sh\nfixtures: [data.txt]\nrawFlags: [-c, 'cat data.txt; ls']\n",
+		"data.txt":  "data\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	repository := pkg.NewRepository([]string{dir})
+	require.NoError(t, repository.Load())
+
+	r := NewRenderer(WithRepositories(repository), WithGoTemplate(true))
+	out := &strings.Builder{}
+	err := r.Render(context.Background(), strings.NewReader(`{{ run "cat" }}{{ run "sh" }}`), out)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\ndata\ndata.txt\n", out.String())
+
+	r = NewRenderer(WithRepositories(repository), WithGoTemplate(true), WithDryRun(true))
+	out = &strings.Builder{}
+	err = r.Render(context.Background(), strings.NewReader(`{{ run "cat" }}`), out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), filepath.Join(dir, "input.txt"))
+	assert.NotContains(t, out.String(), "source: template")
+}
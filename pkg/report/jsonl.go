@@ -0,0 +1,88 @@
+package report
+
+import (
+	"encoding/json"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"io"
+)
+
+// JSONLReporter writes one JSON object per line: a result event for every program
+// as soon as it is added, and a summary event when the reporter is closed.
+type JSONLReporter struct {
+	encoder *json.Encoder
+	counts  map[golden.Status]int
+	total   int
+}
+
+func NewJSONLReporter(w io.Writer) *JSONLReporter {
+	return &JSONLReporter{
+		encoder: json.NewEncoder(w),
+		counts:  map[golden.Status]int{},
+	}
+}
+
+type jsonlCheck struct {
+	Name   string        `json:"name"`
+	Status golden.Status `json:"status"`
+	Diff   string        `json:"diff,omitempty"`
+}
+
+type jsonlResultEvent struct {
+	Event      string        `json:"event"`
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Suite      string        `json:"suite"`
+	Status     golden.Status `json:"status"`
+	DurationMs int64         `json:"duration_ms"`
+	Checks     []*jsonlCheck `json:"checks,omitempty"`
+	ExitCode   *int          `json:"exit_code,omitempty"`
+	Stdout     string        `json:"stdout,omitempty"`
+	Stderr     string        `json:"stderr,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+type jsonlSummaryEvent struct {
+	Event  string                `json:"event"`
+	Total  int                   `json:"total"`
+	Counts map[golden.Status]int `json:"counts"`
+}
+
+func (j *JSONLReporter) AddResult(res *golden.Result) error {
+	j.total++
+	j.counts[res.Status]++
+
+	e := &jsonlResultEvent{
+		Event:      "result",
+		Name:       res.Name,
+		Path:       res.Path,
+		Suite:      suiteName(res),
+		Status:     res.Status,
+		DurationMs: res.Duration.Milliseconds(),
+		Stdout:     stdout(res),
+		Stderr:     stderr(res),
+	}
+	if res.Output != nil {
+		exitCode := res.Output.ExitCode
+		e.ExitCode = &exitCode
+	}
+	if res.Err != nil {
+		e.Error = res.Err.Error()
+	}
+	for _, c := range res.Checks {
+		e.Checks = append(e.Checks, &jsonlCheck{
+			Name:   c.Name,
+			Status: c.Status,
+			Diff:   c.Diff,
+		})
+	}
+
+	return j.encoder.Encode(e)
+}
+
+func (j *JSONLReporter) Close() error {
+	return j.encoder.Encode(&jsonlSummaryEvent{
+		Event:  "summary",
+		Total:  j.total,
+		Counts: j.counts,
+	})
+}
@@ -0,0 +1,144 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"io"
+	"sort"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Errors   int               `xml:"errors,attr"`
+	Skipped  int               `xml:"skipped,attr"`
+	Time     string            `xml:"time,attr"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Errors    int              `xml:"errors,attr"`
+	Skipped   int              `xml:"skipped,attr"`
+	Time      string           `xml:"time,attr"`
+	TestCases []*junitTestCase `xml:"testcase"`
+
+	duration time.Duration
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+// JUnitReporter writes a JUnit XML report. Each program is a test case, grouped
+// in test suites by the directory of the program file.
+//
+// The report is written when the reporter is closed.
+type JUnitReporter struct {
+	w      io.Writer
+	suites map[string]*junitTestSuite
+}
+
+func NewJUnitReporter(w io.Writer) *JUnitReporter {
+	return &JUnitReporter{
+		w:      w,
+		suites: map[string]*junitTestSuite{},
+	}
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func (j *JUnitReporter) AddResult(res *golden.Result) error {
+	name := suiteName(res)
+	suite, ok := j.suites[name]
+	if !ok {
+		suite = &junitTestSuite{Name: name}
+		j.suites[name] = suite
+	}
+
+	tc := &junitTestCase{
+		Name:      testName(res),
+		ClassName: name,
+		File:      res.Path,
+		Time:      formatSeconds(res.Duration),
+		SystemOut: stdout(res),
+		SystemErr: stderr(res),
+	}
+
+	switch {
+	case isFailure(res):
+		tc.Failure = &junitMessage{
+			Message: failureMessage(res),
+			Body:    failureDetails(res),
+		}
+		suite.Failures++
+	case isError(res):
+		tc.Error = &junitMessage{Message: res.Err.Error()}
+		suite.Errors++
+	case isSkipped(res):
+		tc.Skipped = &junitMessage{Message: "no expectations declared"}
+		suite.Skipped++
+	}
+
+	suite.Tests++
+	suite.duration += res.Duration
+	suite.TestCases = append(suite.TestCases, tc)
+
+	return nil
+}
+
+func (j *JUnitReporter) Close() error {
+	ret := &junitTestSuites{}
+
+	names := make([]string, 0, len(j.suites))
+	for name := range j.suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var total time.Duration
+	for _, name := range names {
+		suite := j.suites[name]
+		suite.Time = formatSeconds(suite.duration)
+		ret.Tests += suite.Tests
+		ret.Failures += suite.Failures
+		ret.Errors += suite.Errors
+		ret.Skipped += suite.Skipped
+		total += suite.duration
+		ret.Suites = append(ret.Suites, suite)
+	}
+	ret.Time = formatSeconds(total)
+
+	_, err := io.WriteString(j.w, xml.Header)
+	if err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(j.w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(ret)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(j.w, "\n")
+	return err
+}
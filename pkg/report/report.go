@@ -0,0 +1,125 @@
+// Package report writes the results of golden test runs in formats that can be
+// consumed by CI systems: JUnit XML, TAP and a JSON-lines event stream.
+package report
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"github.com/pkg/errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatJUnit Format = "junit"
+	FormatTAP   Format = "tap"
+	FormatJSONL Format = "jsonl"
+)
+
+// Reporter receives the results of a test run one by one.
+//
+// Close has to be called once all results have been added, as some formats
+// can only be written out once all the results are known.
+type Reporter interface {
+	AddResult(res *golden.Result) error
+	Close() error
+}
+
+func NewReporter(format Format, w io.Writer) (Reporter, error) {
+	switch format {
+	case FormatJUnit:
+		return NewJUnitReporter(w), nil
+	case FormatTAP:
+		return NewTAPReporter(w), nil
+	case FormatJSONL:
+		return NewJSONLReporter(w), nil
+	default:
+		return nil, errors.Errorf("unknown report format %s", format)
+	}
+}
+
+// MultiReporter dispatches results to multiple reporters.
+type MultiReporter []Reporter
+
+func (m MultiReporter) AddResult(res *golden.Result) error {
+	for _, r := range m {
+		if err := r.AddResult(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MultiReporter) Close() error {
+	for _, r := range m {
+		if err := r.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testName returns the name of the test case of a result, the qualified name of the
+// program, since programs of different repositories can have the same name.
+func testName(res *golden.Result) string {
+	if res.QualifiedName != "" {
+		return res.QualifiedName
+	}
+	return res.Name
+}
+
+// suiteName returns the name of the test suite of a result, which is the directory
+// the program file is stored in.
+func suiteName(res *golden.Result) string {
+	return filepath.Dir(res.Path)
+}
+
+func isFailure(res *golden.Result) bool {
+	return res.Status == golden.StatusFail
+}
+
+func isError(res *golden.Result) bool {
+	return res.Status == golden.StatusError
+}
+
+func isSkipped(res *golden.Result) bool {
+	return res.Status == golden.StatusSkip
+}
+
+// failureMessage lists the failed expectations of a result.
+func failureMessage(res *golden.Result) string {
+	names := []string{}
+	for _, c := range res.FailedChecks() {
+		names = append(names, c.Name)
+	}
+	return "failed expectations: " + strings.Join(names, ", ")
+}
+
+// failureDetails concatenates the diffs of the failed expectations of a result.
+func failureDetails(res *golden.Result) string {
+	sb := &strings.Builder{}
+	for _, c := range res.FailedChecks() {
+		sb.WriteString("== " + c.Name + "\n")
+		sb.WriteString(c.Diff)
+		if !strings.HasSuffix(c.Diff, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func stdout(res *golden.Result) string {
+	if res.Output == nil {
+		return ""
+	}
+	return res.Output.Stdout
+}
+
+func stderr(res *golden.Result) string {
+	if res.Output == nil {
+		return ""
+	}
+	return res.Output.Stderr
+}
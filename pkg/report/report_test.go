@@ -0,0 +1,75 @@
+package report
+
+import (
+	"bytes"
+	"errors"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func testResults() []*golden.Result {
+	return []*golden.Result{
+		{
+			Name:          "foo",
+			QualifiedName: "repo/sqleton/foo",
+			Path:          "repo/sqleton/foo.yaml",
+			Status:        golden.StatusFail,
+			Duration:      1500 * time.Millisecond,
+			Output:        &runner.Output{Stdout: "foo\n", ExitCode: 1},
+			Checks: []*golden.Check{
+				{Name: "exit-code", Status: golden.StatusFail, Diff: "expected 0, got 1"},
+				{Name: "stdout", Status: golden.StatusPass},
+			},
+		},
+		{
+			Name:   "bar",
+			Path:   "repo/glaze/bar.yaml",
+			Status: golden.StatusError,
+			Err:    errors.New("could not run bar"),
+		},
+		{
+			Name:   "baz",
+			Path:   "repo/glaze/baz.yaml",
+			Status: golden.StatusSkip,
+		},
+	}
+}
+
+func runReporter(t *testing.T, format Format) string {
+	buf := &bytes.Buffer{}
+	r, err := NewReporter(format, buf)
+	require.NoError(t, err)
+	for _, res := range testResults() {
+		require.NoError(t, r.AddResult(res))
+	}
+	require.NoError(t, r.Close())
+	return buf.String()
+}
+
+func TestJUnitReporter(t *testing.T) {
+	s := runReporter(t, FormatJUnit)
+	assert.Contains(t, s, `<testsuites tests="3" failures="1" errors="1" skipped="1" time="1.500">`)
+	assert.Contains(t, s, `<testsuite name="repo/glaze" tests="2" failures="0" errors="1" skipped="1" time="0.000">`)
+	assert.Contains(t, s, `<failure message="failed expectations: exit-code">== exit-code&#xA;expected 0, got 1&#xA;</failure>`)
+	assert.Contains(t, s, `<error message="could not run bar"></error>`)
+	assert.Contains(t, s, `<system-out>foo&#xA;</system-out>`)
+	assert.Contains(t, s, `<testcase name="repo/sqleton/foo" classname="repo/sqleton"`)
+	assert.Contains(t, s, `<testcase name="bar" classname="repo/glaze"`)
+}
+
+func TestTAPReporter(t *testing.T) {
+	s := runReporter(t, FormatTAP)
+	assert.Contains(t, s, "TAP version 13\nnot ok 1 - repo/sqleton/foo\n  ---\n  file: repo/sqleton/foo.yaml\n  duration_ms: 1500\n")
+	assert.Contains(t, s, "not ok 2 - bar\n")
+	assert.Contains(t, s, "ok 3 - baz # SKIP no expectations declared\n1..3\n")
+}
+
+func TestJSONLReporter(t *testing.T) {
+	s := runReporter(t, FormatJSONL)
+	assert.Contains(t, s, `{"event":"result","name":"foo","path":"repo/sqleton/foo.yaml","suite":"repo/sqleton","status":"fail","duration_ms":1500,`)
+	assert.Contains(t, s, `{"event":"summary","total":3,"counts":{"error":1,"fail":1,"skip":1}}`)
+}
@@ -0,0 +1,97 @@
+package report
+
+import (
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg/golden"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strings"
+)
+
+// TAPReporter writes a TAP version 13 stream. Each program is a test point,
+// with its timing, failed expectations and outputs in a YAML diagnostic block.
+//
+// Since the number of programs is not known upfront, the plan is written at the end.
+type TAPReporter struct {
+	w     io.Writer
+	count int
+}
+
+func NewTAPReporter(w io.Writer) *TAPReporter {
+	return &TAPReporter{w: w}
+}
+
+type tapDiagnostic struct {
+	File       string            `yaml:"file"`
+	DurationMs int64             `yaml:"duration_ms"`
+	Message    string            `yaml:"message,omitempty"`
+	Diffs      map[string]string `yaml:"diffs,omitempty"`
+	Stdout     string            `yaml:"stdout,omitempty"`
+	Stderr     string            `yaml:"stderr,omitempty"`
+}
+
+func (t *TAPReporter) AddResult(res *golden.Result) error {
+	if t.count == 0 {
+		_, err := fmt.Fprintln(t.w, "TAP version 13")
+		if err != nil {
+			return err
+		}
+	}
+	t.count++
+
+	status := "ok"
+	if isFailure(res) || isError(res) {
+		status = "not ok"
+	}
+	line := fmt.Sprintf("%s %d - %s", status, t.count, testName(res))
+	if isSkipped(res) {
+		line += " # SKIP no expectations declared"
+	}
+	_, err := fmt.Fprintln(t.w, line)
+	if err != nil {
+		return err
+	}
+
+	d := &tapDiagnostic{
+		File:       res.Path,
+		DurationMs: res.Duration.Milliseconds(),
+		Stdout:     stdout(res),
+		Stderr:     stderr(res),
+	}
+	switch {
+	case isFailure(res):
+		d.Message = failureMessage(res)
+		d.Diffs = map[string]string{}
+		for _, c := range res.FailedChecks() {
+			d.Diffs[c.Name] = c.Diff
+		}
+	case isError(res):
+		d.Message = res.Err.Error()
+	case isSkipped(res):
+		return nil
+	}
+
+	b, err := yaml.Marshal(d)
+	if err != nil {
+		return err
+	}
+	sb := &strings.Builder{}
+	sb.WriteString("  ---\n")
+	for _, l := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		sb.WriteString("  " + l + "\n")
+	}
+	sb.WriteString("  ...\n")
+	_, err = io.WriteString(t.w, sb.String())
+	return err
+}
+
+func (t *TAPReporter) Close() error {
+	if t.count == 0 {
+		_, err := fmt.Fprintln(t.w, "TAP version 13")
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(t.w, "1..%d\n", t.count)
+	return err
+}
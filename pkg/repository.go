@@ -3,7 +3,9 @@ package pkg
 import (
 	"context"
 	"github.com/go-go-golems/clay/pkg/watcher"
+	"github.com/go-go-golems/cliopatra/pkg/normalize"
 	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"io/fs"
@@ -11,16 +13,124 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
-type repositoryProgram struct {
-	fs_     fs.FS
+// RepositoryProgram is a program loaded from a repository, along with the path
+// of the file it was loaded from.
+type RepositoryProgram struct {
+	// fs_ is the filesystem of programs loaded from a source that is not on disk.
+	// Otherwise, path is the path of the program file on disk.
+	fs_ fs.FS
+	// fsPath is the path of the program file relative to its source.
+	fsPath  string
 	path    string
+	root    string
 	program *cliopatra.Program
+	spec    *ProgramSpec
+	config  *RepositoryConfig
+	log     map[string][]*parameters.ParseStep
+	// namespace is the first component of the qualified name
+	namespace string
+	// err keeps the program from running, see Err
+	err error
 }
 
-func LoadProgramsFromFS(f fs.FS, dir string) ([]*repositoryProgram, error) {
-	programs := []*repositoryProgram{}
+func (rp *RepositoryProgram) Path() string {
+	return rp.path
+}
+
+// Err returns the error that keeps the program from running, such as a reference to
+// a variable that is not set. Such programs are loaded nevertheless, so that running
+// or testing them fails instead of silently leaving them out.
+func (rp *RepositoryProgram) Err() error {
+	return rp.err
+}
+
+// IsOnDisk returns true if Path is the path of the program file on disk, and false for
+// programs loaded from a source such as an embed.FS.
+func (rp *RepositoryProgram) IsOnDisk() bool {
+	return rp.fs_ == nil
+}
+
+// ReadProgramFile returns the content of the program file, from disk or from its source.
+func (rp *RepositoryProgram) ReadProgramFile() ([]byte, error) {
+	if rp.fs_ != nil {
+		return fs.ReadFile(rp.fs_, rp.fsPath)
+	}
+	return os.ReadFile(rp.path)
+}
+
+// RelativePath returns the path of the program file relative to the directory of
+// its repository, or the path itself if it wasn't loaded from a repository.
+func (rp *RepositoryProgram) RelativePath() string {
+	if rp.root == "" {
+		return rp.path
+	}
+	return rp.fsPath
+}
+
+// CommandPath returns the names of the nested subcommands under which the program is
+// exposed, ending with the name of the program itself. Depending on the CommandNesting
+// of its repository, programs are grouped by the directory of their program file
+// or by their verbs.
+func (rp *RepositoryProgram) CommandPath() []string {
+	ret := []string{}
+	if rp.config != nil && rp.config.CommandNesting == CommandNestingVerbs {
+		ret = append(ret, rp.program.Verbs...)
+	} else if dir := filepath.Dir(rp.RelativePath()); rp.root != "" && dir != "." {
+		ret = append(ret, strings.Split(filepath.ToSlash(dir), "/")...)
+	}
+	return append(ret, rp.program.Name)
+}
+
+// HasProfile returns true if the repository of the program declares the environment
+// profile name.
+func (rp *RepositoryProgram) HasProfile(name string) bool {
+	return rp.config != nil && rp.config.HasProfile(name)
+}
+
+func (rp *RepositoryProgram) Program() *cliopatra.Program {
+	return rp.program
+}
+
+func (rp *RepositoryProgram) Spec() *ProgramSpec {
+	return rp.spec
+}
+
+// Normalizers returns the normalization filters of the repository, followed by the
+// filters of the program itself.
+func (rp *RepositoryProgram) Normalizers() normalize.Pipeline {
+	ret := normalize.Pipeline{}
+	if rp.config != nil {
+		ret = append(ret, rp.config.Normalize...)
+	}
+	return append(ret, rp.spec.Normalize...)
+}
+
+// IsWorkflowFile returns true if name is the name of a workflow file, such as
+// export-orders.workflow.yaml. Workflow files live next to program files, but are
+// not loaded as programs.
+func IsWorkflowFile(name string) bool {
+	return strings.HasSuffix(name, ".workflow.yaml") || strings.HasSuffix(name, ".workflow.yml")
+}
+
+// IsProgramFile returns true if name is the name of a program file.
+func IsProgramFile(name string) bool {
+	if IsWorkflowFile(name) {
+		return false
+	}
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
+func LoadProgramsFromFS(f fs.FS, dir string) ([]*RepositoryProgram, error) {
+	return loadProgramsFromFS(f, dir, nil)
+}
+
+// loadProgramsFromFS is LoadProgramsFromFS calling onError with the program files that
+// can't be loaded instead of failing, if it is not nil.
+func loadProgramsFromFS(f fs.FS, dir string, onError func(path string, err error)) ([]*RepositoryProgram, error) {
+	programs := []*RepositoryProgram{}
 
 	entries, err := fs.ReadDir(f, dir)
 	if err != nil {
@@ -33,7 +143,7 @@ func LoadProgramsFromFS(f fs.FS, dir string) ([]*repositoryProgram, error) {
 
 		fileName := filepath.Join(dir, entry.Name())
 		if entry.IsDir() {
-			programs_, err := LoadProgramsFromFS(f, fileName)
+			programs_, err := loadProgramsFromFS(f, fileName, onError)
 			if err != nil {
 				return nil, errors.Wrapf(err, "could not load programs from dir %s", fileName)
 			}
@@ -41,8 +151,7 @@ func LoadProgramsFromFS(f fs.FS, dir string) ([]*repositoryProgram, error) {
 			continue
 		}
 
-		if strings.HasSuffix(entry.Name(), ".yaml") ||
-			strings.HasSuffix(entry.Name(), ".yml") {
+		if IsProgramFile(entry.Name()) {
 			file, err := f.Open(fileName)
 			if err != nil {
 				return nil, errors.Wrapf(err, "could not open file %s", fileName)
@@ -52,138 +161,437 @@ func LoadProgramsFromFS(f fs.FS, dir string) ([]*repositoryProgram, error) {
 				_ = file.Close()
 			}()
 
-			program, err := cliopatra.NewProgramFromYAML(file)
+			rp, err := NewRepositoryProgramFromYAML(file, fileName)
+			if err != nil && onError != nil {
+				onError(fileName, err)
+				continue
+			}
 			if err != nil {
 				return nil, errors.Wrapf(err, "could not load program from file %s", fileName)
 			}
+			rp.fs_ = f
 
-			programs = append(programs, &repositoryProgram{
-				fs_:     f,
-				path:    fileName,
-				program: program,
-			})
+			programs = append(programs, rp)
 		}
 	}
 
 	return programs, nil
 }
 
+// Repository loads the programs of a list of sources, usually repository directories.
+//
+// Programs are addressed by their qualified name, or by their short name as long as
+// it is unique. The sources are listed in order of precedence, see programIndex.
 type Repository struct {
-	repositoryPrograms map[string]*repositoryProgram
-	pathsToProgramName map[string]string
-	lock               sync.RWMutex
-	directories        []string
+	// programs are all the loaded programs, by path
+	programs map[string]*RepositoryProgram
+	index    *programIndex
+	lock     sync.RWMutex
+	sources  []*Source
+	// configs are the configurations of the sources, by name
+	configs map[string]*RepositoryConfig
+	profile string
+	env     map[string]string
+
+	subscriptions []*subscription
+	// notifyLock is held from applying a change to delivering its event, so that
+	// changes are applied and handled one at a time, in order. It is acquired before
+	// lock.
+	notifyLock      sync.Mutex
+	renameWindow    time.Duration
+	pendingRemovals map[string]*pendingRemoval
+	onLoadError     func(path string, err error)
+}
+
+type RepositoryOption func(r *Repository)
+
+// WithProfile selects the environment profile the programs are resolved with, see
+// RepositoryProgram.WithEnvironment. At least one repository has to declare it.
+func WithProfile(profile string) RepositoryOption {
+	return func(r *Repository) {
+		r.profile = profile
+	}
+}
+
+// WithEnv sets environment variables on top of the environment of all the programs.
+func WithEnv(env map[string]string) RepositoryOption {
+	return func(r *Repository) {
+		r.env = env
+	}
+}
+
+// WithLoadErrorHandler makes Load skip the program files that can't be loaded, and
+// report them to handler with their path instead of failing.
+//
+// Programs whose environment can't be computed, for example because they refer to a
+// variable that is not set, are loaded with that error as their Err.
+func WithLoadErrorHandler(handler func(path string, err error)) RepositoryOption {
+	return func(r *Repository) {
+		r.onLoadError = handler
+	}
+}
+
+// NewRepository returns a repository loading the programs of directories.
+func NewRepository(directories []string, options ...RepositoryOption) *Repository {
+	sources := make([]*Source, len(directories))
+	for i, d := range directories {
+		sources[i] = NewDirSource(d)
+	}
+	return NewRepositoryFromSources(sources, options...)
+}
+
+// NewRepositoryFromSources returns a repository loading the programs of sources,
+// for example to ship a collection of programs embedded into a tool.
+func NewRepositoryFromSources(sources []*Source, options ...RepositoryOption) *Repository {
+	ret := &Repository{
+		programs:        map[string]*RepositoryProgram{},
+		sources:         sources,
+		configs:         map[string]*RepositoryConfig{},
+		renameWindow:    DefaultRenameWindow,
+		pendingRemovals: map[string]*pendingRemoval{},
+	}
+	ret.index = newProgramIndex(nil, ret.sourceNames())
+	for _, option := range options {
+		option(ret)
+	}
+	return ret
+}
+
+// Sources returns the sources of the repository, in order of precedence.
+func (r *Repository) Sources() []*Source {
+	return append([]*Source{}, r.sources...)
 }
 
-func NewRepository(directories []string) *Repository {
-	return &Repository{
-		repositoryPrograms: map[string]*repositoryProgram{},
-		directories:        directories,
-		pathsToProgramName: map[string]string{},
+func (r *Repository) sourceNames() []string {
+	ret := make([]string, len(r.sources))
+	for i, source := range r.sources {
+		ret[i] = source.Name
 	}
+	return ret
 }
 
 func (r *Repository) Load() error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	for _, repository := range r.directories {
-		_, err := os.Stat(repository)
+	for _, source := range r.sources {
+		if source.IsWatchable() {
+			_, err := os.Stat(source.Dir)
+			if err != nil {
+				return errors.Wrapf(err, "could not stat repository %s", source.Dir)
+			}
+		}
+
+		config, err := LoadRepositoryConfigFromFS(source.FS)
 		if err != nil {
-			return errors.Wrapf(err, "could not stat repository %s", repository)
+			return errors.Wrapf(err, "could not load config of repository %s", source.Name)
 		}
+		r.configs[source.Name] = config
 
-		programs_, err := LoadProgramsFromFS(os.DirFS(repository), ".")
+		var onError func(string, error)
+		if r.onLoadError != nil {
+			onError = func(fsPath string, err error) {
+				r.onLoadError(source.FilePath(fsPath), err)
+			}
+		}
+		programs_, err := loadProgramsFromFS(source.FS, ".", onError)
 		if err != nil {
-			return errors.Wrapf(err, "could not load programs from repository %s", repository)
+			return errors.Wrapf(err, "could not load programs from repository %s", source.Name)
 		}
 
 		for _, rp := range programs_ {
-			name := rp.program.Name
-			if _, ok := r.repositoryPrograms[name]; ok {
-				return errors.Errorf("program %s already exists", name)
+			rp.fsPath = rp.path
+			rp.path = source.FilePath(rp.fsPath)
+			if source.IsWatchable() {
+				rp.fs_ = nil
+			}
+			r.setRepository(rp, source.Name, config)
+			rp_, err := rp.WithEnvironment(r.profile, r.env)
+			if err != nil {
+				// a variable missing for one program doesn't break the others
+				rp.err = err
+				rp_ = rp
 			}
-			rp.fs_ = nil
-			rp.path = filepath.Join(repository, rp.path)
-			r.repositoryPrograms[name] = rp
-			r.pathsToProgramName[rp.path] = name
+			r.programs[rp.path] = rp_
+		}
+	}
+	r.reindex()
+
+	if r.profile != "" {
+		found := false
+		for _, config := range r.configs {
+			found = found || config.HasProfile(r.profile)
+		}
+		if !found {
+			return errors.Errorf("profile %s is not declared by any repository", r.profile)
 		}
 	}
 
 	return nil
 }
 
+// setRepository attaches rp to the repository directory it was loaded from.
+func (r *Repository) setRepository(rp *RepositoryProgram, repository string, config *RepositoryConfig) {
+	rp.root = repository
+	rp.config = config
+	rp.namespace = repositoryNamespace(repository, config)
+}
+
+// reindex recomputes the names of the programs once programs were loaded, changed or
+// removed. It has to be called with the write lock held.
+func (r *Repository) reindex() {
+	rps := make([]*RepositoryProgram, 0, len(r.programs))
+	for _, rp := range r.programs {
+		rps = append(rps, rp)
+	}
+	r.index = newProgramIndex(rps, r.sourceNames())
+}
+
+// GetPrograms returns the programs that can be addressed, by qualified name. The keys
+// used to be the short names of the programs, before programs of several repositories
+// could have the same name: use LookupProgram to resolve short names.
 func (r *Repository) GetPrograms() map[string]*cliopatra.Program {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 
 	programs := map[string]*cliopatra.Program{}
-	for name, rp := range r.repositoryPrograms {
+	for name, rp := range r.index.byQualified {
 		programs[name] = rp.program
 	}
 	return programs
 }
 
+// GetRepositoryPrograms returns the programs that can be addressed, by qualified name,
+// along with the file they were loaded from. Use Lookup to resolve short names.
+func (r *Repository) GetRepositoryPrograms() map[string]*RepositoryProgram {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	programs := map[string]*RepositoryProgram{}
+	for name, rp := range r.index.byQualified {
+		programs[name] = rp
+	}
+	return programs
+}
+
+// GetOrderedRepositoryPrograms returns the programs that can be addressed, in order
+// of precedence.
+func (r *Repository) GetOrderedRepositoryPrograms() []*RepositoryProgram {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]*RepositoryProgram{}, r.index.programs...)
+}
+
+// GetShadows reports the programs that can't be addressed by their qualified name,
+// or by their short name, ordered by name.
+func (r *Repository) GetShadows() []*Shadow {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]*Shadow{}, r.index.shadows...)
+}
+
+// Lookup returns the program with the given qualified name, or short name if it is
+// unique.
+func (r *Repository) Lookup(name string) (*RepositoryProgram, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.index.lookup(name)
+}
+
+// LookupProgram is Lookup for callers that only need the program, such as the
+// templates of render.Renderer.
+func (r *Repository) LookupProgram(name string) (*cliopatra.Program, error) {
+	rp, err := r.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return rp.program, nil
+}
+
+// GetParameterLog returns the provenance recorded for the flag or argument parameter
+// of the program name, see RepositoryProgram.ParameterLog.
+func (r *Repository) GetParameterLog(name string, parameter string) []*parameters.ParseStep {
+	rp, err := r.Lookup(name)
+	if err != nil {
+		return nil
+	}
+	return rp.ParameterLog(parameter)
+}
+
+// getRepositoryForPath returns the name and the configuration of the directory
+// source containing path, and the path relative to it.
+func (r *Repository) getRepositoryForPath(path string) (string, *RepositoryConfig, string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, source := range r.sources {
+		if !source.IsWatchable() {
+			continue
+		}
+		rel, err := filepath.Rel(source.Dir, path)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return source.Name, r.configs[source.Name], rel
+		}
+	}
+	return "", nil, path
+}
+
+// Watch reloads the programs of the directory sources when their files change, until
+// ctx is cancelled. Other sources can't be watched and are left as loaded. The changes
+// are reported to the handlers registered with Subscribe.
 func (r *Repository) Watch(
 	ctx context.Context,
 ) error {
+	directories := []string{}
+	for _, source := range r.sources {
+		if source.IsWatchable() {
+			directories = append(directories, source.Dir)
+		}
+	}
+	if len(directories) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
 	watcherOptions := []watcher.Option{
-		watcher.WithWriteCallback(func(path string) error {
-			log.Debug().Str("path", path).Msg("watcher write event")
+		watcher.WithWriteCallback(r.onWrite),
+		watcher.WithRemoveCallback(r.onRemove),
+		watcher.WithPaths(directories...),
+		watcher.WithMask("**/*.yaml", "**/*.yml"),
+	}
 
-			f, err := os.Open(path)
-			if err != nil {
-				return errors.Wrapf(err, "could not open file %s", path)
-			}
+	watcher_ := watcher.NewWatcher(watcherOptions...)
 
-			defer func() {
-				_ = f.Close()
-			}()
+	err := watcher_.Run(ctx)
+	r.flushPendingRemovals()
+	return err
+}
 
-			program, err := cliopatra.NewProgramFromYAML(f)
-			if err != nil {
-				log.Warn().Err(err).Str("path", path).Msg("could not load program from file")
-				return nil
-			}
+// onWrite reloads the program file at path once it was created or written.
+func (r *Repository) onWrite(path string) error {
+	log.Debug().Str("path", path).Msg("watcher write event")
+	if !IsProgramFile(path) {
+		return nil
+	}
 
-			_, ok := r.pathsToProgramName[path]
-			if ok {
-				log.Info().Str("name", program.Name).Str("path", path).Msg("updating program")
-			} else {
-				log.Info().Str("name", program.Name).Str("path", path).Msg("adding program")
-			}
+	rp, err := r.loadProgramFile(path)
 
-			r.lock.Lock()
-			defer r.lock.Unlock()
-			r.repositoryPrograms[program.Name] = &repositoryProgram{
-				fs_:     nil,
-				path:    path,
-				program: program,
-			}
-			r.pathsToProgramName[path] = program.Name
-
-			return nil
-		}),
-		watcher.WithRemoveCallback(func(path string) error {
-			log.Debug().Str("path", path).Msg("watcher remove event")
-			name, ok := r.pathsToProgramName[path]
-			if !ok {
-				log.Warn().Str("path", path).Msg("could not find program name for path")
-				return nil
-			}
+	r.notifyLock.Lock()
+	defer r.notifyLock.Unlock()
 
-			log.Info().Str("name", name).Str("path", path).Msg("removing program")
-			r.lock.Lock()
-			defer r.lock.Unlock()
-			delete(r.repositoryPrograms, name)
-			delete(r.pathsToProgramName, path)
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("could not load program from file")
+		r.lock.Lock()
+		// the file is back, keep the program previously loaded from it
+		_, _ = r.takePendingRemoval(path, nil)
+		e := newChangeEvent(ChangeLoadError, path, r.programs[path], nil)
+		r.lock.Unlock()
+		e.Err = err
+		r.notify(e)
+		return nil
+	}
 
-			return nil
-		}),
-		watcher.WithPaths(r.directories...),
-		watcher.WithMask("**/*.yaml"),
+	r.lock.Lock()
+	e := newChangeEvent(ChangeAdded, path, nil, rp)
+	if oldPath, ok := r.takePendingRemoval(path, rp); ok && oldPath != path {
+		e = newChangeEvent(ChangeRenamed, path, r.programs[oldPath], rp)
+		delete(r.programs, oldPath)
+	} else if old, ok := r.programs[path]; ok {
+		e = newChangeEvent(ChangeUpdated, path, old, rp)
 	}
+	log.Info().Str("name", e.Name).Str("path", path).Str("change", string(e.Type)).Msg("program changed")
+	r.programs[path] = rp
+	r.reindex()
+	r.logShadows(path)
+	r.lock.Unlock()
 
-	watcher_ := watcher.NewWatcher(watcherOptions...)
+	r.notify(e)
+	return nil
+}
+
+// onRemove holds back the removal of the program file at path, see removeProgram.
+func (r *Repository) onRemove(path string) error {
+	log.Debug().Str("path", path).Msg("watcher remove event")
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rp, ok := r.programs[path]
+	if !ok {
+		log.Warn().Str("path", path).Msg("could not find program for path")
+		return nil
+	}
+
+	log.Info().Str("name", rp.QualifiedName()).Str("path", path).Msg("removing program")
+	r.removeProgram(path)
+
+	return nil
+}
+
+// loadProgramFile loads the program file at path, in the directory source containing it.
+func (r *Repository) loadProgramFile(path string) (*RepositoryProgram, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open file %s", path)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
 
-	return watcher_.Run(ctx)
+	rp, err := NewRepositoryProgramFromYAML(f, path)
+	if err != nil {
+		return nil, err
+	}
+	repository, config, rel := r.getRepositoryForPath(path)
+	rp.fsPath = rel
+	r.setRepository(rp, repository, config)
+	ret, err := rp.WithEnvironment(r.profile, r.env)
+	if err != nil {
+		// see Load
+		rp.err = err
+		return rp, nil
+	}
+	return ret, nil
+}
+
+// LoadProgramFile loads a program file outside of a repository. The configuration
+// file of the directory holding it applies, if there is one, so that the program
+// gets the same environment and normalizers as when it is loaded with that directory
+// as a repository.
+func LoadProgramFile(path string) (*RepositoryProgram, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open file %s", path)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	rp, err := NewRepositoryProgramFromYAML(f, path)
+	if err != nil {
+		return nil, err
+	}
+	rp.config, err = LoadRepositoryConfigFromFS(os.DirFS(filepath.Dir(path)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load config of %s", filepath.Dir(path))
+	}
+	return rp, nil
+}
+
+// logShadows warns about the shadows involving the program at path. It has to be
+// called with the lock held.
+func (r *Repository) logShadows(path string) {
+	for _, s := range r.index.shadows {
+		if s.Shadowed.path != path && (s.Program == nil || s.Program.path != path) {
+			continue
+		}
+		e := log.Warn().Str("name", s.Name).Str("kind", string(s.Kind)).Str("shadowed", s.Shadowed.path)
+		if s.Program != nil {
+			e = e.Str("program", s.Program.path)
+		}
+		e.Msg("program is shadowed")
+	}
 }
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles writes files, by path relative to dir, creating their directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func TestLoadKeepsProgramsWithMissingVariables(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".cliopatra.yaml": "interpolate: true\n",
+		"ok.yaml":         "name: ok\npath: echo\n",
+		"broken.yaml":     "name: broken\npath: echo\nrawFlags: ['${CLIOPATRA_TEST_UNSET}']\n",
+	})
+
+	errors_ := map[string]error{}
+	r := NewRepository([]string{dir}, WithLoadErrorHandler(func(path string, err error) {
+		errors_[path] = err
+	}))
+	require.NoError(t, r.Load())
+	assert.Empty(t, errors_)
+	assert.Len(t, r.GetOrderedRepositoryPrograms(), 2)
+
+	rp, err := r.Lookup("ok")
+	require.NoError(t, err)
+	assert.NoError(t, rp.Err())
+
+	rp, err = r.Lookup("broken")
+	require.NoError(t, err)
+	require.Error(t, rp.Err())
+	assert.Contains(t, rp.Err().Error(), "CLIOPATRA_TEST_UNSET")
+	_, _, err = rp.PrepareRun(false)
+	assert.ErrorIs(t, err, rp.Err())
+	_, _, err = rp.PlanRun()
+	assert.ErrorIs(t, err, rp.Err())
+}
+
+func TestCommandPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		file     string
+		program  string
+		expected []string
+	}{
+		{
+			name:     "top-level",
+			file:     "echo.yaml",
+			program:  "name: echo\nverbs: [say]\n",
+			expected: []string{"echo"},
+		},
+		{
+			name:     "by directory",
+			file:     "reports/sales/orders.yaml",
+			program:  "name: ttc-orders\nverbs: [ttc, orders]\n",
+			expected: []string{"reports", "sales", "ttc-orders"},
+		},
+		{
+			name:     "by verbs",
+			config:   "commandNesting: verbs\n",
+			file:     "reports/orders.yaml",
+			program:  "name: ttc-orders\nverbs: [ttc, orders]\n",
+			expected: []string{"ttc", "orders", "ttc-orders"},
+		},
+		{
+			name:     "by verbs without verbs",
+			config:   "commandNesting: verbs\n",
+			file:     "reports/echo.yaml",
+			program:  "name: echo\n",
+			expected: []string{"echo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{tt.file: tt.program}
+			if tt.config != "" {
+				files[RepositoryConfigFileName] = tt.config
+			}
+			writeFiles(t, dir, files)
+
+			r := NewRepository([]string{dir})
+			require.NoError(t, r.Load())
+			rps := r.GetOrderedRepositoryPrograms()
+			require.Len(t, rps, 1)
+			assert.Equal(t, tt.expected, rps[0].CommandPath())
+		})
+	}
+
+	rp, err := LoadProgramFile(filepath.Join("..", "misc", "ttc-orders.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ttc-orders"}, rp.CommandPath())
+}
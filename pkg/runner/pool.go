@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"context"
+	"golang.org/x/sync/errgroup"
+	"sync"
+)
+
+// Task is a unit of work run by a Pool.
+type Task struct {
+	// Group is the exclusivity group of the task. Tasks with the same non-empty
+	// group never run at the same time.
+	Group string
+	Run   func(ctx context.Context) error
+}
+
+// Pool runs tasks on a bounded number of workers.
+type Pool struct {
+	jobs int
+	// slots holds a value for each running task
+	slots  chan struct{}
+	lock   sync.Mutex
+	groups map[string]*sync.Mutex
+}
+
+// NewPool returns a pool running at most jobs tasks at the same time.
+// A value smaller than 1 runs the tasks one after the other.
+func NewPool(jobs int) *Pool {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &Pool{
+		jobs:   jobs,
+		slots:  make(chan struct{}, jobs),
+		groups: map[string]*sync.Mutex{},
+	}
+}
+
+func (p *Pool) groupLock(group string) *sync.Mutex {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	l, ok := p.groups[group]
+	if !ok {
+		l = &sync.Mutex{}
+		p.groups[group] = l
+	}
+	return l
+}
+
+// Run runs all tasks and waits for them to finish. The first error cancels the
+// context passed to the remaining tasks and is returned.
+//
+// A task waiting for its exclusivity group holds on to its worker, so heavy use of
+// groups reduces the effective parallelism.
+func (p *Pool) Run(ctx context.Context, tasks []*Task) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(p.jobs)
+
+	for _, task := range tasks {
+		task := task
+		eg.Go(func() error {
+			return p.Do(ctx, task)
+		})
+	}
+
+	return eg.Wait()
+}
+
+// Do runs task as soon as a worker is free, and waits for it to finish. It is used
+// by callers scheduling tasks themselves, for example once the tasks they depend on
+// are done, and can be called concurrently with Run.
+func (p *Pool) Do(ctx context.Context, task *Task) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-p.slots
+	}()
+
+	if task.Group != "" {
+		l := p.groupLock(task.Group)
+		l.Lock()
+		defer l.Unlock()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return task.Run(ctx)
+}
@@ -0,0 +1,264 @@
+// Package runner executes cliopatra programs and captures stdout, stderr and
+// the exit code separately.
+//
+// This mirrors cliopatra.Program.RunIntoWriter, which merges both output streams
+// and turns a non-zero exit code into an error, something that is not
+// usable when the failure of a program is what is being tested.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Output is the captured result of running a program.
+type Output struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
+
+type Runner struct {
+	parsedLayers *layers.ParsedLayers
+	dir          string
+	timeout      time.Duration
+	stdin        io.Reader
+	stdout       io.Writer
+	stderr       io.Writer
+}
+
+type Option func(r *Runner)
+
+// WithParsedLayers passes parameter values that override the values stored in the program.
+func WithParsedLayers(parsedLayers *layers.ParsedLayers) Option {
+	return func(r *Runner) {
+		r.parsedLayers = parsedLayers
+	}
+}
+
+// WithDir sets the working directory of the program.
+func WithDir(dir string) Option {
+	return func(r *Runner) {
+		r.dir = dir
+	}
+}
+
+// WithTimeout cancels the program if it runs longer than timeout. 0 means no timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Runner) {
+		r.timeout = timeout
+	}
+}
+
+// WithStdin passes stdin to programs that don't declare their own stdin.
+func WithStdin(stdin io.Reader) Option {
+	return func(r *Runner) {
+		r.stdin = stdin
+	}
+}
+
+// WithOutputWriters streams stdout and stderr of the program to the given writers as
+// they are written, instead of capturing them into Output. A nil writer keeps
+// capturing the corresponding stream.
+func WithOutputWriters(stdout io.Writer, stderr io.Writer) Option {
+	return func(r *Runner) {
+		r.stdout = stdout
+		r.stderr = stderr
+	}
+}
+
+func NewRunner(options ...Option) *Runner {
+	r := &Runner{
+		parsedLayers: layers.NewParsedLayers(),
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// Run executes the program and waits for it to finish.
+//
+// A non-zero exit code is not considered an error and is reported in Output.ExitCode.
+// An error is returned if the program could not be started at all, or if it
+// was killed because it ran longer than the timeout.
+func (r *Runner) Run(ctx context.Context, p *cliopatra.Program) (*Output, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	cmd, err := r.command(p)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	var stdoutWriter, stderrWriter io.Writer = stdout, stderr
+	if r.stdout != nil {
+		stdoutWriter = r.stdout
+	}
+	if r.stderr != nil {
+		stderrWriter = r.stderr
+	}
+
+	start := time.Now()
+	err = run(ctx, cmd, stdoutWriter, stderrWriter)
+	ret := &Output{
+		Duration: time.Since(start),
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}
+
+	if ctx.Err() != nil {
+		if r.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ret, errors.Errorf("%s timed out after %s", p.Name, r.timeout)
+		}
+		return ret, ctx.Err()
+	}
+
+	if err != nil {
+		var exitError *exec.ExitError
+		if !errors.As(err, &exitError) {
+			return nil, errors.Wrapf(err, "could not run %s", p.Name)
+		}
+		ret.ExitCode = exitError.ExitCode()
+	}
+
+	return ret, nil
+}
+
+func (r *Runner) command(p *cliopatra.Program) (*exec.Cmd, error) {
+	var err error
+	path := p.Path
+	if path == "" {
+		path, err = exec.LookPath(p.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not find executable %s", p.Name)
+		}
+	}
+
+	args, err := p.ComputeArgs(r.parsedLayers.GetAllParsedParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("path", path).Strs("args", args).Msg("running program")
+
+	cmd := exec.Command(path, args...)
+	cmd.Dir = r.dir
+	cmd.Env = append([]string{}, os.Environ()...)
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	log.Trace().Strs("env", cmd.Env).Msg("environment")
+
+	if p.Stdin != "" {
+		cmd.Stdin = strings.NewReader(p.Stdin)
+	} else if r.stdin != nil {
+		cmd.Stdin = r.stdin
+	}
+
+	return cmd, nil
+}
+
+// run starts cmd in its own process group and waits for it to exit and for its
+// output to be copied to stdout and stderr.
+//
+// When ctx is done, the whole process group is killed and the output pipes are
+// closed. Killing only cmd, as exec.CommandContext does, leaves its children
+// running, and a child that keeps the pipes open, such as the sleep in
+// `sh -c "sleep 3; echo hi"`, would keep the run waiting after its timeout.
+//
+// A program reading from a terminal stays in the process group of cliopatra,
+// since a background process group is stopped when it reads from the terminal.
+// Only the program itself is killed then, its children exit once the pipes are closed.
+func run(ctx context.Context, cmd *exec.Cmd, stdout io.Writer, stderr io.Writer) error {
+	processGroup := !isTerminal(cmd.Stdin)
+	if processGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdoutReader.Close()
+		_ = stdoutWriter.Close()
+		return err
+	}
+	defer func() {
+		_ = stdoutReader.Close()
+		_ = stderrReader.Close()
+	}()
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	err = cmd.Start()
+	// the program holds its own copies of the write ends
+	_ = stdoutWriter.Close()
+	_ = stderrWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stdout, stdoutReader)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stderr, stderrReader)
+	}()
+
+	done := make(chan struct{})
+	killed := make(chan struct{})
+	go func() {
+		defer close(killed)
+		select {
+		case <-ctx.Done():
+			if processGroup {
+				_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			} else {
+				_ = cmd.Process.Kill()
+			}
+			_ = stdoutReader.Close()
+			_ = stderrReader.Close()
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	wg.Wait()
+	close(done)
+	<-killed
+
+	return err
+}
+
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
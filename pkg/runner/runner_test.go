@@ -0,0 +1,151 @@
+package runner
+
+import (
+	"context"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunCapturesStreamsAndExitCode(t *testing.T) {
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("sh"),
+		cliopatra.WithPath("sh"),
+		cliopatra.WithRawFlags("-c", "echo out; echo err >&2; exit 3"),
+	)
+	output, err := NewRunner().Run(context.Background(), p)
+	require.NoError(t, err)
+	assert.Equal(t, "out\n", output.Stdout)
+	assert.Equal(t, "err\n", output.Stderr)
+	assert.Equal(t, 3, output.ExitCode)
+}
+
+func TestRunStreamsOutputAndStdin(t *testing.T) {
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("sh"),
+		cliopatra.WithPath("sh"),
+		cliopatra.WithRawFlags("-c", "cat; echo err >&2; exit 4"),
+	)
+	stdout := &strings.Builder{}
+	stderr := &strings.Builder{}
+	output, err := NewRunner(
+		WithStdin(strings.NewReader("in\n")),
+		WithOutputWriters(stdout, stderr),
+	).Run(context.Background(), p)
+	require.NoError(t, err)
+	assert.Equal(t, "in\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+	assert.Equal(t, "", output.Stdout)
+	assert.Equal(t, 4, output.ExitCode)
+
+	// the stdin of the program takes precedence
+	p.Stdin = "declared\n"
+	stdout.Reset()
+	_, err = NewRunner(
+		WithStdin(strings.NewReader("in\n")),
+		WithOutputWriters(stdout, nil),
+	).Run(context.Background(), p)
+	require.NoError(t, err)
+	assert.Equal(t, "declared\n", stdout.String())
+}
+
+func TestRunTimeout(t *testing.T) {
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("sleep"),
+		cliopatra.WithPath("sleep"),
+		cliopatra.WithRawFlags("10"),
+	)
+	start := time.Now()
+	_, err := NewRunner(WithTimeout(50*time.Millisecond)).Run(context.Background(), p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out after 50ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunTimeoutKillsChildren(t *testing.T) {
+	// the sleep keeps stdout open after sh is killed
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("sh"),
+		cliopatra.WithPath("sh"),
+		cliopatra.WithRawFlags("-c", "sleep 3; echo hi"),
+	)
+	start := time.Now()
+	_, err := NewRunner(WithTimeout(50*time.Millisecond)).Run(context.Background(), p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out after 50ms")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestPoolExclusiveGroups(t *testing.T) {
+	var running, maxRunning, exclusive, maxExclusive int32
+
+	track := func(counter *int32, max *int32) func() {
+		n := atomic.AddInt32(counter, 1)
+		for {
+			m := atomic.LoadInt32(max)
+			if n <= m || atomic.CompareAndSwapInt32(max, m, n) {
+				break
+			}
+		}
+		return func() { atomic.AddInt32(counter, -1) }
+	}
+
+	tasks := []*Task{}
+	for i := 0; i < 12; i++ {
+		group := ""
+		if i%2 == 0 {
+			group = "db"
+		}
+		tasks = append(tasks, &Task{
+			Group: group,
+			Run: func(ctx context.Context) error {
+				done := track(&running, &maxRunning)
+				defer done()
+				if group != "" {
+					doneExclusive := track(&exclusive, &maxExclusive)
+					defer doneExclusive()
+				}
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			},
+		})
+	}
+
+	err := NewPool(4).Run(context.Background(), tasks)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, maxRunning, int32(4))
+	assert.Greater(t, maxRunning, int32(1))
+	assert.Equal(t, int32(1), maxExclusive)
+}
+
+func TestPoolDo(t *testing.T) {
+	pool := NewPool(1)
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = pool.Do(context.Background(), &Task{Run: func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}})
+	}()
+	<-started
+
+	// the only worker is busy, so the task waits until its context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := pool.Do(ctx, &Task{Run: func(ctx context.Context) error {
+		return errors.New("should not run")
+	}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	err = pool.Do(context.Background(), &Task{Run: func(ctx context.Context) error {
+		return nil
+	}})
+	assert.NoError(t, err)
+}
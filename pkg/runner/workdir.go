@@ -0,0 +1,230 @@
+package runner
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Workdir is a temporary working directory populated with fixture files, so that
+// a program run doesn't depend on the directory cliopatra is invoked from.
+type Workdir struct {
+	Path string
+	keep bool
+}
+
+// NewWorkdir creates a fresh temporary directory and copies the fixtures into it.
+//
+// Fixtures are files or directories given relative to baseDir, and are copied
+// to the same relative path inside the working directory. If keep is true, the
+// directory is not removed on Close, for debugging purposes.
+func NewWorkdir(baseDir string, fixtures []string, keep bool) (*Workdir, error) {
+	for _, fixture := range fixtures {
+		if filepath.IsAbs(fixture) || strings.HasPrefix(filepath.Clean(fixture), "..") {
+			return nil, errors.Errorf("fixture %s has to be a path inside %s", fixture, baseDir)
+		}
+	}
+	return NewWorkdirFromFS(os.DirFS(baseDir), fixtures, keep)
+}
+
+// NewWorkdirFromFS is NewWorkdir with fixtures relative to the root of f, for
+// programs loaded from filesystems that aren't on disk, such as an embed.FS.
+func NewWorkdirFromFS(f fs.FS, fixtures []string, keep bool) (*Workdir, error) {
+	dir, err := os.MkdirTemp("", "cliopatra-")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create working directory")
+	}
+	w := &Workdir{Path: dir, keep: keep}
+
+	for _, fixture := range fixtures {
+		src := filepath.ToSlash(filepath.Clean(fixture))
+		if !fs.ValidPath(src) {
+			_ = w.Close()
+			return nil, errors.Errorf("fixture %s has to be a path inside the directory of the program", fixture)
+		}
+		err = copyPath(f, src, filepath.Join(dir, fixture))
+		if err != nil {
+			_ = w.Close()
+			return nil, errors.Wrapf(err, "could not copy fixture %s", fixture)
+		}
+	}
+
+	return w, nil
+}
+
+// IsFixture returns true if file, relative to the directory the fixtures are given
+// relative to, is one of fixtures or inside one of them, and is thus copied into a
+// Workdir when it exists.
+func IsFixture(fixtures []string, file string) bool {
+	file = filepath.Clean(file)
+	for _, fixture := range fixtures {
+		fixture = filepath.Clean(fixture)
+		if fixture == "." || file == fixture || strings.HasPrefix(file, fixture+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the path of file inside the working directory.
+func (w *Workdir) Resolve(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(w.Path, file)
+}
+
+func (w *Workdir) Close() error {
+	if w.keep {
+		log.Info().Str("path", w.Path).Msg("keeping working directory")
+		return nil
+	}
+	return os.RemoveAll(w.Path)
+}
+
+// copyPath copies the file or directory src of f to dst on disk.
+func copyPath(f fs.FS, src string, dst string) error {
+	return fs.WalkDir(f, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := dst
+		if path != src {
+			rel := strings.TrimPrefix(path, src+"/")
+			if src == "." {
+				rel = path
+			}
+			target = filepath.Join(dst, filepath.FromSlash(rel))
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		return copyFile(f, path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(f fs.FS, src string, dst string, mode fs.FileMode) error {
+	in, err := f.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+var stringTypes = map[parameters.ParameterType]bool{
+	parameters.ParameterTypeString:          true,
+	parameters.ParameterTypeStringFromFile:  true,
+	parameters.ParameterTypeStringFromFiles: true,
+}
+
+var stringListTypes = map[parameters.ParameterType]bool{
+	parameters.ParameterTypeStringList:          true,
+	parameters.ParameterTypeStringListFromFile:  true,
+	parameters.ParameterTypeStringListFromFiles: true,
+}
+
+// ResolvePaths returns a clone of p where relative paths in the flag and argument
+// values and in the raw flags are made relative to baseDir, usually the directory of
+// the program file, instead of the directory cliopatra is run from.
+//
+// Since program files don't declare which values are paths, a value is considered a
+// path if it exists relative to baseDir. Other values, such as the hello of
+// `echo hello`, are left untouched, whatever the directory cliopatra is run from
+// contains. Values for which exists returns true, for example because they were
+// copied into a Workdir as fixtures, are left untouched as well.
+//
+// Only string and string list parameters are resolved. Raw flags are resolved when
+// they are a single word: the value of a raw flag such as `--input=data.csv` is
+// passed as written.
+func ResolvePaths(p *cliopatra.Program, baseDir string, exists func(string) bool) *cliopatra.Program {
+	ret := p.Clone()
+
+	resolve := func(v string) string {
+		if v == "" || filepath.IsAbs(v) || strings.HasPrefix(v, "-") {
+			return v
+		}
+		if exists != nil && exists(v) {
+			return v
+		}
+		path := filepath.Join(baseDir, v)
+		if _, err := os.Stat(path); err != nil {
+			return v
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return v
+		}
+		return abs
+	}
+
+	for _, param := range append(append([]*cliopatra.Parameter{}, ret.Flags...), ret.Args...) {
+		resolveParameter(param, resolve)
+	}
+	for i, f := range ret.RawFlags {
+		ret.RawFlags[i] = resolve(f)
+	}
+
+	return ret
+}
+
+// resolveParameter applies resolve to the value of param, if param is a string or a
+// list of strings.
+func resolveParameter(param *cliopatra.Parameter, resolve func(string) string) {
+	if stringTypes[param.Type] {
+		if s, ok := param.Value.(string); ok {
+			param.Value = resolve(s)
+		}
+		// overrides of file parameters are passed as raw values
+		param.Raw = resolve(param.Raw)
+	}
+
+	if stringListTypes[param.Type] {
+		switch l := param.Value.(type) {
+		case []interface{}:
+			l_ := make([]interface{}, len(l))
+			for i, v := range l {
+				if s, ok := v.(string); ok {
+					l_[i] = resolve(s)
+				} else {
+					l_[i] = v
+				}
+			}
+			param.Value = l_
+		case []string:
+			l_ := make([]string, len(l))
+			for i, s := range l {
+				l_[i] = resolve(s)
+			}
+			param.Value = l_
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package runner
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewWorkdirCopiesFixtures(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "data", "nested"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "data", "nested", "a.csv"), []byte("a,b\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "input.txt"), []byte("hello\n"), 0644))
+
+	w, err := NewWorkdir(base, []string{"data", "input.txt"}, false)
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(w.Resolve("data/nested/a.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n", string(b))
+	b, err = os.ReadFile(w.Resolve("input.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(b))
+
+	require.NoError(t, w.Close())
+	_, err = os.Stat(w.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = NewWorkdir(base, []string{"../outside"}, false)
+	assert.Error(t, err)
+}
+
+func TestNewWorkdirFromFS(t *testing.T) {
+	f := fstest.MapFS{
+		"data/nested/a.csv": {Data: []byte("a,b\n"), Mode: 0644},
+		"input.txt":         {Data: []byte("hello\n"), Mode: 0644},
+	}
+
+	w, err := NewWorkdirFromFS(f, []string{"data", "input.txt"}, false)
+	require.NoError(t, err)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	b, err := os.ReadFile(w.Resolve("data/nested/a.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n", string(b))
+	b, err = os.ReadFile(w.Resolve("input.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(b))
+
+	_, err = NewWorkdirFromFS(f, []string{"../outside"}, false)
+	assert.Error(t, err)
+	_, err = NewWorkdirFromFS(f, []string{"missing.txt"}, false)
+	assert.Error(t, err)
+}
+
+func TestResolvePaths(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(base, "query.sql"), []byte("select 1"), 0644))
+
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("cat"),
+		cliopatra.WithArgs(
+			&cliopatra.Parameter{Name: "file", Type: parameters.ParameterTypeString, Value: "query.sql"},
+			&cliopatra.Parameter{Name: "other", Type: parameters.ParameterTypeString, Value: "missing.sql"},
+		),
+	)
+
+	resolved := ResolvePaths(p, base, nil)
+	abs, err := filepath.Abs(filepath.Join(base, "query.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, abs, resolved.Args[0].Value)
+	assert.Equal(t, "missing.sql", resolved.Args[1].Value)
+	assert.Equal(t, "query.sql", p.Args[0].Value)
+
+	resolved = ResolvePaths(p, base, func(string) bool { return true })
+	assert.Equal(t, "query.sql", resolved.Args[0].Value)
+
+	// workdir.go exists relative to the working directory of the test, but not to base
+	p.Args[1].Value = "workdir.go"
+	resolved = ResolvePaths(p, base, nil)
+	assert.Equal(t, "workdir.go", resolved.Args[1].Value)
+}
+
+func TestResolvePathsOfFlagsAndRawFlags(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(base, "orders.csv"), []byte("id\n"), 0644))
+	abs, err := filepath.Abs(filepath.Join(base, "orders.csv"))
+	require.NoError(t, err)
+
+	p := cliopatra.NewProgram(
+		cliopatra.WithName("glaze"),
+		cliopatra.WithFlags(
+			&cliopatra.Parameter{Name: "input", Type: parameters.ParameterTypeString, Value: "orders.csv"},
+			&cliopatra.Parameter{Name: "inputs", Type: parameters.ParameterTypeStringList, Value: []interface{}{"orders.csv", "hello"}},
+			&cliopatra.Parameter{Name: "limit", Type: parameters.ParameterTypeInteger, Value: 10},
+		),
+		cliopatra.WithRawFlags("--from", "orders.csv", "--input=orders.csv", "hello"),
+	)
+
+	resolved := ResolvePaths(p, base, nil)
+	assert.Equal(t, abs, resolved.Flags[0].Value)
+	assert.Equal(t, []interface{}{abs, "hello"}, resolved.Flags[1].Value)
+	assert.Equal(t, 10, resolved.Flags[2].Value)
+	assert.Equal(t, []string{"--from", abs, "--input=orders.csv", "hello"}, resolved.RawFlags)
+}
+
+func TestIsFixture(t *testing.T) {
+	fixtures := []string{"data", "input.txt", "./queries/"}
+	assert.True(t, IsFixture(fixtures, "input.txt"))
+	assert.True(t, IsFixture(fixtures, "data/orders.csv"))
+	assert.True(t, IsFixture(fixtures, "./queries/orders.sql"))
+	assert.False(t, IsFixture(fixtures, "database.db"))
+	assert.False(t, IsFixture(fixtures, "output.txt"))
+	assert.True(t, IsFixture([]string{"."}, "anything"))
+}
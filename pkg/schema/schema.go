@@ -0,0 +1,456 @@
+// Package schema publishes the JSON Schema of program files, so that YAML language
+// servers can complete and validate them, and validates program files against it.
+//
+// Program files are validated at the yaml.Node level, so that errors point at the
+// line and column of the offending value, which JSON Schema libraries validating
+// decoded values can't do. The validator supports the subset of JSON Schema used by
+// the program schema: type, enum, const, pattern, properties, required,
+// additionalProperties, items, allOf, anyOf, if/then/else and local $refs.
+package schema
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed program.schema.json
+var programSchemaJSON []byte
+
+// ProgramSchemaJSON returns the JSON Schema of program files.
+func ProgramSchemaJSON() []byte {
+	return programSchemaJSON
+}
+
+var (
+	programSchema     *Schema
+	programSchemaErr  error
+	programSchemaOnce sync.Once
+)
+
+// ProgramSchema returns the parsed JSON Schema of program files.
+func ProgramSchema() (*Schema, error) {
+	programSchemaOnce.Do(func() {
+		programSchema, programSchemaErr = Parse(programSchemaJSON)
+	})
+	return programSchema, programSchemaErr
+}
+
+// ValidateProgram validates the program file s against the program schema. It
+// returns a *ValidationError listing all the violations if it doesn't match.
+func ValidateProgram(s []byte) error {
+	schema, err := ProgramSchema()
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(s, &doc)
+	if err != nil {
+		return err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 {
+		return errors.New("program file is empty")
+	}
+
+	return schema.Validate(doc.Content[0])
+}
+
+// Schema is a JSON Schema, or a subschema of it.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 Types              `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Const                interface{}        `json:"const,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	If                   *Schema            `json:"if,omitempty"`
+	Then                 *Schema            `json:"then,omitempty"`
+	Else                 *Schema            `json:"else,omitempty"`
+
+	// never is true for the `false` schema, which matches nothing
+	never   bool
+	pattern *regexp.Regexp
+	root    *Schema
+}
+
+// Types is the `type` of a schema, either a single type or a list of types.
+type Types []string
+
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = Types{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*t = l
+	return nil
+}
+
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	var boolean bool
+	if err := json.Unmarshal(b, &boolean); err == nil {
+		*s = Schema{never: !boolean}
+		return nil
+	}
+	type schema Schema
+	return json.Unmarshal(b, (*schema)(s))
+}
+
+// Parse parses a JSON Schema and compiles its patterns.
+func Parse(b []byte) (*Schema, error) {
+	ret := &Schema{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	err := decoder.Decode(ret)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse schema")
+	}
+	err = ret.compile(ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *Schema) compile(root *Schema) error {
+	if s == nil {
+		return nil
+	}
+	s.root = root
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern %s", s.Pattern)
+		}
+		s.pattern = re
+	}
+	if s.Ref != "" {
+		if _, err := s.resolve(); err != nil {
+			return err
+		}
+	}
+
+	children := []*Schema{s.AdditionalProperties, s.Items, s.If, s.Then, s.Else}
+	children = append(children, s.AllOf...)
+	children = append(children, s.AnyOf...)
+	for _, child := range s.Properties {
+		children = append(children, child)
+	}
+	for _, child := range s.Defs {
+		children = append(children, child)
+	}
+	for _, child := range children {
+		if err := child.compile(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the schema referred to by the $ref of s, which has to be of the
+// form #/$defs/<name>.
+func (s *Schema) resolve() (*Schema, error) {
+	name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+	if !ok {
+		return nil, errors.Errorf("unsupported $ref %s", s.Ref)
+	}
+	ret, ok := s.root.Defs[name]
+	if !ok {
+		return nil, errors.Errorf("unknown $ref %s", s.Ref)
+	}
+	return ret, nil
+}
+
+// Violation is a value of a YAML document that doesn't match the schema.
+type Violation struct {
+	// Path is the path of the value in the document, such as flags[0].value.
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (v *Violation) String() string {
+	path := v.Path
+	if path == "" {
+		path = "document"
+	}
+	return fmt.Sprintf("line %d, column %d: %s: %s", v.Line, v.Column, path, v.Message)
+}
+
+// ValidationError lists the violations of a document, ordered by location.
+type ValidationError struct {
+	Violations []*Violation
+}
+
+func (e *ValidationError) Error() string {
+	ret := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		ret[i] = v.String()
+	}
+	return strings.Join(ret, "\n")
+}
+
+// Validate validates the YAML node n against s, and returns a *ValidationError if it
+// doesn't match.
+func (s *Schema) Validate(n *yaml.Node) error {
+	violations := s.validate(n, "")
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		if violations[i].Line != violations[j].Line {
+			return violations[i].Line < violations[j].Line
+		}
+		return violations[i].Column < violations[j].Column
+	})
+	return &ValidationError{Violations: violations}
+}
+
+func (s *Schema) validate(n *yaml.Node, path string) []*Violation {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	violation := func(n *yaml.Node, message string, args ...interface{}) []*Violation {
+		return []*Violation{{
+			Path:    path,
+			Line:    n.Line,
+			Column:  n.Column,
+			Message: fmt.Sprintf(message, args...),
+		}}
+	}
+
+	if s.never {
+		return violation(n, "is not allowed")
+	}
+	if s.Ref != "" {
+		ref, err := s.resolve()
+		if err != nil {
+			return violation(n, "%s", err.Error())
+		}
+		return ref.validate(n, path)
+	}
+
+	type_ := nodeType(n)
+	if len(s.Type) > 0 && !s.Type.matches(type_) {
+		return violation(n, "expected %s, got %s", strings.Join(s.Type, " or "), type_)
+	}
+	if s.Enum != nil {
+		found := false
+		for _, e := range s.Enum {
+			found = found || equals(n, e)
+		}
+		if !found {
+			return violation(n, "expected one of %s, got %s", formatValues(s.Enum), formatNode(n))
+		}
+	}
+	if s.Const != nil && !equals(n, s.Const) {
+		return violation(n, "expected %s, got %s", formatValues([]interface{}{s.Const}), formatNode(n))
+	}
+	if s.pattern != nil && type_ == "string" && !s.pattern.MatchString(n.Value) {
+		return violation(n, "%s doesn't match %s", formatNode(n), s.Pattern)
+	}
+
+	ret := []*Violation{}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		present := map[string]bool{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			present[key.Value] = true
+			valuePath := joinPath(path, key.Value)
+			if property, ok := s.Properties[key.Value]; ok {
+				ret = append(ret, property.validate(value, valuePath)...)
+			} else if s.AdditionalProperties != nil {
+				if s.AdditionalProperties.never {
+					ret = append(ret, &Violation{
+						Path:    valuePath,
+						Line:    key.Line,
+						Column:  key.Column,
+						Message: "unknown field",
+					})
+					continue
+				}
+				ret = append(ret, s.AdditionalProperties.validate(value, valuePath)...)
+			}
+		}
+		for _, required := range s.Required {
+			if !present[required] {
+				ret = append(ret, violation(n, "missing field %s", required)...)
+			}
+		}
+
+	case yaml.SequenceNode:
+		if s.Items != nil {
+			for i, item := range n.Content {
+				ret = append(ret, s.Items.validate(item, path+"["+strconv.Itoa(i)+"]")...)
+			}
+		}
+
+	case yaml.DocumentNode, yaml.ScalarNode, yaml.AliasNode:
+	}
+
+	for _, s_ := range s.AllOf {
+		ret = append(ret, s_.validate(n, path)...)
+	}
+
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, s_ := range s.AnyOf {
+			if len(s_.validate(n, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			summaries := make([]string, len(s.AnyOf))
+			for i, s_ := range s.AnyOf {
+				summaries[i] = s_.summary()
+			}
+			ret = append(ret, violation(n, "expected %s, got %s", strings.Join(summaries, " or "), formatNode(n))...)
+		}
+	}
+
+	if s.If != nil {
+		if len(s.If.validate(n, path)) == 0 {
+			if s.Then != nil {
+				ret = append(ret, s.Then.validate(n, path)...)
+			}
+		} else if s.Else != nil {
+			ret = append(ret, s.Else.validate(n, path)...)
+		}
+	}
+
+	return ret
+}
+
+// summary describes the values s accepts, for the errors of anyOf.
+func (s *Schema) summary() string {
+	if s.Ref != "" {
+		if ref, err := s.resolve(); err == nil {
+			return ref.summary()
+		}
+	}
+	ret := "value"
+	switch {
+	case s.Enum != nil:
+		ret = "one of " + formatValues(s.Enum)
+	case s.Const != nil:
+		ret = formatValues([]interface{}{s.Const})
+	case len(s.Type) > 0:
+		ret = strings.Join(s.Type, " or ")
+	}
+	if s.Pattern != "" {
+		ret += " matching " + s.Pattern
+	}
+	return ret
+}
+
+func (t Types) matches(type_ string) bool {
+	for _, t_ := range t {
+		if t_ == type_ || (t_ == "number" && type_ == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeType returns the JSON type of a YAML node. Timestamps and binary values are
+// strings in JSON.
+func nodeType(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	case yaml.DocumentNode, yaml.AliasNode:
+		return "document"
+	case yaml.ScalarNode:
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return "null"
+	case "!!bool":
+		return "boolean"
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// equals compares a scalar node to a value of the schema.
+func equals(n *yaml.Node, v interface{}) bool {
+	if n.Kind != yaml.ScalarNode {
+		return false
+	}
+	switch v_ := v.(type) {
+	case string:
+		return nodeType(n) == "string" && n.Value == v_
+	case bool:
+		return nodeType(n) == "boolean" && n.Value == strconv.FormatBool(v_)
+	case json.Number:
+		f, err := strconv.ParseFloat(n.Value, 64)
+		g, err2 := v_.Float64()
+		return err == nil && err2 == nil && f == g
+	case nil:
+		return nodeType(n) == "null"
+	default:
+		return false
+	}
+}
+
+func formatValues(values []interface{}) string {
+	ret := make([]string, len(values))
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			ret[i] = strconv.Quote(s)
+		} else {
+			ret[i] = fmt.Sprint(v)
+		}
+	}
+	return strings.Join(ret, ", ")
+}
+
+func formatNode(n *yaml.Node) string {
+	type_ := nodeType(n)
+	switch type_ {
+	case "string":
+		return strconv.Quote(n.Value)
+	case "integer", "number", "boolean":
+		return n.Value
+	default:
+		return type_
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
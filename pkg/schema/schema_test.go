@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestProgramSchema(t *testing.T) {
+	_, err := ProgramSchema()
+	require.NoError(t, err)
+}
+
+func TestValidateProgram(t *testing.T) {
+	err := ValidateProgram([]byte(`name: ttc-orders
+path: sqleton
+verbs: [ttc, orders]
+description: Show WooCommerce orders.
+env:
+  PORT: 5432
+flags:
+  - name: use-dbt-profiles
+    type: bool
+    value: true
+    noValue: true
+    log:
+      - source: defaults
+        value: false
+        metadata: {}
+  - name: limit
+    type: int
+    value: ${LIMIT:-10}
+  - name: from
+    type: date
+    value: 2023-01-01
+  - name: ids
+    type: intList
+    value: [1, 2]
+  - name: where
+    type: keyValue
+    value: {status: open}
+args:
+  - name: files
+    type: stringList
+    value: [a.csv]
+timeout: 1m30s
+normalize:
+  - sort-lines
+  - replace: '\d+ms'
+    with: <duration>
+compare:
+  format: csv
+expectedStdout: |
+  id,amount
+expectedFileChanges:
+  - path: out.csv
+    change: created
+`))
+	require.NoError(t, err)
+}
+
+func TestValidateProgramViolations(t *testing.T) {
+	err := ValidateProgram([]byte(`path: sqleton
+flags:
+  - name: limit
+    type: int
+    value: "12"
+  - name: ratios
+    type: floatList
+    value: [0.5, high]
+  - name: output
+    type: table
+timout: 2m
+normalize:
+  - sort-line
+`))
+	require.Error(t, err)
+	var validationError *ValidationError
+	require.ErrorAs(t, err, &validationError)
+
+	type violation struct {
+		Path   string
+		Line   int
+		Column int
+	}
+	actual := []violation{}
+	for _, v := range validationError.Violations {
+		actual = append(actual, violation{v.Path, v.Line, v.Column})
+	}
+	assert.Equal(t, []violation{
+		{"", 1, 1},
+		{"flags[0].value", 5, 12},
+		{"flags[1].value[1]", 8, 18},
+		{"flags[2].type", 10, 11},
+		{"timout", 11, 1},
+		{"normalize[0]", 13, 5},
+	}, actual)
+
+	assert.Equal(t, "missing field name", validationError.Violations[0].Message)
+	assert.Equal(t, `expected integer or null or string matching \$\{, got "12"`, validationError.Violations[1].Message)
+	assert.Equal(t, "unknown field", validationError.Violations[4].Message)
+	assert.Contains(t, err.Error(), `line 5, column 12: flags[0].value: expected integer`)
+}
+
+func TestValidateProgramSyntaxError(t *testing.T) {
+	err := ValidateProgram([]byte("name: a\nflags: [\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
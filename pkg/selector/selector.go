@@ -0,0 +1,340 @@
+// Package selector selects a subset of the programs of a repository, using
+// expressions such as
+//
+//	tag:sqleton and not (tag:slow or path:reports/**)
+//
+// An expression is made of terms combined with `and`, `or`, `not` and parentheses.
+// The supported terms are:
+//
+//   - `name:<regexp>` matches the program name or its qualified name against a
+//     regular expression
+//   - `path:<glob>` matches the program file against a doublestar glob, either its
+//     full path or its path relative to the repository directory
+//   - `tag:<tag>` matches programs declaring the tag in their `tags` field
+//
+// A term without prefix is treated as a name regular expression. Values containing
+// spaces can be quoted with single or double quotes.
+package selector
+
+import (
+	"fmt"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Selector is a parsed selection expression.
+type Selector interface {
+	Match(rp *pkg.RepositoryProgram) bool
+	String() string
+}
+
+type all struct{}
+
+func (a all) Match(*pkg.RepositoryProgram) bool { return true }
+func (a all) String() string                    { return "" }
+
+type nameTerm struct {
+	re *regexp.Regexp
+}
+
+func (n *nameTerm) Match(rp *pkg.RepositoryProgram) bool {
+	return n.re.MatchString(rp.Program().Name) || n.re.MatchString(rp.QualifiedName())
+}
+
+func (n *nameTerm) String() string {
+	return "name:" + n.re.String()
+}
+
+type pathTerm struct {
+	glob string
+}
+
+func (p *pathTerm) Match(rp *pkg.RepositoryProgram) bool {
+	for _, path := range []string{rp.Path(), rp.RelativePath()} {
+		if ok, _ := doublestar.Match(p.glob, filepath.ToSlash(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pathTerm) String() string {
+	return "path:" + p.glob
+}
+
+type tagTerm struct {
+	tag string
+}
+
+func (t *tagTerm) Match(rp *pkg.RepositoryProgram) bool {
+	for _, tag := range rp.Spec().Tags {
+		if tag == t.tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tagTerm) String() string {
+	return "tag:" + t.tag
+}
+
+type not struct {
+	s Selector
+}
+
+func (n *not) Match(rp *pkg.RepositoryProgram) bool {
+	return !n.s.Match(rp)
+}
+
+func (n *not) String() string {
+	return "not " + n.s.String()
+}
+
+type and struct {
+	left, right Selector
+}
+
+func (a *and) Match(rp *pkg.RepositoryProgram) bool {
+	return a.left.Match(rp) && a.right.Match(rp)
+}
+
+func (a *and) String() string {
+	return fmt.Sprintf("(%s and %s)", a.left, a.right)
+}
+
+type or struct {
+	left, right Selector
+}
+
+func (o *or) Match(rp *pkg.RepositoryProgram) bool {
+	return o.left.Match(rp) || o.right.Match(rp)
+}
+
+func (o *or) String() string {
+	return fmt.Sprintf("(%s or %s)", o.left, o.right)
+}
+
+// Parse parses a selection expression. An empty expression selects all programs.
+func Parse(s string) (Selector, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return all{}, nil
+	}
+
+	p := &parser{tokens: tokens}
+	ret, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector %q", s)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("invalid selector %q: unexpected %s", s, p.tokens[p.pos].value)
+	}
+
+	return ret, nil
+}
+
+// Filter returns the programs matched by s, sorted by name and qualified name.
+func Filter(s Selector, programs map[string]*pkg.RepositoryProgram) []*pkg.RepositoryProgram {
+	ret := []*pkg.RepositoryProgram{}
+	for _, rp := range programs {
+		if s.Match(rp) {
+			ret = append(ret, rp)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Program().Name != ret[j].Program().Name {
+			return ret[i].Program().Name < ret[j].Program().Name
+		}
+		return ret[i].QualifiedName() < ret[j].QualifiedName()
+	})
+	return ret
+}
+
+type tokenKind int
+
+const (
+	tokenTerm tokenKind = iota
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// tokenize splits an expression into terms and parentheses. Parentheses inside a
+// term, for example in `name:(foo|bar)`, are kept as part of the term as long as
+// they are balanced.
+func tokenize(s string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpen, value: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenClose, value: ")"})
+			i++
+		default:
+			sb := strings.Builder{}
+			depth := 0
+		term:
+			for ; i < len(runes); i++ {
+				c = runes[i]
+				switch {
+				case c == '\'' || c == '"':
+					end := strings.IndexRune(string(runes[i+1:]), c)
+					if end < 0 {
+						return nil, errors.Errorf("unterminated quote in selector %q", s)
+					}
+					quoted := []rune(string(runes[i+1:])[:end])
+					sb.WriteString(string(quoted))
+					i += len(quoted) + 1
+				case c == ' ' || c == '\t' || c == '\n':
+					break term
+				case c == '(':
+					depth++
+					sb.WriteRune(c)
+				case c == ')':
+					if depth == 0 {
+						break term
+					}
+					depth--
+					sb.WriteRune(c)
+				default:
+					sb.WriteRune(c)
+				}
+			}
+			tokens = append(tokens, token{kind: tokenTerm, value: sb.String()})
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	if p.pos >= len(p.tokens) {
+		return false
+	}
+	t := p.tokens[p.pos]
+	return t.kind == tokenTerm && strings.EqualFold(t.value, keyword)
+}
+
+func (p *parser) parseOr() (Selector, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &or{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Selector, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &and{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Selector, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		s, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &not{s: s}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (Selector, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case tokenOpen:
+		s, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenClose {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return s, nil
+	case tokenClose:
+		return nil, errors.New("unexpected )")
+	case tokenTerm:
+		return newTerm(t.value)
+	}
+
+	return nil, errors.Errorf("unexpected %s", t.value)
+}
+
+func newTerm(s string) (Selector, error) {
+	kind, value, ok := strings.Cut(s, ":")
+	if !ok {
+		kind, value = "name", s
+	}
+	if value == "" {
+		return nil, errors.Errorf("empty value in %s", s)
+	}
+
+	switch kind {
+	case "name":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid name pattern %s", value)
+		}
+		return &nameTerm{re: re}, nil
+	case "path":
+		if !doublestar.ValidatePattern(value) {
+			return nil, errors.Errorf("invalid path glob %s", value)
+		}
+		return &pathTerm{glob: value}, nil
+	case "tag":
+		return &tagTerm{tag: value}, nil
+	default:
+		return nil, errors.Errorf("unknown selector %s, expected name:, path: or tag:", kind)
+	}
+}
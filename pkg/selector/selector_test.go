@@ -0,0 +1,66 @@
+package selector
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func loadTestProgram(t *testing.T, path string, s string) *pkg.RepositoryProgram {
+	rp, err := pkg.NewRepositoryProgramFromYAML(strings.NewReader(s), path)
+	require.NoError(t, err)
+	return rp
+}
+
+func TestSelect(t *testing.T) {
+	programs := map[string]*pkg.RepositoryProgram{
+		"ttc-orders": loadTestProgram(t, "reports/sqleton/ttc-orders.yaml", `
+name: ttc-orders
+tags: [sqleton]
+`),
+		"ttc-slow": loadTestProgram(t, "reports/sqleton/ttc-slow.yaml", `
+name: ttc-slow
+tags: [sqleton, slow]
+`),
+		"glaze-json": loadTestProgram(t, "glaze/json.yaml", `
+name: glaze-json
+tags: [glaze]
+`),
+	}
+
+	names := func(expr string) []string {
+		sel, err := Parse(expr)
+		require.NoError(t, err)
+		ret := []string{}
+		for _, rp := range Filter(sel, programs) {
+			ret = append(ret, rp.Program().Name)
+		}
+		return ret
+	}
+
+	assert.Equal(t, []string{"glaze-json", "ttc-orders", "ttc-slow"}, names(""))
+	assert.Equal(t, []string{"ttc-orders"}, names("tag:sqleton and not tag:slow"))
+	assert.Equal(t, []string{"glaze-json", "ttc-slow"}, names("tag:glaze or tag:slow"))
+	assert.Equal(t, []string{"ttc-orders", "ttc-slow"}, names("^ttc-"))
+	assert.Equal(t, []string{"glaze-json", "ttc-orders"}, names("name:(orders|json)$"))
+	assert.Equal(t, []string{"ttc-orders", "ttc-slow"}, names("path:reports/**"))
+	assert.Equal(t, []string{"ttc-slow"}, names("not (tag:glaze or name:orders)"))
+	assert.Equal(t, []string{"ttc-orders"}, names("name:'ttc-o' and path:\"**/*.yaml\""))
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tag:a and",
+		"(tag:a",
+		"tag:a)",
+		"foo:bar",
+		"name:(",
+		"tag:",
+		"name:'unterminated",
+	} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
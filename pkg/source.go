@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Source is a filesystem a repository loads programs from, such as a directory, an
+// embed.FS compiled into a tool, a zip archive opened with zip.OpenReader, or an
+// in-memory fstest.MapFS.
+type Source struct {
+	// Name identifies the source in the paths of its programs, and is the default
+	// namespace of their qualified names.
+	Name string
+	FS   fs.FS
+	// Dir is the directory of the source on disk, for sources that are directories.
+	// Only these sources can be watched for changes, and their programs resolve
+	// relative paths in their arguments against the directory of their program file.
+	Dir string
+}
+
+// NewDirSource returns a source for the directory dir.
+func NewDirSource(dir string) *Source {
+	return &Source{
+		Name: dir,
+		FS:   os.DirFS(dir),
+		Dir:  dir,
+	}
+}
+
+// NewFSSource returns a source for a filesystem that is not on disk. Its programs
+// are read from f, as are the fixtures they declare.
+func NewFSSource(name string, f fs.FS) *Source {
+	return &Source{
+		Name: name,
+		FS:   f,
+	}
+}
+
+// IsWatchable returns true if the source is a directory that can be watched for changes.
+func (s *Source) IsWatchable() bool {
+	return s.Dir != ""
+}
+
+// FilePath returns the path under which the file at fsPath, relative to the source,
+// is known: its path on disk, or its path prefixed with the name of the source.
+func (s *Source) FilePath(fsPath string) string {
+	if s.IsWatchable() {
+		return filepath.Join(s.Dir, fsPath)
+	}
+	return path.Join(s.Name, fsPath)
+}
@@ -0,0 +1,383 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-go-golems/cliopatra/pkg/compare"
+	"github.com/go-go-golems/cliopatra/pkg/environment"
+	"github.com/go-go-golems/cliopatra/pkg/fschange"
+	"github.com/go-go-golems/cliopatra/pkg/normalize"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/cliopatra/pkg/schema"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ProgramSpec contains the fields of a program file that are specific to
+// cliopatra and not part of cliopatra.Program, which lives in glazed.
+//
+// They are decoded from the same YAML document, next to the program fields.
+type ProgramSpec struct {
+	// ExpectedStderrPattern is a regular expression that stderr has to match.
+	ExpectedStderrPattern string `yaml:"expectedStderrPattern,omitempty"`
+	// Normalize is applied to the outputs of the program, after the repository's filters.
+	Normalize normalize.Pipeline `yaml:"normalize,omitempty"`
+	// Compare configures how stdout is compared to the expected output.
+	Compare *compare.Options `yaml:"compare,omitempty"`
+	// Timeout overrides the default timeout of the program, for example 30s or 2m.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Exclusive is the name of an exclusivity group. Programs in the same group are
+	// never run at the same time, even when running programs in parallel.
+	Exclusive string `yaml:"exclusive,omitempty"`
+	// Fixtures are files or directories, relative to the program file, that are
+	// copied into a fresh temporary working directory the program is run in.
+	Fixtures []string `yaml:"fixtures,omitempty"`
+	// Hermetic runs the program in a fresh temporary working directory, even if
+	// it doesn't declare any fixtures.
+	Hermetic bool `yaml:"hermetic,omitempty"`
+	// Tags are used to select programs, for example with `--select tag:slow`.
+	Tags []string `yaml:"tags,omitempty"`
+	// CaptureFileChanges snapshots the working directory before and after the run,
+	// and checks that the program changes exactly the ExpectedFileChanges. It implies
+	// Hermetic.
+	CaptureFileChanges bool `yaml:"captureFileChanges,omitempty"`
+	// ExpectedFileChanges are the files the program creates, modifies or deletes.
+	ExpectedFileChanges []*fschange.Change `yaml:"expectedFileChanges,omitempty"`
+	// IgnoreFileChanges are doublestar globs, relative to the working directory, of
+	// files whose changes are not captured, such as caches or logs.
+	IgnoreFileChanges []string `yaml:"ignoreFileChanges,omitempty"`
+}
+
+// CapturesFileChanges returns true if the file changes of the program have to be captured.
+func (s *ProgramSpec) CapturesFileChanges() bool {
+	return s.CaptureFileChanges || len(s.ExpectedFileChanges) > 0
+}
+
+// IsHermetic returns true if the program runs in a fresh temporary working directory.
+// Programs capturing their file changes always do, so that the snapshots neither
+// include the directory cliopatra is run from nor the files of programs run in parallel.
+func (s *ProgramSpec) IsHermetic() bool {
+	return s.Hermetic || len(s.Fixtures) > 0 || s.CapturesFileChanges()
+}
+
+// parameterLogs decodes the `log` fields that glazed writes next to the flags and
+// arguments of a program, recording the steps that set their values.
+type parameterLogs struct {
+	Flags []*parameterLog `yaml:"flags"`
+	Args  []*parameterLog `yaml:"args"`
+}
+
+type parameterLog struct {
+	Name string                  `yaml:"name"`
+	Log  []*parameters.ParseStep `yaml:"log"`
+}
+
+// NewRepositoryProgramFromYAML loads both the cliopatra.Program and the ProgramSpec
+// from a program file, after validating it against the program schema. Invalid
+// program files fail with a *schema.ValidationError locating each violation.
+func NewRepositoryProgramFromYAML(r io.Reader, path string) (*RepositoryProgram, error) {
+	s, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = schema.ValidateProgram(s)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := cliopatra.NewProgramFromYAML(bytes.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &ProgramSpec{}
+	err = yaml.Unmarshal(s, spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode program spec")
+	}
+
+	logs := &parameterLogs{}
+	err = yaml.Unmarshal(s, logs)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode parameter logs")
+	}
+	log_ := map[string][]*parameters.ParseStep{}
+	for _, l := range append(logs.Args, logs.Flags...) {
+		if len(l.Log) > 0 {
+			log_[l.Name] = l.Log
+		}
+	}
+
+	return &RepositoryProgram{
+		path:    path,
+		program: program,
+		spec:    spec,
+		log:     log_,
+	}, nil
+}
+
+// ParameterLog returns the provenance recorded in the `log` field of the flag or
+// argument name, from the first to the last step that set its value.
+func (rp *RepositoryProgram) ParameterLog(name string) []*parameters.ParseStep {
+	return rp.log[name]
+}
+
+// WithEnvironment returns a copy of rp whose environment is the merge of, from lowest
+// to highest precedence, the default environment of its repository, the selected
+// profile, the env of the program and env, usually passed on the command line.
+//
+// When the repository sets interpolate, `${VAR}` references in the env entries, the
+// raw flags and the flag and argument values of the program are interpolated, falling
+// back to the environment of cliopatra. See package environment. Otherwise, they are
+// passed as written, as they were before repositories could declare environments.
+func (rp *RepositoryProgram) WithEnvironment(profile string, env map[string]string) (*RepositoryProgram, error) {
+	layers := []map[string]string{}
+	interpolate := false
+	if rp.config != nil {
+		layers = rp.config.envLayers(profile)
+		interpolate = rp.config.Interpolate
+	}
+	programEnv := rp.program.Env
+	if !interpolate {
+		programEnv = map[string]string{}
+		for k, v := range rp.program.Env {
+			programEnv[k] = strings.ReplaceAll(v, "${", "$${")
+		}
+	}
+	layers = append(layers, programEnv, env)
+
+	merged, err := environment.Merge(os.LookupEnv, layers...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not compute the environment of %s", rp.program.Name)
+	}
+
+	p := rp.program.Clone()
+	p.Env = merged
+	if !interpolate {
+		ret := *rp
+		ret.program = p
+		return &ret, nil
+	}
+
+	lookup := environment.Chain(environment.MapLookup(merged), os.LookupEnv)
+	for i, f := range p.RawFlags {
+		p.RawFlags[i], err = environment.Interpolate(f, lookup)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not interpolate the raw flags of %s", p.Name)
+		}
+	}
+	for _, param := range append(append([]*cliopatra.Parameter{}, p.Flags...), p.Args...) {
+		err = interpolateParameter(param, lookup)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not interpolate %s of %s", param.Name, p.Name)
+		}
+	}
+
+	ret := *rp
+	ret.program = p
+	return &ret, nil
+}
+
+// PlanRun returns the program PrepareRun would return, without creating the working
+// directory of a hermetic program, for example to show how the program would be run.
+// hermetic is true if the program would be run in a temporary working directory.
+func (rp *RepositoryProgram) PlanRun() (p *cliopatra.Program, hermetic bool, err error) {
+	if rp.err != nil {
+		return nil, false, rp.err
+	}
+	if rp.fs_ != nil {
+		return rp.program.Clone(), rp.spec.IsHermetic(), nil
+	}
+
+	baseDir := filepath.Dir(rp.path)
+	if !rp.spec.IsHermetic() {
+		return runner.ResolvePaths(rp.program, baseDir, nil), false, nil
+	}
+
+	// the fixtures that exist are copied into the working directory
+	p = runner.ResolvePaths(rp.program, baseDir, func(path string) bool {
+		if !runner.IsFixture(rp.spec.Fixtures, path) {
+			return false
+		}
+		_, err := os.Stat(filepath.Join(baseDir, path))
+		return err == nil
+	})
+	return p, true, nil
+}
+
+// WithProgram returns a copy of rp running p instead of its program, for example with
+// values overridden on the command line. The values of p go through PrepareRun like
+// the recorded ones.
+func (rp *RepositoryProgram) WithProgram(p *cliopatra.Program) *RepositoryProgram {
+	ret := *rp
+	ret.program = p
+	return &ret
+}
+
+// interpolateParameter interpolates the raw value of param, and its value if it is a
+// string or a list of strings. As only strings can refer to variables, the values of
+// other types, such as `${LIMIT}` for an int flag, are then parsed according to the
+// type of param.
+func interpolateParameter(param *cliopatra.Parameter, lookup environment.Lookup) error {
+	var err error
+	param.Raw, err = environment.Interpolate(param.Raw, lookup)
+	if err != nil {
+		return err
+	}
+
+	switch v := param.Value.(type) {
+	case string:
+		param.Value, err = environment.Interpolate(v, lookup)
+		if err != nil {
+			return err
+		}
+		return parseInterpolatedValue(param, []string{param.Value.(string)})
+	case []string:
+		values := make([]string, len(v))
+		for i, s := range v {
+			values[i], err = environment.Interpolate(s, lookup)
+			if err != nil {
+				return err
+			}
+		}
+		param.Value = values
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		strs := make([]string, len(v))
+		hasStrings := false
+		for i, s := range v {
+			values[i] = s
+			strs[i] = fmt.Sprint(s)
+			if s, ok := s.(string); ok {
+				hasStrings = true
+				strs[i], err = environment.Interpolate(s, lookup)
+				if err != nil {
+					return err
+				}
+				values[i] = strs[i]
+			}
+		}
+		param.Value = values
+		if hasStrings {
+			return parseInterpolatedValue(param, strs)
+		}
+	}
+
+	return nil
+}
+
+// parseInterpolatedValue sets the value of param to the interpolated strings, parsed
+// as its type if it is a number, a boolean or a list of numbers. Values of other types
+// are left as they are.
+func parseInterpolatedValue(param *cliopatra.Parameter, strs []string) error {
+	//exhaustive:ignore
+	switch param.Type {
+	case parameters.ParameterTypeInteger,
+		parameters.ParameterTypeFloat,
+		parameters.ParameterTypeBool,
+		parameters.ParameterTypeIntegerList,
+		parameters.ParameterTypeFloatList:
+		parsed, err := parameters.NewParameterDefinition(param.Name, param.Type).ParseParameter(strs)
+		if err != nil {
+			return err
+		}
+		param.Value = parsed.Value
+	}
+	return nil
+}
+
+// CompareOptions returns the comparison options of the program. If no format is
+// declared, it is detected from the value of the program's output flag.
+func (rp *RepositoryProgram) CompareOptions() *compare.Options {
+	options := &compare.Options{}
+	if rp.spec != nil && rp.spec.Compare != nil {
+		*options = *rp.spec.Compare
+	}
+	if options.Format == "" {
+		options.Format = compare.DetectFormat(getOutputFlagValue(rp.program))
+	}
+	return options
+}
+
+// getOutputFlagValue returns the value of the --output flag of p, looking at
+// both the typed flags and the raw flags.
+func getOutputFlagValue(p *cliopatra.Program) string {
+	for _, f := range p.Flags {
+		if f.Name == "output" {
+			if f.Raw != "" {
+				return f.Raw
+			}
+			if v, ok := f.Value.(string); ok {
+				return v
+			}
+		}
+	}
+
+	for i, f := range p.RawFlags {
+		if strings.HasPrefix(f, "--output=") {
+			return strings.TrimPrefix(f, "--output=")
+		}
+		if f == "--output" && i+1 < len(p.RawFlags) {
+			return p.RawFlags[i+1]
+		}
+	}
+
+	return ""
+}
+
+// PrepareRun returns the program to run, with its relative argument paths resolved
+// against the directory of the program file. It fails with Err if the program can't
+// be run.
+//
+// If the program is hermetic, see ProgramSpec.IsHermetic, a temporary working
+// directory is created and returned as well. The program has to be run in that directory, which
+// has to be closed once the run and its checks are done.
+//
+// Programs loaded from a source that isn't on disk have their fixtures copied from
+// that source, and their argument paths are left as is.
+func (rp *RepositoryProgram) PrepareRun(keepWorkdir bool) (*cliopatra.Program, *runner.Workdir, error) {
+	if rp.err != nil {
+		return nil, nil, rp.err
+	}
+	if rp.fs_ != nil {
+		if !rp.spec.IsHermetic() {
+			return rp.program.Clone(), nil, nil
+		}
+		f, err := fs.Sub(rp.fs_, path.Dir(rp.fsPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		workdir, err := runner.NewWorkdirFromFS(f, rp.spec.Fixtures, keepWorkdir)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rp.program.Clone(), workdir, nil
+	}
+
+	baseDir := filepath.Dir(rp.path)
+
+	if !rp.spec.IsHermetic() {
+		return runner.ResolvePaths(rp.program, baseDir, nil), nil, nil
+	}
+
+	workdir, err := runner.NewWorkdir(baseDir, rp.spec.Fixtures, keepWorkdir)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := runner.ResolvePaths(rp.program, baseDir, func(path string) bool {
+		_, err := os.Stat(workdir.Resolve(path))
+		return err == nil
+	})
+
+	return p, workdir, nil
+}
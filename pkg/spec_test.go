@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"github.com/go-go-golems/cliopatra/pkg/schema"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// yamlFields returns the names of the yaml fields of the structs vs.
+func yamlFields(vs ...interface{}) []string {
+	ret := []string{}
+	for _, v := range vs {
+		t := reflect.TypeOf(v)
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name != "" && name != "-" {
+				ret = append(ret, name)
+			}
+		}
+	}
+	return ret
+}
+
+func propertyNames(s *schema.Schema) []string {
+	ret := []string{}
+	for name := range s.Properties {
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// TestSchemaMatchesProgramFields catches fields added to cliopatra.Program or to
+// ProgramSpec without being added to the schema, which would reject them.
+func TestSchemaMatchesProgramFields(t *testing.T) {
+	s, err := schema.ProgramSchema()
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, yamlFields(cliopatra.Program{}, ProgramSpec{}), propertyNames(s))
+
+	require.Contains(t, s.Defs, "parameter")
+	assert.ElementsMatch(t,
+		yamlFields(cliopatra.Parameter{}, parameterLog{}),
+		// the name is declared by both structs
+		append(propertyNames(s.Defs["parameter"]), "name"),
+	)
+}
+
+func TestWithEnvironmentParsesInterpolatedValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		param    string
+		env      map[string]string
+		expected interface{}
+		err      string
+	}{
+		{
+			name:     "string",
+			param:    "{name: profile, type: string, value: '${PROFILE}'}",
+			env:      map[string]string{"PROFILE": "prod"},
+			expected: "prod",
+		},
+		{
+			name:     "int",
+			param:    "{name: limit, type: int, value: '${LIMIT}'}",
+			env:      map[string]string{"LIMIT": "12"},
+			expected: 12,
+		},
+		{
+			name:     "int default",
+			param:    "{name: limit, type: int, value: '${LIMIT:-10}'}",
+			expected: 10,
+		},
+		{
+			name:     "float",
+			param:    "{name: ratio, type: float, value: '${RATIO}'}",
+			env:      map[string]string{"RATIO": "0.5"},
+			expected: 0.5,
+		},
+		{
+			name:     "bool",
+			param:    "{name: verbose, type: bool, value: '${VERBOSE}'}",
+			env:      map[string]string{"VERBOSE": "true"},
+			expected: true,
+		},
+		{
+			name:     "int list",
+			param:    "{name: ids, type: intList, value: [1, '${ID}']}",
+			env:      map[string]string{"ID": "2"},
+			expected: []int{1, 2},
+		},
+		{
+			name:     "float list",
+			param:    "{name: ratios, type: floatList, value: ['${RATIO}', 1.5]}",
+			env:      map[string]string{"RATIO": "0.5"},
+			expected: []float64{0.5, 1.5},
+		},
+		{
+			name:     "int without variables",
+			param:    "{name: limit, type: int, value: 3}",
+			expected: 3,
+		},
+		{
+			name:  "invalid int",
+			param: "{name: limit, type: int, value: '${LIMIT}'}",
+			env:   map[string]string{"LIMIT": "many"},
+			err:   "could not interpolate limit of test",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, err := NewRepositoryProgramFromYAML(
+				strings.NewReader("name: test\nflags:\n  - "+tt.param+"\n"),
+				"test.yaml",
+			)
+			require.NoError(t, err)
+			rp.config = &RepositoryConfig{Interpolate: true}
+
+			rp, err = rp.WithEnvironment("", tt.env)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, rp.Program().Flags[0].Value)
+		})
+	}
+}
+
+func TestWithEnvironmentInterpolatesOnlyWhenEnabled(t *testing.T) {
+	rp, err := NewRepositoryProgramFromYAML(strings.NewReader(`name: test
+env:
+  QUERY: select '${NOT_A_VARIABLE}'
+rawFlags: ['${NOT_A_VARIABLE}']
+flags:
+  - {name: profile, type: string, value: '${PROFILE}'}
+`), "test.yaml")
+	require.NoError(t, err)
+
+	ret, err := rp.WithEnvironment("", map[string]string{"PROFILE": "prod"})
+	require.NoError(t, err)
+	assert.Equal(t, "select '${NOT_A_VARIABLE}'", ret.Program().Env["QUERY"])
+	assert.Equal(t, []string{"${NOT_A_VARIABLE}"}, ret.Program().RawFlags)
+	assert.Equal(t, "${PROFILE}", ret.Program().Flags[0].Value)
+
+	rp.config = &RepositoryConfig{Interpolate: true}
+	_, err = rp.WithEnvironment("", map[string]string{"PROFILE": "prod"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NOT_A_VARIABLE")
+}
+
+func TestPrepareRunResolvesPathsOfOverriddenPrograms(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"cat.yaml":     "name: cat\npath: cat\nargs: [{name: file, type: string, value: input.txt}]\n",
+		"input.txt":    "hello\n",
+		"override.txt": "goodbye\n",
+	})
+	rp, err := LoadProgramFile(filepath.Join(dir, "cat.yaml"))
+	require.NoError(t, err)
+
+	p := rp.Program().Clone()
+	p.Args[0].Value = "override.txt"
+	prepared, workdir, err := rp.WithProgram(p).PrepareRun(false)
+	require.NoError(t, err)
+	assert.Nil(t, workdir)
+	assert.Equal(t, filepath.Join(dir, "override.txt"), prepared.Args[0].Value)
+	assert.Equal(t, "input.txt", rp.Program().Args[0].Value)
+}
+
+func TestPlanRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"cat.yaml":      "name: cat\npath: cat\nfixtures: [data]\nargs: [{name: files, type: stringList, value: [data/in.txt, query.sql]}]\n",
+		"data/in.txt":   "hello\n",
+		"query.sql":     "select 1\n",
+		"echo.yaml":     "name: echo\npath: echo\nargs: [{name: file, type: string, value: query.sql}]\n",
+		"hermetic.yaml": "name: pwd\npath: pwd\nhermetic: true\n",
+	})
+
+	rp, err := LoadProgramFile(filepath.Join(dir, "cat.yaml"))
+	require.NoError(t, err)
+	p, hermetic, err := rp.PlanRun()
+	require.NoError(t, err)
+	assert.True(t, hermetic)
+	assert.Equal(t, []interface{}{"data/in.txt", filepath.Join(dir, "query.sql")}, p.Args[0].Value)
+
+	rp, err = LoadProgramFile(filepath.Join(dir, "echo.yaml"))
+	require.NoError(t, err)
+	p, hermetic, err = rp.PlanRun()
+	require.NoError(t, err)
+	assert.False(t, hermetic)
+	assert.Equal(t, filepath.Join(dir, "query.sql"), p.Args[0].Value)
+
+	rp, err = LoadProgramFile(filepath.Join(dir, "hermetic.yaml"))
+	require.NoError(t, err)
+	_, hermetic, err = rp.PlanRun()
+	require.NoError(t, err)
+	assert.True(t, hermetic)
+}
@@ -0,0 +1,497 @@
+// Package workflow runs pipelines of repository programs, such as exporting data
+// with sqleton, reshaping it with glaze and rendering a report.
+//
+// A workflow is declared in a `.workflow.yaml` file next to the program files:
+//
+//	name: ttc-report
+//	steps:
+//	  - name: export
+//	    program: ttc-orders
+//	    flags:
+//	      output: json
+//	  - name: reshape
+//	    program: glaze-json
+//	    stdinFrom: export
+//	  - name: render
+//	    program: render-report
+//	    needs: [reshape]
+//	    flags:
+//	      title: 'Orders ({{ .Steps.reshape.Stdout | trim }})'
+//
+// Steps form a directed acyclic graph through their `needs` and `stdinFrom` fields,
+// and run in parallel as soon as the steps they depend on have succeeded. Flag and
+// argument values are templates that can refer to the outputs of the steps a step
+// depends on.
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/go-go-golems/cliopatra/pkg/helpers/maps"
+	"github.com/go-go-golems/cliopatra/pkg/overrides"
+	"github.com/go-go-golems/cliopatra/pkg/runner"
+	"github.com/go-go-golems/glazed/pkg/cli/cliopatra"
+	"github.com/go-go-golems/glazed/pkg/helpers/templating"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step runs a repository program.
+type Step struct {
+	Name    string `yaml:"name"`
+	Program string `yaml:"program"`
+	// Needs are the names of the steps that have to succeed before this step runs.
+	Needs []string `yaml:"needs,omitempty"`
+	// StdinFrom is the name of a step whose stdout is passed to the program as stdin.
+	// The step is implicitly needed.
+	StdinFrom string `yaml:"stdinFrom,omitempty"`
+	// Flags and Args override the values of the program's parameters. They are
+	// templates rendered with the outputs of the needed steps as `.Steps.<name>`.
+	Flags map[string]string `yaml:"flags,omitempty"`
+	Args  map[string]string `yaml:"args,omitempty"`
+}
+
+// dependencies returns the names of the steps s directly depends on.
+func (s *Step) dependencies() []string {
+	ret := append([]string{}, s.Needs...)
+	if s.StdinFrom != "" {
+		ret = append(ret, s.StdinFrom)
+	}
+	return ret
+}
+
+// Workflow is a set of steps loaded from a workflow file.
+type Workflow struct {
+	Name        string  `yaml:"name"`
+	Description string  `yaml:"description,omitempty"`
+	Steps       []*Step `yaml:"steps"`
+
+	path string
+}
+
+func (w *Workflow) Path() string {
+	return w.path
+}
+
+// NewWorkflowFromYAML loads and validates a workflow file.
+func NewWorkflowFromYAML(r io.Reader, path string) (*Workflow, error) {
+	w := &Workflow{}
+	err := yaml.NewDecoder(r).Decode(w)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode workflow")
+	}
+	w.path = path
+
+	err = w.Validate()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid workflow %s", path)
+	}
+
+	return w, nil
+}
+
+// LoadWorkflowsFromFS loads all the workflow files in dir and its subdirectories.
+func LoadWorkflowsFromFS(f fs.FS, dir string) ([]*Workflow, error) {
+	ret := []*Workflow{}
+
+	err := fs.WalkDir(f, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !pkg.IsWorkflowFile(d.Name()) {
+			return nil
+		}
+
+		file, err := f.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "could not open file %s", path)
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		w, err := NewWorkflowFromYAML(file, path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, w)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Validate checks that the steps have unique names, only depend on existing steps,
+// and don't form a cycle.
+func (w *Workflow) Validate() error {
+	if w.Name == "" {
+		return errors.New("workflow has no name")
+	}
+	if len(w.Steps) == 0 {
+		return errors.Errorf("workflow %s has no steps", w.Name)
+	}
+
+	steps := map[string]*Step{}
+	for _, s := range w.Steps {
+		if s.Name == "" {
+			return errors.New("step has no name")
+		}
+		if s.Program == "" {
+			return errors.Errorf("step %s has no program", s.Name)
+		}
+		if _, ok := steps[s.Name]; ok {
+			return errors.Errorf("step %s is declared twice", s.Name)
+		}
+		steps[s.Name] = s
+	}
+	for _, s := range w.Steps {
+		for _, d := range s.dependencies() {
+			if _, ok := steps[d]; !ok {
+				return errors.Errorf("step %s depends on unknown step %s", s.Name, d)
+			}
+		}
+	}
+
+	// depth-first search, a step being visited that is reached again closes a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(s *Step, path []string) error
+	visit = func(s *Step, path []string) error {
+		switch state[s.Name] {
+		case visiting:
+			return errors.Errorf("steps form a cycle: %s", strings.Join(append(path, s.Name), " -> "))
+		case visited:
+			return nil
+		}
+		state[s.Name] = visiting
+		for _, d := range s.dependencies() {
+			err := visit(steps[d], append(path, s.Name))
+			if err != nil {
+				return err
+			}
+		}
+		state[s.Name] = visited
+		return nil
+	}
+	for _, s := range w.Steps {
+		err := visit(s, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Status is the outcome of a step.
+type Status string
+
+const (
+	// StatusSuccess means that the program exited with 0.
+	StatusSuccess Status = "success"
+	// StatusFailed means that the program exited with a non-zero exit code.
+	StatusFailed Status = "failed"
+	// StatusError means that the program couldn't be run, for example because
+	// it wasn't found or timed out.
+	StatusError Status = "error"
+	// StatusSkipped means that a step the step depends on didn't succeed.
+	StatusSkipped Status = "skipped"
+)
+
+// StepResult is the outcome of running a step.
+type StepResult struct {
+	Name     string
+	Program  string
+	Status   Status
+	Output   *runner.Output
+	Duration time.Duration
+	Err      error
+}
+
+// StepOutput are the outputs of a step, as exposed to the templates of the steps
+// depending on it.
+type StepOutput struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+type templateData struct {
+	Steps map[string]*StepOutput
+}
+
+// ProgramLookup returns the repository program with the given name, such as
+// pkg.Repository.Lookup.
+type ProgramLookup func(name string) (*pkg.RepositoryProgram, error)
+
+type settings struct {
+	jobs          int
+	runnerOptions []runner.Option
+}
+
+type Option func(s *settings)
+
+// WithJobs runs up to jobs steps at the same time. The default is 1.
+func WithJobs(jobs int) Option {
+	return func(s *settings) {
+		s.jobs = jobs
+	}
+}
+
+// WithRunnerOptions passes options to the runner of each step, for example a
+// default timeout.
+func WithRunnerOptions(options ...runner.Option) Option {
+	return func(s *settings) {
+		s.runnerOptions = append(s.runnerOptions, options...)
+	}
+}
+
+// Run runs the steps of the workflow, each as soon as the steps it depends on have
+// succeeded. Steps depending on a step that didn't succeed are skipped, while
+// independent steps keep running.
+//
+// The programs are looked up with lookup before any step is run. The results are
+// returned in the order of the steps.
+func (w *Workflow) Run(ctx context.Context, lookup ProgramLookup, options ...Option) ([]*StepResult, error) {
+	s := &settings{jobs: 1}
+	for _, option := range options {
+		option(s)
+	}
+
+	programs := map[string]*pkg.RepositoryProgram{}
+	for _, step := range w.Steps {
+		rp, err := lookup(step.Program)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not find the program of step %s", step.Name)
+		}
+		programs[step.Name] = rp
+	}
+
+	steps := map[string]*Step{}
+	for _, step := range w.Steps {
+		steps[step.Name] = step
+	}
+
+	results := map[string]*StepResult{}
+	done := map[string]chan struct{}{}
+	for _, step := range w.Steps {
+		results[step.Name] = &StepResult{Name: step.Name, Program: step.Program}
+		done[step.Name] = make(chan struct{})
+	}
+
+	pool := runner.NewPool(s.jobs)
+	wg := sync.WaitGroup{}
+	for _, step := range w.Steps {
+		step := step
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[step.Name])
+			res := results[step.Name]
+
+			// wait for the dependencies first, so that waiting steps don't hold a worker
+			for _, d := range step.dependencies() {
+				select {
+				case <-done[d]:
+				case <-ctx.Done():
+					res.Status = StatusError
+					res.Err = ctx.Err()
+					return
+				}
+				if results[d].Status != StatusSuccess {
+					res.Status = StatusSkipped
+					res.Err = errors.Errorf("step %s did not succeed", d)
+					return
+				}
+			}
+
+			rp := programs[step.Name]
+			err := pool.Do(ctx, &runner.Task{
+				Group: rp.Spec().Exclusive,
+				Run: func(ctx context.Context) error {
+					data := &templateData{Steps: map[string]*StepOutput{}}
+					collectOutputs(step, steps, results, data.Steps)
+					runStep(ctx, step, rp, data, res, s)
+					return nil
+				},
+			})
+			if err != nil {
+				res.Status = StatusError
+				res.Err = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	ret := make([]*StepResult, len(w.Steps))
+	for i, step := range w.Steps {
+		ret[i] = results[step.Name]
+	}
+	return ret, nil
+}
+
+// collectOutputs adds the outputs of all the steps step depends on, directly or
+// transitively, to outputs. These steps are all done.
+func collectOutputs(step *Step, steps map[string]*Step, results map[string]*StepResult, outputs map[string]*StepOutput) {
+	for _, d := range step.dependencies() {
+		if _, ok := outputs[d]; ok {
+			continue
+		}
+		output := results[d].Output
+		outputs[d] = &StepOutput{
+			Stdout:   output.Stdout,
+			Stderr:   output.Stderr,
+			ExitCode: output.ExitCode,
+		}
+		collectOutputs(steps[d], steps, results, outputs)
+	}
+}
+
+func runStep(
+	ctx context.Context,
+	step *Step,
+	rp *pkg.RepositoryProgram,
+	data *templateData,
+	res *StepResult,
+	s *settings,
+) {
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	// the step parameters are set first, so that their paths are resolved like the
+	// recorded ones
+	p := rp.Program().Clone()
+	err := applyParameters(step, p, data)
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return
+	}
+
+	p, workdir, err := rp.WithProgram(p).PrepareRun(false)
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return
+	}
+	options := append([]runner.Option{}, s.runnerOptions...)
+	if workdir != nil {
+		defer func() {
+			_ = workdir.Close()
+		}()
+		options = append(options, runner.WithDir(workdir.Path))
+	}
+	if rp.Spec().Timeout > 0 {
+		options = append(options, runner.WithTimeout(rp.Spec().Timeout))
+	}
+
+	output, err := runner.NewRunner(options...).Run(ctx, p)
+	res.Output = output
+	if err != nil {
+		res.Status = StatusError
+		res.Err = err
+		return
+	}
+	res.Status = StatusSuccess
+	if output.ExitCode != 0 {
+		res.Status = StatusFailed
+		res.Err = errors.Errorf("%s exited with code %d", p.Name, output.ExitCode)
+	}
+}
+
+// applyParameters renders the flag and argument templates of step, and sets them on p
+// along with the stdin of the step.
+func applyParameters(step *Step, p *cliopatra.Program, data *templateData) error {
+	if step.StdinFrom != "" {
+		p.Stdin = data.Steps[step.StdinFrom].Stdout
+	}
+
+	for _, name := range maps.SortedKeys(step.Flags) {
+		v, err := renderValue(step.Name+".flags."+name, step.Flags[name], data)
+		if err != nil {
+			return err
+		}
+		err = overrides.SetFlag(p, name, v)
+		if err != nil {
+			return errors.Wrapf(err, "step %s", step.Name)
+		}
+	}
+	for _, name := range maps.SortedKeys(step.Args) {
+		v, err := renderValue(step.Name+".args."+name, step.Args[name], data)
+		if err != nil {
+			return err
+		}
+		err = overrides.SetArg(p, name, v)
+		if err != nil {
+			return errors.Wrapf(err, "step %s", step.Name)
+		}
+	}
+
+	return nil
+}
+
+func renderValue(name string, value string, data *templateData) (string, error) {
+	t, err := templating.CreateTemplate(name).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not parse template %s", name)
+	}
+	buf := &bytes.Buffer{}
+	err = t.Execute(buf, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not render template %s", name)
+	}
+	return buf.String(), nil
+}
+
+// FindWorkflow returns the workflow with the given name among workflows.
+func FindWorkflow(workflows []*Workflow, name string) (*Workflow, bool) {
+	for _, w := range workflows {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return nil, false
+}
+
+// LoadWorkflows loads the workflows of all the sources of a repository, see
+// pkg.Repository.Sources. Their paths are the ones of the program files of the
+// sources. Workflow names have to be unique.
+func LoadWorkflows(sources []*pkg.Source) ([]*Workflow, error) {
+	ret := []*Workflow{}
+	names := map[string]string{}
+	for _, source := range sources {
+		workflows, err := LoadWorkflowsFromFS(source.FS, ".")
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load workflows from repository %s", source.Name)
+		}
+		for _, w := range workflows {
+			w.path = source.FilePath(w.path)
+			if other, ok := names[w.Name]; ok {
+				return nil, errors.Errorf("workflow %s is declared in both %s and %s", w.Name, other, w.path)
+			}
+			names[w.Name] = w.path
+			ret = append(ret, w)
+		}
+	}
+	return ret, nil
+}
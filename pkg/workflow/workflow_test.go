@@ -0,0 +1,209 @@
+package workflow
+
+import (
+	"context"
+	"github.com/go-go-golems/cliopatra/pkg"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func loadTestWorkflow(t *testing.T, s string) *Workflow {
+	w, err := NewWorkflowFromYAML(strings.NewReader(s), "test.workflow.yaml")
+	require.NoError(t, err)
+	return w
+}
+
+func testPrograms(t *testing.T) ProgramLookup {
+	rps := map[string]*pkg.RepositoryProgram{}
+	for _, s := range []string{`
+name: letters
+path: sh
+rawFlags: [-c, "printf 'b\\na\\nc\\n'"]
+`, `
+name: sort
+path: sort
+`, `
+name: echo
+path: echo
+args:
+  - name: message
+    type: string
+    value: nothing
+`, `
+name: fail
+path: sh
+rawFlags: [-c, "exit 2"]
+`} {
+		rp, err := pkg.NewRepositoryProgramFromYAML(strings.NewReader(s), "test.yaml")
+		require.NoError(t, err)
+		rps[rp.Program().Name] = rp
+	}
+	return func(name string) (*pkg.RepositoryProgram, error) {
+		rp, ok := rps[name]
+		if !ok {
+			return nil, errors.Errorf("program %s not found", name)
+		}
+		return rp, nil
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		steps string
+		err   string
+	}{
+		{"duplicate", "[{name: a, program: echo}, {name: a, program: echo}]", "step a is declared twice"},
+		{"unknown", "[{name: a, program: echo, needs: [b]}]", "step a depends on unknown step b"},
+		{"unknown stdin", "[{name: a, program: echo, stdinFrom: b}]", "step a depends on unknown step b"},
+		{"no program", "[{name: a}]", "step a has no program"},
+		{"cycle", "[{name: a, program: echo, needs: [c]}, {name: b, program: echo, needs: [a]}, {name: c, program: echo, stdinFrom: b}]",
+			"steps form a cycle: a -> c -> b -> a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewWorkflowFromYAML(strings.NewReader("name: w\nsteps: "+tc.steps), "w.workflow.yaml")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	w := loadTestWorkflow(t, `
+name: sorted
+steps:
+  - name: letters
+    program: letters
+  - name: sort
+    program: sort
+    stdinFrom: letters
+  - name: first
+    program: echo
+    needs: [sort]
+    args:
+      message: 'first is {{ .Steps.sort.Stdout | splitList "\n" | first }} of {{ .Steps.letters.Stdout | trim | splitList "\n" | len }}'
+`)
+	results, err := w.Run(context.Background(), testPrograms(t), WithJobs(2))
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	for _, res := range results {
+		assert.Equal(t, StatusSuccess, res.Status, res.Name)
+	}
+	assert.Equal(t, "a\nb\nc\n", results[1].Output.Stdout)
+	assert.Equal(t, "first is a of 3\n", results[2].Output.Stdout)
+}
+
+func TestRunSkipsDependentsOfFailedSteps(t *testing.T) {
+	w := loadTestWorkflow(t, `
+name: failing
+steps:
+  - name: fail
+    program: fail
+  - name: after
+    program: echo
+    needs: [fail]
+  - name: independent
+    program: echo
+`)
+	results, err := w.Run(context.Background(), testPrograms(t), WithJobs(4))
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusFailed, results[0].Status)
+	assert.Equal(t, 2, results[0].Output.ExitCode)
+	assert.Equal(t, StatusSkipped, results[1].Status)
+	assert.Equal(t, StatusSuccess, results[2].Status)
+	assert.Equal(t, "nothing\n", results[2].Output.Stdout)
+}
+
+func TestRunOnlyExposesDependencies(t *testing.T) {
+	w := loadTestWorkflow(t, `
+name: unrelated
+steps:
+  - name: letters
+    program: letters
+  - name: echo
+    program: echo
+    args:
+      message: '{{ .Steps.letters.Stdout }}'
+`)
+	results, err := w.Run(context.Background(), testPrograms(t))
+	require.NoError(t, err)
+	assert.Equal(t, StatusError, results[1].Status)
+	assert.Contains(t, results[1].Err.Error(), "could not render template")
+}
+
+func TestRunResolvesPathsOfStepParameters(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cat.yaml"), []byte(`name: cat
+path: cat
+args:
+  - name: file
+    type: string
+    value: missing.txt
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "input.txt"), []byte("hello\n"), 0644))
+	r := pkg.NewRepository([]string{dir})
+	require.NoError(t, r.Load())
+
+	w := loadTestWorkflow(t, `
+name: cat
+steps:
+  - name: cat
+    program: cat
+    args:
+      file: '{{ "input.txt" }}'
+`)
+	results, err := w.Run(context.Background(), r.Lookup)
+	require.NoError(t, err)
+	require.Equal(t, StatusSuccess, results[0].Status, results[0].Err)
+	assert.Equal(t, "hello\n", results[0].Output.Stdout)
+}
+
+func TestRunUnknownProgram(t *testing.T) {
+	w := loadTestWorkflow(t, "name: w\nsteps: [{name: a, program: missing}]")
+	_, err := w.Run(context.Background(), testPrograms(t))
+	require.Error(t, err)
+}
+
+func TestLoadWorkflowsFromFS(t *testing.T) {
+	f := fstest.MapFS{
+		"echo.yaml":                    {Data: []byte("name: echo\npath: echo\n")},
+		"reports/daily.workflow.yaml":  {Data: []byte("name: daily\nsteps: [{name: a, program: echo}]\n")},
+		"reports/weekly.workflow.yml":  {Data: []byte("name: weekly\nsteps: [{name: a, program: echo}]\n")},
+		".hidden/hidden.workflow.yaml": {Data: []byte("name: hidden\nsteps: [{name: a, program: echo}]\n")},
+	}
+	workflows, err := LoadWorkflowsFromFS(f, ".")
+	require.NoError(t, err)
+	require.Len(t, workflows, 2)
+	assert.Equal(t, "daily", workflows[0].Name)
+	assert.Equal(t, "reports/daily.workflow.yaml", workflows[0].Path())
+	assert.Equal(t, "weekly", workflows[1].Name)
+
+	rps, err := pkg.LoadProgramsFromFS(f, ".")
+	require.NoError(t, err)
+	require.Len(t, rps, 1)
+}
+
+func TestLoadWorkflows(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "daily.workflow.yaml"), []byte("name: daily\nsteps: [{name: a, program: echo}]\n"), 0644))
+	embedded := pkg.NewFSSource("embedded", fstest.MapFS{
+		"weekly.workflow.yaml": {Data: []byte("name: weekly\nsteps: [{name: a, program: echo}]\n")},
+	})
+
+	workflows, err := LoadWorkflows([]*pkg.Source{pkg.NewDirSource(dir), embedded})
+	require.NoError(t, err)
+	require.Len(t, workflows, 2)
+	assert.Equal(t, filepath.Join(dir, "daily.workflow.yaml"), workflows[0].Path())
+	assert.Equal(t, "embedded/weekly.workflow.yaml", workflows[1].Path())
+
+	_, err = LoadWorkflows([]*pkg.Source{embedded, embedded})
+	assert.ErrorContains(t, err, "workflow weekly is declared in both")
+}
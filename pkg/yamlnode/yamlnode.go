@@ -0,0 +1,100 @@
+// Package yamlnode edits YAML documents at the yaml.Node level, so that key order,
+// comments and indentation survive rewriting program files.
+package yamlnode
+
+import (
+	"bufio"
+	"bytes"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// Key returns the key node of key in the mapping node, or nil if it is not present.
+func Key(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i]
+		}
+	}
+	return nil
+}
+
+// Get returns the value of key in the mapping node, or nil if it is not present.
+func Get(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Set replaces the value of key in the mapping node, or appends it if the key is
+// not present. The comments attached to the previous value are kept.
+func Set(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			value.HeadComment = mapping.Content[i+1].HeadComment
+			value.LineComment = mapping.Content[i+1].LineComment
+			value.FootComment = mapping.Content[i+1].FootComment
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		value,
+	)
+}
+
+// Delete removes key from the mapping node, if it is present.
+func Delete(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// NewString returns a string scalar, using the literal block style for multiline
+// values so that the stored outputs stay readable in diffs.
+func NewString(s string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+	if strings.Contains(s, "\n") {
+		n.Style = yaml.LiteralStyle
+	}
+	return n
+}
+
+// DetectIndent returns the indentation used by the first indented line of s,
+// falling back to 2 spaces.
+func DetectIndent(s []byte) int {
+	scanner := bufio.NewScanner(bytes.NewReader(s))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == line || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		return len(line) - len(trimmed)
+	}
+	return 2
+}
+
+// Encode encodes doc with the indentation of original, the content it was decoded from.
+func Encode(doc *yaml.Node, original []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(DetectIndent(original))
+	err := encoder.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,48 @@
+package yamlnode
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+func TestEdit(t *testing.T) {
+	s := []byte(`name: echo
+flags:
+    - name: limit
+# the expected output
+expectedStdout: hello # keep me
+expectedError: oops
+`)
+	var doc yaml.Node
+	require.NoError(t, yaml.Unmarshal(s, &doc))
+	root := doc.Content[0]
+
+	assert.Equal(t, "echo", Get(root, "name").Value)
+	assert.Nil(t, Get(root, "path"))
+	assert.Equal(t, 5, Key(root, "expectedStdout").Line)
+	assert.Nil(t, Key(root, "path"))
+
+	Set(root, "expectedStdout", NewString("hello\nworld\n"))
+	Set(root, "path", NewString("echo"))
+	Delete(root, "expectedError")
+	Delete(root, "missing")
+
+	b, err := Encode(&doc, s)
+	require.NoError(t, err)
+	assert.Equal(t, `name: echo
+flags:
+    - name: limit
+# the expected output
+expectedStdout: | # keep me
+    hello
+    world
+path: echo
+`, string(b))
+}
+
+func TestDetectIndent(t *testing.T) {
+	assert.Equal(t, 2, DetectIndent([]byte("name: echo\n")))
+	assert.Equal(t, 4, DetectIndent([]byte("# comment\n  # indented comment\nflags:\n    - name: x\n")))
+}